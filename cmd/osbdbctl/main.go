@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/duglin/osbdb/dbclient"
+	"github.com/duglin/osbdb/osbclient"
+)
+
+var brokerURL = "http://localhost"
+var user = "user"
+var password = "passw0rd"
+var token = ""
+var out = &Output{Format: "table", Writer: os.Stdout}
+
+// Canceled on ^C so things like "watch" stop cleanly
+var ctx = context.Background()
+var dbc = dbclient.NewClient()
+
+type Command struct {
+	Name  string
+	Args  string
+	Short string
+	Run   func(args []string)
+}
+
+var commands = []*Command{}
+
+func init() {
+	commands = []*Command{
+		{"catalog", "", "Show the broker's catalog", catalogCmd},
+		{"instances", "", "List all instances", instancesCmd},
+		{"provision", "[flags] INSTANCE", "Create an instance", provisionCmd},
+		{"update", "[flags] INSTANCE", "Update an instance", updateCmd},
+		{"deprovision", "[flags] INSTANCE", "Delete an instance", deprovisionCmd},
+		{"bind", "[flags] INSTANCE BINDING", "Create a binding", bindCmd},
+		{"unbind", "[flags] INSTANCE BINDING", "Delete a binding", unbindCmd},
+		{"backup", "INSTANCE [NAME]", "Save a backup of an instance's DB", backupCmd},
+		{"backups", "[INSTANCE]", "List the backups, of all instances or one", backupsCmd},
+		{"delete-backup", "NAME", "Delete a backup", deleteBackupCmd},
+		{"replication", "", "Show whether the broker is a leader or follower", replicationCmd},
+		{"promote", "", "Make a follower the leader", promoteCmd},
+		{"dbs", "", "List all DBs", dbsCmd},
+		{"create-db", "[DB]", "Create a DB", createDBCmd},
+		{"delete-db", "DB", "Delete a DB", deleteDBCmd},
+		{"keys", "DB [PREFIX]", "List the keys in a DB", keysCmd},
+		{"get", "DB KEY", "Show the value of a key", getCmd},
+		{"set", "DB KEY VALUE", "Set a key, VALUE of '-' means stdin", setCmd},
+		{"del", "DB KEY", "Delete a key", delCmd},
+		{"watch", "DB [PREFIX]", "Show changes to keys as they happen", watchCmd},
+		{"pub", "DB CHANNEL MESSAGE", "Publish a message, MESSAGE of '-' means stdin", pubCmd},
+		{"sub", "DB CHANNEL", "Show messages sent to a channel", subCmd},
+		{"export", "[flags] DB [FILE]", "Save all keys of a DB as NDJSON or JSON", exportCmd},
+		{"import", "[flags] DB [FILE]", "Load keys into a DB from an export", importCmd},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: osbdbctl [flags] COMMAND [args]\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	tw := &Output{Writer: os.Stderr}
+	rows := [][]string{}
+	for _, cmd := range commands {
+		rows = append(rows, []string{"  " + cmd.Name + " " + cmd.Args,
+			cmd.Short})
+	}
+	tw.Print(nil, nil, rows)
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func main() {
+	brokerURL = envOr("OSBDB_URL", brokerURL)
+	user = envOr("OSBDB_USER", user)
+	password = envOr("OSBDB_PASSWORD", password)
+	token = envOr("OSBDB_TOKEN", token)
+
+	flag.StringVar(&brokerURL, "s", brokerURL, "URL of the broker ($OSBDB_URL)")
+	flag.StringVar(&user, "u", user, "Username for broker/DB admin ($OSBDB_USER)")
+	flag.StringVar(&password, "w", password, "Password for broker/DB admin ($OSBDB_PASSWORD)")
+	flag.StringVar(&token, "t", token, "Bearer token for the broker ($OSBDB_TOKEN)")
+	flag.StringVar(&out.Format, "o", out.Format, "Output format: table, json or yaml")
+	flag.DurationVar(&dbc.Timeout, "timeout", dbc.Timeout, "Timeout for each DB request")
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := out.CheckFormat(); err != nil {
+		fatal("%s", err)
+	}
+	brokerURL = strings.TrimRight(brokerURL, "/")
+	dbc.Token = token
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	var cancel context.CancelFunc
+	ctx, cancel = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			cmd.Run(flag.Args()[1:])
+			return
+		}
+	}
+	fatal("Unknown command %q, see 'osbdbctl -h'", name)
+}
+
+// needArgs checks that there are between low and high args
+func needArgs(fs *flag.FlagSet, low, high int) {
+	if fs.NArg() < low || fs.NArg() > high {
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.Name == name {
+				fmt.Fprintf(os.Stderr, "Usage: osbdbctl %s %s\n", name,
+					cmd.Args)
+				fmt.Fprintf(os.Stderr, "%s\n", cmd.Short)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+/* OSB Commands */
+/****************/
+
+func osbClient() *osbclient.Client {
+	client := osbclient.NewClient(brokerURL, user, password)
+	client.Token = token
+	return client
+}
+
+// Params is a flag.Value for repeated "-p key=value" flags
+type Params map[string]string
+
+func (p Params) String() string {
+	return fmt.Sprintf("%v", map[string]string(p))
+}
+
+func (p Params) Set(str string) error {
+	i := strings.Index(str, "=")
+	if i <= 0 {
+		return fmt.Errorf("Must be of the form key=value")
+	}
+	p[str[:i]] = str[i+1:]
+	return nil
+}
+
+// osbFlags adds the flags common to most OSB commands
+func osbFlags(fs *flag.FlagSet) (*string, *string, Params) {
+	serviceID := fs.String("service", "", "Service ID (default: look it up)")
+	planID := fs.String("plan", "", "Plan ID (default: look it up)")
+	params := Params{}
+	fs.Var(params, "p", "Parameter as key=value (can be repeated)")
+	return serviceID, planID, params
+}
+
+// lookupIDs fills in the service/plan IDs if they weren't specified. For
+// existing instances we ask the broker, otherwise we use the first plan
+// of the first service in the catalog.
+func lookupIDs(instanceID string, serviceID, planID *string) {
+	if *serviceID != "" && *planID != "" {
+		return
+	}
+
+	if instanceID != "" {
+		instances, err := dbc.GetInstances(ctx, brokerURL+"/admin/instances",
+			user, password)
+		if err == nil {
+			for _, i := range instances {
+				if i.ID == instanceID {
+					if *serviceID == "" {
+						*serviceID = i.ServiceID
+					}
+					if *planID == "" {
+						*planID = i.PlanID
+					}
+					return
+				}
+			}
+		}
+	}
+
+	catalog, err := osbClient().Catalog(ctx)
+	if err != nil {
+		fatal("%s", err)
+	}
+	for _, service := range catalog.Services {
+		if *serviceID != "" && *serviceID != service.ID {
+			continue
+		}
+		*serviceID = service.ID
+		if *planID == "" && len(service.Plans) > 0 {
+			*planID = service.Plans[0].ID
+		}
+		return
+	}
+	fatal("Can't find service %q in the catalog", *serviceID)
+}
+
+func catalogCmd(args []string) {
+	fs := newFlagSet("catalog")
+	fs.Parse(args)
+	needArgs(fs, 0, 0)
+
+	catalog, err := osbClient().Catalog(ctx)
+	if err != nil {
+		fatal("%s", err)
+	}
+
+	rows := [][]string{}
+	for _, s := range catalog.Services {
+		for _, p := range s.Plans {
+			rows = append(rows, []string{s.Name, s.ID, p.Name, p.ID,
+				p.Description})
+		}
+	}
+	show(catalog, []string{"SERVICE", "SERVICE ID", "PLAN", "PLAN ID",
+		"DESCRIPTION"}, rows)
+}
+
+func instancesCmd(args []string) {
+	fs := newFlagSet("instances")
+	fs.Parse(args)
+	needArgs(fs, 0, 0)
+
+	instances, err := dbc.GetInstances(ctx, brokerURL+"/admin/instances",
+		user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+
+	rows := [][]string{}
+	for _, i := range instances {
+		rows = append(rows, []string{i.ID, i.ServiceID, i.PlanID, i.DBURL,
+			strings.Join(i.Bindings, ",")})
+	}
+	show(instances, []string{"INSTANCE", "SERVICE ID", "PLAN ID",
+		"DB URL", "BINDINGS"}, rows)
+}
+
+func backupCmd(args []string) {
+	fs := newFlagSet("backup")
+	fs.Parse(args)
+	needArgs(fs, 1, 2)
+
+	info, err := dbc.CreateBackup(ctx, brokerURL, fs.Arg(0), fs.Arg(1), user,
+		password)
+	if err != nil {
+		fatal("%s", err)
+	}
+	printBackups(info, []*dbclient.BackupInfo{info})
+}
+
+func backupsCmd(args []string) {
+	fs := newFlagSet("backups")
+	fs.Parse(args)
+	needArgs(fs, 0, 1)
+
+	infos, err := dbc.GetBackups(ctx, brokerURL, fs.Arg(0), user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+	printBackups(infos, infos)
+}
+
+func printBackups(obj interface{}, infos []*dbclient.BackupInfo) {
+	rows := [][]string{}
+	for _, b := range infos {
+		rows = append(rows, []string{b.Name, b.InstanceID,
+			b.Created.Format(time.RFC3339), strconv.Itoa(b.Keys),
+			strconv.FormatInt(b.Size, 10)})
+	}
+	show(obj, []string{"NAME", "INSTANCE", "CREATED", "KEYS", "SIZE"},
+		rows)
+}
+
+func deleteBackupCmd(args []string) {
+	fs := newFlagSet("delete-backup")
+	fs.Parse(args)
+	needArgs(fs, 1, 1)
+
+	if err := dbc.DeleteBackup(ctx, brokerURL, fs.Arg(0), user,
+		password); err != nil {
+		fatal("%s", err)
+	}
+}
+
+func replicationCmd(args []string) {
+	fs := newFlagSet("replication")
+	fs.Parse(args)
+	needArgs(fs, 0, 0)
+
+	status, err := dbc.GetReplication(ctx, brokerURL, user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+	printReplication(status)
+}
+
+func promoteCmd(args []string) {
+	fs := newFlagSet("promote")
+	fs.Parse(args)
+	needArgs(fs, 0, 0)
+
+	status, err := dbc.Promote(ctx, brokerURL, user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+	printReplication(status)
+}
+
+func printReplication(status *dbclient.ReplicationStatus) {
+	show(status, []string{"ROLE", "LEADER", "CONNECTED", "SYNCED",
+		"SEQ", "FOLLOWERS"},
+		[][]string{{status.Role, status.Leader,
+			strconv.FormatBool(status.Connected),
+			strconv.FormatBool(status.Synced),
+			strconv.FormatUint(status.Seq, 10),
+			strconv.Itoa(status.Followers)}})
+}
+
+func provisionCmd(args []string) {
+	fs := newFlagSet("provision")
+	serviceID, planID, params := osbFlags(fs)
+	orgID := fs.String("org", "", "Organization GUID")
+	spaceID := fs.String("space", "", "Space GUID")
+	fs.Parse(args)
+	needArgs(fs, 1, 1)
+
+	lookupIDs("", serviceID, planID)
+
+	pReq := &osbclient.ProvisionRequest{
+		ServiceID:  *serviceID,
+		PlanID:     *planID,
+		OrgID:      *orgID,
+		SpaceID:    *spaceID,
+		Parameters: params,
+	}
+	if len(params) == 0 {
+		pReq.Parameters = nil
+	}
+
+	res, err := osbClient().Provision(ctx, fs.Arg(0), pReq)
+	if err != nil {
+		fatal("%s", err)
+	}
+	show(res, []string{"INSTANCE", "SERVICE ID", "PLAN ID"},
+		[][]string{{fs.Arg(0), *serviceID, *planID}})
+}
+
+func updateCmd(args []string) {
+	fs := newFlagSet("update")
+	serviceID, planID, params := osbFlags(fs)
+	fs.Parse(args)
+	needArgs(fs, 1, 1)
+
+	lookupIDs(fs.Arg(0), serviceID, planID)
+
+	uReq := &osbclient.UpdateRequest{
+		ServiceID:  *serviceID,
+		PlanID:     *planID,
+		Parameters: params,
+	}
+	if len(params) == 0 {
+		uReq.Parameters = nil
+	}
+
+	if _, err := osbClient().Update(ctx, fs.Arg(0), uReq); err != nil {
+		fatal("%s", err)
+	}
+	show(uReq, []string{"INSTANCE", "SERVICE ID", "PLAN ID"},
+		[][]string{{fs.Arg(0), *serviceID, *planID}})
+}
+
+func deprovisionCmd(args []string) {
+	fs := newFlagSet("deprovision")
+	serviceID, planID, _ := osbFlags(fs)
+	fs.Parse(args)
+	needArgs(fs, 1, 1)
+
+	lookupIDs(fs.Arg(0), serviceID, planID)
+
+	_, err := osbClient().Deprovision(ctx, fs.Arg(0), *serviceID, *planID)
+	if err != nil {
+		fatal("%s", err)
+	}
+	show(map[string]string{"instance": fs.Arg(0), "status": "deleted"},
+		[]string{"INSTANCE", "STATUS"}, [][]string{{fs.Arg(0), "deleted"}})
+}
+
+func bindCmd(args []string) {
+	fs := newFlagSet("bind")
+	serviceID, planID, params := osbFlags(fs)
+	fs.Parse(args)
+	needArgs(fs, 2, 2)
+
+	lookupIDs(fs.Arg(0), serviceID, planID)
+
+	bReq := &osbclient.BindRequest{
+		ServiceID:  *serviceID,
+		PlanID:     *planID,
+		Parameters: params,
+	}
+	if len(params) == 0 {
+		bReq.Parameters = nil
+	}
+
+	res, err := osbClient().Bind(ctx, fs.Arg(0), fs.Arg(1), bReq)
+	if err != nil {
+		fatal("%s", err)
+	}
+
+	rows := [][]string{}
+	keys := []string{}
+	for k := range res.Credentials {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rows = append(rows, []string{k, fmt.Sprintf("%v", res.Credentials[k])})
+	}
+	show(res, []string{"CREDENTIAL", "VALUE"}, rows)
+}
+
+func unbindCmd(args []string) {
+	fs := newFlagSet("unbind")
+	serviceID, planID, _ := osbFlags(fs)
+	fs.Parse(args)
+	needArgs(fs, 2, 2)
+
+	lookupIDs(fs.Arg(0), serviceID, planID)
+
+	_, err := osbClient().Unbind(ctx, fs.Arg(0), fs.Arg(1), *serviceID, *planID)
+	if err != nil {
+		fatal("%s", err)
+	}
+	show(map[string]string{"binding": fs.Arg(1), "status": "deleted"},
+		[]string{"BINDING", "STATUS"}, [][]string{{fs.Arg(1), "deleted"}})
+}
+
+/* DB Commands */
+/***************/
+
+func dbURL() string {
+	return brokerURL + "/db"
+}
+
+// getDB uses the admin credentials to find the DB's own credentials
+func getDB(id string) *dbclient.DBConnection {
+	db, err := dbc.GetDB(ctx, dbURL(), id, user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+	return db
+}
+
+func printDBs(dbs []*dbclient.DBConnection) {
+	rows := [][]string{}
+	for _, db := range dbs {
+		rows = append(rows, []string{db.GetID(), db.URL, db.User,
+			db.Password})
+	}
+	show(dbs, []string{"ID", "URL", "USER", "PASSWORD"}, rows)
+}
+
+func dbsCmd(args []string) {
+	fs := newFlagSet("dbs")
+	fs.Parse(args)
+	needArgs(fs, 0, 0)
+
+	dbs, err := dbc.GetDBs(ctx, dbURL(), user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].URL < dbs[j].URL })
+	printDBs(dbs)
+}
+
+func createDBCmd(args []string) {
+	fs := newFlagSet("create-db")
+	fs.Parse(args)
+	needArgs(fs, 0, 1)
+
+	var db *dbclient.DBConnection
+	var err error
+	if fs.NArg() == 1 {
+		db, err = dbc.NewDBByID(ctx, dbURL(), fs.Arg(0), user, password)
+	} else {
+		db, err = dbc.NewDB(ctx, dbURL(), user, password)
+	}
+	if err != nil {
+		fatal("%s", err)
+	}
+	printDBs([]*dbclient.DBConnection{db})
+}
+
+func deleteDBCmd(args []string) {
+	fs := newFlagSet("delete-db")
+	fs.Parse(args)
+	needArgs(fs, 1, 1)
+
+	err := dbc.DeleteDB(ctx, dbURL()+"/"+fs.Arg(0), user, password)
+	if err != nil {
+		fatal("%s", err)
+	}
+}
+
+func keysCmd(args []string) {
+	fs := newFlagSet("keys")
+	fs.Parse(args)
+	needArgs(fs, 1, 2)
+
+	keys, err := getDB(fs.Arg(0)).KeysContext(ctx, fs.Arg(1))
+	if err != nil {
+		fatal("%s", err)
+	}
+
+	rows := [][]string{}
+	for _, k := range keys {
+		rows = append(rows, []string{k})
+	}
+	show(keys, []string{"KEY"}, rows)
+}
+
+func getCmd(args []string) {
+	fs := newFlagSet("get")
+	fs.Parse(args)
+	needArgs(fs, 2, 2)
+
+	db := getDB(fs.Arg(0))
+	if out.Format == "table" {
+		// Stream it so large values don't need to fit in memory
+		rc, err := db.GetReader(ctx, fs.Arg(1))
+		if err != nil {
+			fatal("%s", err)
+		}
+		defer rc.Close()
+		if _, err = io.Copy(os.Stdout, rc); err != nil {
+			fatal("Error reading value: %s", err)
+		}
+		return
+	}
+
+	value, err := db.GetAsBytesContext(ctx, fs.Arg(1))
+	if err != nil {
+		fatal("%s", err)
+	}
+	show(map[string]string{"key": fs.Arg(1), "value": string(value)},
+		nil, nil)
+}
+
+func setCmd(args []string) {
+	fs := newFlagSet("set")
+	fs.Parse(args)
+	needArgs(fs, 3, 3)
+
+	var err error
+	db := getDB(fs.Arg(0))
+	if fs.Arg(2) == "-" {
+		err = db.SetReader(ctx, fs.Arg(1), os.Stdin, -1)
+	} else {
+		err = db.SetContext(ctx, fs.Arg(1), fs.Arg(2))
+	}
+	if err != nil {
+		fatal("%s", err)
+	}
+}
+
+func delCmd(args []string) {
+	fs := newFlagSet("del")
+	fs.Parse(args)
+	needArgs(fs, 2, 2)
+
+	if err := getDB(fs.Arg(0)).DeleteKeyContext(ctx, fs.Arg(1)); err != nil {
+		fatal("%s", err)
+	}
+}
+
+func watchCmd(args []string) {
+	fs := newFlagSet("watch")
+	fs.Parse(args)
+	needArgs(fs, 1, 2)
+
+	db := getDB(fs.Arg(0))
+	err := db.WatchContext(ctx, fs.Arg(1), func(ev *dbclient.WatchEvent) bool {
+		value := string(ev.Value)
+		if ev.Null {
+			value = "<nil>"
+		}
+		switch out.Format {
+		case "json":
+			buf, _ := json.Marshal(map[string]string{"op": ev.Op,
+				"key": ev.Key, "value": value})
+			fmt.Printf("%s\n", buf)
+		case "yaml":
+			fmt.Printf("---\n")
+			show(map[string]string{"op": ev.Op, "key": ev.Key,
+				"value": value}, nil, nil)
+		default:
+			fmt.Printf("%-6s %s %q\n", ev.Op, ev.Key, value)
+		}
+		return true
+	})
+	if err != nil && err != context.Canceled {
+		fatal("%s", err)
+	}
+}
+
+func pubCmd(args []string) {
+	fs := newFlagSet("pub")
+	fs.Parse(args)
+	needArgs(fs, 3, 3)
+
+	data := []byte(fs.Arg(2))
+	if fs.Arg(2) == "-" {
+		var err error
+		if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+			fatal("Error reading stdin: %s", err)
+		}
+	}
+	count, err := getDB(fs.Arg(0)).Publish(ctx, fs.Arg(1), data)
+	if err != nil {
+		fatal("%s", err)
+	}
+	show(map[string]int{"subscribers": count}, []string{"SUBSCRIBERS"},
+		[][]string{{strconv.Itoa(count)}})
+}
+
+func subCmd(args []string) {
+	fs := newFlagSet("sub")
+	fs.Parse(args)
+	needArgs(fs, 2, 2)
+
+	db := getDB(fs.Arg(0))
+	err := db.Subscribe(ctx, fs.Arg(1), func(msg *dbclient.Message) bool {
+		switch out.Format {
+		case "json":
+			buf, _ := json.Marshal(map[string]string{"channel": msg.Channel,
+				"data": string(msg.Data)})
+			fmt.Printf("%s\n", buf)
+		case "yaml":
+			fmt.Printf("---\n")
+			show(map[string]string{"channel": msg.Channel,
+				"data": string(msg.Data)}, nil, nil)
+		default:
+			fmt.Printf("%s\n", msg.Data)
+		}
+		return true
+	})
+	if err != nil && err != context.Canceled {
+		fatal("%s", err)
+	}
+}
+
+func exportCmd(args []string) {
+	fs := newFlagSet("export")
+	asJSON := fs.Bool("json", false, "Save as a JSON array instead of NDJSON")
+	fs.Parse(args)
+	needArgs(fs, 1, 2)
+
+	db := getDB(fs.Arg(0))
+	if fs.NArg() < 2 || fs.Arg(1) == "-" {
+		if err := db.Export(ctx, os.Stdout, *asJSON); err != nil {
+			fatal("%s", err)
+		}
+		return
+	}
+
+	f, err := os.OpenFile(fs.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		fatal("Error writing %q: %s", fs.Arg(1), err)
+	}
+	err = db.Export(ctx, f, *asJSON)
+	// Close before any exit, and a failed flush means a bad export
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("Error writing %q: %s", fs.Arg(1), closeErr)
+	}
+	if err != nil {
+		fatal("%s", err)
+	}
+}
+
+func importCmd(args []string) {
+	fs := newFlagSet("import")
+	replace := fs.Bool("replace", false, "Delete keys that aren't in the import")
+	fs.Parse(args)
+	needArgs(fs, 1, 2)
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 2 && fs.Arg(1) != "-" {
+		f, err := os.Open(fs.Arg(1))
+		if err != nil {
+			fatal("Error reading %q: %s", fs.Arg(1), err)
+		}
+		in = f
+	}
+
+	result, err := getDB(fs.Arg(0)).Import(ctx, in, *replace)
+	// Close it now since fatal exits w/o running any defers
+	if f, ok := in.(*os.File); ok && f != os.Stdin {
+		f.Close()
+	}
+	if err != nil {
+		fatal("%s", err)
+	}
+	show(result, []string{"IMPORTED", "DELETED"},
+		[][]string{{strconv.Itoa(result.Imported),
+			strconv.Itoa(result.Deleted)}})
+}
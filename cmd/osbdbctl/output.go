@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output prints results in the format chosen by the -o flag
+type Output struct {
+	Format string // table, json or yaml
+	Writer io.Writer
+}
+
+// CheckFormat makes sure Format is one we know how to print
+func (o *Output) CheckFormat() error {
+	switch o.Format {
+	case "table", "json", "yaml":
+		return nil
+	}
+	return fmt.Errorf("Unknown output format %q, must be table, json or yaml",
+		o.Format)
+}
+
+// Print shows obj as JSON or YAML, or as a table using headers/rows
+func (o *Output) Print(obj interface{}, headers []string, rows [][]string) error {
+	switch o.Format {
+	case "json":
+		buf, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(o.Writer, "%s\n", buf)
+		return nil
+
+	case "yaml":
+		// Round-trip through JSON so the json tags decide the field names
+		buf, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		var tmp interface{}
+		if err = json.Unmarshal(buf, &tmp); err != nil {
+			return err
+		}
+		writeYAML(o.Writer, tmp, 0, false)
+		return nil
+
+	case "table", "":
+		tw := tabwriter.NewWriter(o.Writer, 0, 4, 2, ' ', 0)
+		if len(headers) != 0 {
+			fmt.Fprintln(tw, strings.Join(headers, "\t"))
+		}
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown output format %q", o.Format)
+}
+
+// writeYAML writes a value that came from json.Unmarshal as YAML.
+// inList means we're right after a "- " so the first line isn't indented.
+func writeYAML(w io.Writer, obj interface{}, indent int, inList bool) {
+	pad := strings.Repeat("  ", indent)
+	first := true
+	prefix := func() string {
+		if first && inList {
+			first = false
+			return ""
+		}
+		first = false
+		return pad
+	}
+
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(w, "%s{}\n", prefix())
+			return
+		}
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := prefix()
+			if isScalar(v[k]) || isEmpty(v[k]) {
+				fmt.Fprintf(w, "%s%s: %s\n", p, yamlString(k),
+					yamlScalar(v[k]))
+			} else {
+				fmt.Fprintf(w, "%s%s:\n", p, yamlString(k))
+				writeYAML(w, v[k], indent+1, false)
+			}
+		}
+
+	case []interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(w, "%s[]\n", prefix())
+			return
+		}
+		for _, item := range v {
+			p := prefix()
+			if isScalar(item) || isEmpty(item) {
+				fmt.Fprintf(w, "%s- %s\n", p, yamlScalar(item))
+			} else {
+				fmt.Fprintf(w, "%s- ", p)
+				writeYAML(w, item, indent+1, true)
+			}
+		}
+
+	default:
+		fmt.Fprintf(w, "%s%s\n", prefix(), yamlScalar(v))
+	}
+}
+
+func isScalar(obj interface{}) bool {
+	switch obj.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+func isEmpty(obj interface{}) bool {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func yamlScalar(obj interface{}) string {
+	switch v := obj.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return yamlString(v)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	return fmt.Sprintf("%v", obj)
+}
+
+// yamlString quotes the string if leaving it bare would change its meaning
+func yamlString(str string) string {
+	if str == "" {
+		return `""`
+	}
+	switch strings.ToLower(str) {
+	case "null", "~", "true", "false", "yes", "no", "on", "off":
+		return strconv.Quote(str)
+	}
+	if _, err := strconv.ParseFloat(str, 64); err == nil {
+		return strconv.Quote(str)
+	}
+	if strings.ContainsAny(str, ":#{}[],&*!|>'\"%@`\n\t\\") ||
+		strings.HasPrefix(str, "-") || strings.HasPrefix(str, "?") ||
+		strings.TrimSpace(str) != str {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// show prints the result of a command via out, see Output.Print
+func show(obj interface{}, headers []string, rows [][]string) {
+	if err := out.Print(obj, headers, rows); err != nil {
+		fatal("Error writing output: %s", err)
+	}
+}
+
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
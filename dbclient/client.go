@@ -1,18 +1,262 @@
 package dbclient
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+/* Client Stuff */
+/****************/
+
+// Client holds the HTTP settings shared by all calls. It's safe to use
+// from multiple goroutines, and should be reused so connections are too.
+type Client struct {
+	HTTPClient *http.Client  // Defaults to http.DefaultClient
+	Timeout    time.Duration // Per attempt, 0 means no timeout
+
+	// Sent as a bearer token, instead of the admin user/password, on
+	// calls that take them. DBs still use their own user/password.
+	Token string
+
+	// Idempotent calls (GET, PUT, DELETE) are retried on connection
+	// errors and 5xx/429 responses, waiting RetryBackoff, then twice
+	// that, and so on between attempts.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// DefaultClient is used by the package level functions and by any
+// DBConnection that doesn't have its own Client
+var DefaultClient = NewClient()
+
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:   &http.Client{Transport: http.DefaultTransport},
+		Timeout:      30 * time.Second,
+		MaxRetries:   2,
+		RetryBackoff: 100 * time.Millisecond,
+	}
+}
+
+// Errors that callers can check for with errors.Is
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrConflict     = errors.New("conflict")
+	ErrEmpty        = errors.New("empty") // Nothing to pop
+	ErrOutOfMemory  = errors.New("out of memory")
+	ErrReadOnly     = errors.New("read-only") // Sent to a follower
+)
+
+// Error is returned for any unexpected response from the server
+type Error struct {
+	Op         string // What we were trying to do, e.g. "get data"
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *Error) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("Can't %s: %s", e.Op, e.Status)
+	}
+	return fmt.Sprintf("Can't %s: %s(%s)", e.Op, e.Body, e.Status)
+}
+
+func (e *Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusInsufficientStorage:
+		return ErrOutOfMemory
+	case http.StatusMisdirectedRequest:
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// StatusCode returns the HTTP status code of an *Error, or 0
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+func newError(op string, code int, body []byte) *Error {
+	return &Error{
+		Op:         op,
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+// request describes one call to the server
+type request struct {
+	method  string
+	url     string
+	user    string
+	pass    string
+	token   string    // Sent instead of user/pass
+	body    []byte    // Kept as bytes so we can resend it on a retry
+	reader  io.Reader // Streamed instead of body, so no retries
+	size    int64     // Size of reader, -1 if unknown
+	wait    bool      // Server may wait, so don't use Client.Timeout
+	header  http.Header
+	op      string // For error messages
+	okCodes []int
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c == nil || c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func retryable(method string) bool {
+	return method == "GET" || method == "PUT" || method == "DELETE" ||
+		method == "HEAD"
+}
+
+func retryStatus(code int) bool {
+	return code == http.StatusTooManyRequests ||
+		code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// response is what's left of an http.Response once the body is read
+type response struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// do sends the request, retrying if allowed, and returns the response if
+// its status code is one of the request's okCodes
+func (c *Client) do(ctx context.Context, r *request) (*response, error) {
+	if c == nil {
+		c = DefaultClient
+	}
+	wait := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := c.doOnce(ctx, r)
+		again := err != nil || retryStatus(res.code)
+		if !again || !retryable(r.method) || r.reader != nil ||
+			attempt >= c.MaxRetries || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			for _, ok := range r.okCodes {
+				if res.code == ok {
+					return res, nil
+				}
+			}
+			return nil, newError(r.op, res.code, res.body)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, r *request) (*response, error) {
+	if c.Timeout > 0 && !r.wait {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	res, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read response: %s", err)
+	}
+	return &response{code: res.StatusCode, header: res.Header, body: body}, nil
+}
+
+// send just does the HTTP call, the caller must close the response body
+func (c *Client) send(ctx context.Context, r *request) (*http.Response, error) {
+	var reader io.Reader
+	if r.body != nil {
+		reader = bytes.NewReader(r.body)
+	} else if r.reader != nil {
+		reader = r.reader
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create http request: %s", err)
+	}
+	if r.reader != nil {
+		req.ContentLength = r.size // -1 means send it chunked
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	} else if r.user != "" {
+		req.SetBasicAuth(r.user, r.pass)
+	}
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		// Let callers check for context.Canceled/DeadlineExceeded
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("Can't create connection: %w", err)
+	}
+	return res, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, r *request, obj interface{}) error {
+	res, err := c.do(ctx, r)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(res.body, obj); err != nil {
+		return fmt.Errorf("Can't parse the response: %s", err)
+	}
+	return nil
+}
+
+/* Admin Stuff */
+/***************/
+
 type DBConnection struct {
 	URL      string
 	User     string
 	Password string
+
+	Client *Client `json:"-"` // Defaults to DefaultClient
 }
 
 // Takes DB user/password
@@ -33,311 +277,1199 @@ func (dbc *DBConnection) GetID() string {
 }
 
 // Take admin user/password
-func GetDBs(url string, u, p string) ([]*DBConnection, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (c *Client) GetDBs(ctx context.Context, url string, u, p string) ([]*DBConnection, error) {
+	dbs := []*DBConnection{}
+	err := c.getJSON(ctx, &request{
+		method: "GET", url: url, user: u, pass: p, token: c.Token,
+		op: "get DBs", okCodes: []int{http.StatusOK},
+	}, &dbs)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+		return nil, err
 	}
+	for _, db := range dbs {
+		db.Client = c
+	}
+	return dbs, nil
+}
 
-	if u != "" {
-		req.SetBasicAuth(u, p)
+// Take admin user/password
+func (c *Client) GetDB(ctx context.Context, url string, id, u, p string) (*DBConnection, error) {
+	db := &DBConnection{Client: c}
+	err := c.getJSON(ctx, &request{
+		method: "GET", url: url + "/" + id,
+		user: u, pass: p, token: c.Token,
+		op: "get DB", okCodes: []int{http.StatusOK},
+	}, db)
+	if err != nil {
+		return nil, err
 	}
+	return db, nil
+}
 
-	client := &http.Client{}
+// Take admin user/password
+func (c *Client) NewDB(ctx context.Context, url string, u, p string) (*DBConnection, error) {
+	return c.createDB(ctx, "POST", url, u, p)
+}
 
-	res, err := client.Do(req)
+// Take admin user/password
+func (c *Client) NewDBByID(ctx context.Context, url string, id, u, p string) (*DBConnection, error) {
+	return c.createDB(ctx, "PUT", url+"/"+id, u, p)
+}
+
+func (c *Client) createDB(ctx context.Context, method, url, u, p string) (*DBConnection, error) {
+	db := &DBConnection{Client: c}
+	err := c.getJSON(ctx, &request{
+		method: method, url: url, user: u, pass: p, token: c.Token,
+		op: "create a DB", okCodes: []int{http.StatusCreated},
+	}, db)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
-	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Can't get DBs: %s\n%s\n", res.Status,
-			string(body))
+	if db.URL == "" {
+		return nil, fmt.Errorf("Missing DB URL in response")
 	}
+	return db, nil
+}
 
-	dbs := []*DBConnection{}
-	err = json.Unmarshal(body, &dbs)
+// Take admin user/password
+func (c *Client) DeleteDB(ctx context.Context, url string, u, p string) error {
+	_, err := c.do(ctx, &request{
+		method: "DELETE", url: url, user: u, pass: p, token: c.Token,
+		op: "delete DB", okCodes: []int{http.StatusOK},
+	})
+	return err
+}
+
+type InstanceInfo struct {
+	ID        string            `json:"id"`
+	ServiceID string            `json:"service_id"`
+	PlanID    string            `json:"plan_id"`
+	OrgID     string            `json:"organization_guid,omitempty"`
+	SpaceID   string            `json:"space_guid,omitempty"`
+	Params    map[string]string `json:"parameters,omitempty"`
+	DBURL     string            `json:"db_url"`
+	Bindings  []string          `json:"bindings"`
+}
+
+// Take the broker's admin instances URL (http://host/admin/instances)
+// and admin user/password
+func (c *Client) GetInstances(ctx context.Context, url string, u, p string) ([]*InstanceInfo, error) {
+	instances := []*InstanceInfo{}
+	err := c.getJSON(ctx, &request{
+		method: "GET", url: url, user: u, pass: p, token: c.Token,
+		op: "get instances", okCodes: []int{http.StatusOK},
+	}, &instances)
 	if err != nil {
-		return nil, fmt.Errorf("Can't parse the DBs: %s", err)
+		return nil, err
 	}
+	return instances, nil
+}
 
-	return dbs, nil
+type BackupInfo struct {
+	Name       string    `json:"name"`
+	InstanceID string    `json:"instance_id"`
+	DBID       string    `json:"db_id"`
+	Created    time.Time `json:"created"`
+	Keys       int       `json:"keys"`
+	Size       int64     `json:"size"`
 }
 
-// Take admin user/password
-func GetDB(url string, id, u, p string) (*DBConnection, error) {
-	req, err := http.NewRequest("GET", url+"/"+id, nil)
+// Take the broker's URL (http://host) and admin user/password. An empty
+// name means the broker picks one.
+func (c *Client) CreateBackup(ctx context.Context, broker, instanceID, name string, u, p string) (*BackupInfo, error) {
+	path := broker + "/admin/instances/" + url.PathEscape(instanceID) +
+		"/backups"
+	if name != "" {
+		path += "?name=" + url.QueryEscape(name)
+	}
+	info := &BackupInfo{}
+	err := c.getJSON(ctx, &request{
+		method: "POST", url: path, user: u, pass: p, token: c.Token,
+		wait: true, op: "create backup", okCodes: []int{http.StatusCreated},
+	}, info)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+		return nil, err
 	}
+	return info, nil
+}
 
-	if u != "" {
-		req.SetBasicAuth(u, p)
+// Take the broker's URL and admin user/password. An empty instanceID
+// means the backups of all instances.
+func (c *Client) GetBackups(ctx context.Context, broker, instanceID string, u, p string) ([]*BackupInfo, error) {
+	path := broker + "/admin/backups"
+	if instanceID != "" {
+		path = broker + "/admin/instances/" + url.PathEscape(instanceID) +
+			"/backups"
 	}
+	infos := []*BackupInfo{}
+	err := c.getJSON(ctx, &request{
+		method: "GET", url: path, user: u, pass: p, token: c.Token,
+		op: "get backups", okCodes: []int{http.StatusOK},
+	}, &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
 
-	client := &http.Client{}
+// Take the broker's URL and admin user/password
+func (c *Client) DeleteBackup(ctx context.Context, broker, name string, u, p string) error {
+	_, err := c.do(ctx, &request{
+		method: "DELETE", url: broker + "/admin/backups/" +
+			url.PathEscape(name), user: u, pass: p, token: c.Token,
+		op: "delete backup", okCodes: []int{http.StatusOK},
+	})
+	return err
+}
+
+type ReplicationStatus struct {
+	Role      string `json:"role"` // leader or follower
+	Leader    string `json:"leader,omitempty"`
+	Connected bool   `json:"connected"`
+	Synced    bool   `json:"synced"`
+	Seq       uint64 `json:"seq"`
+	Followers int    `json:"followers"`
+}
 
-	res, err := client.Do(req)
+// Take the broker's URL and admin user/password
+func (c *Client) GetReplication(ctx context.Context, broker string, u, p string) (*ReplicationStatus, error) {
+	status := &ReplicationStatus{}
+	err := c.getJSON(ctx, &request{
+		method: "GET", url: broker + "/admin/replication",
+		user: u, pass: p, token: c.Token,
+		op: "get replication status", okCodes: []int{http.StatusOK},
+	}, status)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
-	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
-	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Can't get DBs: %s\n%s\n", res.Status,
-			string(body))
+		return nil, err
 	}
+	return status, nil
+}
 
-	db := DBConnection{}
-	err = json.Unmarshal(body, &db)
+// Promote makes a follower stop following its leader and take writes.
+// Takes the follower's URL and admin user/password.
+func (c *Client) Promote(ctx context.Context, broker string, u, p string) (*ReplicationStatus, error) {
+	status := &ReplicationStatus{}
+	err := c.getJSON(ctx, &request{
+		method: "POST", url: broker + "/admin/replication/promote",
+		user: u, pass: p, token: c.Token, wait: true,
+		op: "promote", okCodes: []int{http.StatusOK},
+	}, status)
 	if err != nil {
-		return nil, fmt.Errorf("Can't parse the DBs: %s", err)
+		return nil, err
 	}
+	return status, nil
+}
+
+// The package level functions use DefaultClient and no context
 
-	return &db, nil
+// Take admin user/password
+func GetDBs(url string, u, p string) ([]*DBConnection, error) {
+	return DefaultClient.GetDBs(context.Background(), url, u, p)
+}
+
+// Take admin user/password
+func GetDB(url string, id, u, p string) (*DBConnection, error) {
+	return DefaultClient.GetDB(context.Background(), url, id, u, p)
 }
 
 // Take admin user/password
 func NewDB(url string, u, p string) (*DBConnection, error) {
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+	return DefaultClient.NewDB(context.Background(), url, u, p)
+}
+
+// Take admin user/password
+func NewDBByID(url string, id, u, p string) (*DBConnection, error) {
+	return DefaultClient.NewDBByID(context.Background(), url, id, u, p)
+}
+
+// Take admin user/password
+func DeleteDB(url string, u, p string) error {
+	return DefaultClient.DeleteDB(context.Background(), url, u, p)
+}
+
+// Take the broker's admin instances URL and admin user/password
+func GetInstances(url string, u, p string) ([]*InstanceInfo, error) {
+	return DefaultClient.GetInstances(context.Background(), url, u, p)
+}
+
+// Take the broker's URL and admin user/password
+func CreateBackup(broker, instanceID, name string, u, p string) (*BackupInfo, error) {
+	return DefaultClient.CreateBackup(context.Background(), broker, instanceID,
+		name, u, p)
+}
+
+// Take the broker's URL and admin user/password
+func GetBackups(broker, instanceID string, u, p string) ([]*BackupInfo, error) {
+	return DefaultClient.GetBackups(context.Background(), broker, instanceID,
+		u, p)
+}
+
+// Take the broker's URL and admin user/password
+func DeleteBackup(broker, name string, u, p string) error {
+	return DefaultClient.DeleteBackup(context.Background(), broker, name, u, p)
+}
+
+// Take the broker's URL and admin user/password
+func GetReplication(broker string, u, p string) (*ReplicationStatus, error) {
+	return DefaultClient.GetReplication(context.Background(), broker, u, p)
+}
+
+// Take the follower's URL and admin user/password
+func Promote(broker string, u, p string) (*ReplicationStatus, error) {
+	return DefaultClient.Promote(context.Background(), broker, u, p)
+}
+
+/* DB Stuff */
+/************/
+
+func (db *DBConnection) client() *Client {
+	if db.Client == nil {
+		return DefaultClient
 	}
+	return db.Client
+}
 
-	if u != "" {
-		req.SetBasicAuth(u, p)
+func (db *DBConnection) request(method, path, op string, okCodes ...int) *request {
+	return &request{
+		method:  method,
+		url:     db.URL + path,
+		user:    db.User,
+		pass:    db.Password,
+		op:      op,
+		okCodes: okCodes,
 	}
+}
+
+func (db *DBConnection) GetContext(ctx context.Context, key string) (string, error) {
+	v, err := db.GetAsBytesContext(ctx, key)
+	return string(v), err
+}
 
-	client := &http.Client{}
+func (db *DBConnection) GetAsBytesContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := db.GetWithMetadata(ctx, key)
+	return value, err
+}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+// Metadata is the info about a value that's returned along with it
+type Metadata struct {
+	ContentType string
+	Meta        map[string]string // Sent as X-Meta-* headers
+	Size        int64             // Only filled in by GETs and HEADs
+	Modified    time.Time         // Only filled in by GETs and HEADs
+	Version     int               // Only filled in by GETs and HEADs
+	TTL         time.Duration     // Only used by sets, 0 means forever
+	Expires     time.Time         // Only filled in by GETs and HEADs
+}
+
+// MetaPrefix is the prefix of the HTTP headers that hold user metadata
+const MetaPrefix = "X-Meta-"
+
+func parseMetadata(res *response) *Metadata {
+	md := &Metadata{
+		ContentType: res.header.Get("Content-Type"),
+		Size:        int64(len(res.body)),
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+	if size, err := strconv.ParseInt(res.header.Get("Content-Length"), 10,
+		64); err == nil {
+		md.Size = size
 	}
-	if res.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("Can't create a DB: %s\n%s\n", res.Status,
-			string(body))
+	if lm := res.header.Get("Last-Modified"); lm != "" {
+		md.Modified, _ = http.ParseTime(lm)
 	}
+	md.Version, _ = strconv.Atoi(res.header.Get("X-Version"))
+	if exp := res.header.Get("X-Expires"); exp != "" {
+		md.Expires, _ = http.ParseTime(exp)
+	}
+	for k, v := range res.header {
+		if strings.HasPrefix(k, MetaPrefix) && len(k) > len(MetaPrefix) {
+			if md.Meta == nil {
+				md.Meta = map[string]string{}
+			}
+			md.Meta[k[len(MetaPrefix):]] = strings.Join(v, ", ")
+		}
+	}
+	return md
+}
 
-	dbc := DBConnection{}
-	err = json.Unmarshal(body, &dbc)
-	if dbc.URL == "" {
-		return nil, fmt.Errorf("Missing DB URL in response: %s\n", body)
+// GetWithMetadata returns the value of key along with its Content-Type
+// and X-Meta-* headers
+func (db *DBConnection) GetWithMetadata(ctx context.Context, key string) ([]byte, *Metadata, error) {
+	res, err := db.client().do(ctx, db.request("GET", "/"+key,
+		"get data", http.StatusOK, http.StatusNoContent))
+	if err != nil {
+		return nil, nil, err
+	}
+	md := parseMetadata(res)
+	if res.code == http.StatusNoContent {
+		return nil, md, nil
 	}
+	return res.body, md, nil
+}
 
-	return &DBConnection{
-		URL:      dbc.URL,
-		User:     dbc.User,
-		Password: dbc.Password,
-	}, nil
+// GetVersion returns an old (or the current) version of key
+func (db *DBConnection) GetVersion(ctx context.Context, key string, version int) ([]byte, *Metadata, error) {
+	r := db.request("GET", "/"+key, "get data", http.StatusOK,
+		http.StatusNoContent)
+	r.url += "?version=" + strconv.Itoa(version)
+	res, err := db.client().do(ctx, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	md := parseMetadata(res)
+	if res.code == http.StatusNoContent {
+		return nil, md, nil
+	}
+	return res.body, md, nil
 }
 
-// Take admin user/password
-func NewDBByID(url string, id, u, p string) (*DBConnection, error) {
-	req, err := http.NewRequest("PUT", url+"/"+id, nil)
+type VersionInfo struct {
+	Version     int       `json:"version"`
+	Size        int       `json:"size"`
+	Null        bool      `json:"null,omitempty"`
+	Current     bool      `json:"current,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Modified    time.Time `json:"modified"`
+}
+
+// History returns the versions of key that the server still has, oldest
+// first. If none are Current then the key was deleted.
+func (db *DBConnection) History(ctx context.Context, key string) ([]*VersionInfo, error) {
+	list := []*VersionInfo{}
+	err := db.client().getJSON(ctx, db.request("GET", "/"+key+"/_history",
+		"get history", http.StatusOK), &list)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+		return nil, err
 	}
+	return list, nil
+}
 
-	if u != "" {
-		req.SetBasicAuth(u, p)
+// Restore makes an old version of key the current one, and returns the
+// new version number
+func (db *DBConnection) Restore(ctx context.Context, key string, version int) (int, error) {
+	r := db.request("POST", "/"+key+"/_restore", "restore key", http.StatusOK)
+	r.url += "?version=" + strconv.Itoa(version)
+	res, err := db.client().do(ctx, r)
+	if err != nil {
+		return 0, err
 	}
+	newVersion, _ := strconv.Atoi(res.header.Get("X-Version"))
+	return newVersion, nil
+}
+
+// Incr atomically adds by to the integer value of key, and returns the
+// result. A missing key is treated as 0.
+func (db *DBConnection) Incr(ctx context.Context, key string, by int64) (int64, error) {
+	return db.numOp(ctx, key, "incr", "by", by)
+}
+
+// Decr atomically subtracts by from the integer value of key
+func (db *DBConnection) Decr(ctx context.Context, key string, by int64) (int64, error) {
+	return db.numOp(ctx, key, "decr", "by", by)
+}
+
+// SetMin atomically sets key to value if value is smaller than what's
+// there, and returns the result
+func (db *DBConnection) SetMin(ctx context.Context, key string, value int64) (int64, error) {
+	return db.numOp(ctx, key, "min", "value", value)
+}
 
-	client := &http.Client{}
+// SetMax atomically sets key to value if value is bigger than what's
+// there, and returns the result
+func (db *DBConnection) SetMax(ctx context.Context, key string, value int64) (int64, error) {
+	return db.numOp(ctx, key, "max", "value", value)
+}
 
-	res, err := client.Do(req)
+func (db *DBConnection) numOp(ctx context.Context, key, op, param string, n int64) (int64, error) {
+	r := db.request("POST", "/"+key, op+" key("+key+")", http.StatusOK)
+	r.url += "?" + url.Values{
+		"op":  {op},
+		param: {strconv.FormatInt(n, 10)},
+	}.Encode()
+	res, err := db.client().do(ctx, r)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+		return 0, err
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+	result, err := strconv.ParseInt(string(res.body), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Can't parse the result: %s", err)
 	}
-	if res.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("Can't create a DB: %s\n%s\n", res.Status,
-			string(body))
+	return result, nil
+}
+
+// Head returns just the metadata of key, w/o its value
+func (db *DBConnection) Head(ctx context.Context, key string) (*Metadata, error) {
+	res, err := db.client().do(ctx, db.request("HEAD", "/"+key,
+		"get metadata", http.StatusOK, http.StatusNoContent))
+	if err != nil {
+		return nil, err
 	}
+	return parseMetadata(res), nil
+}
 
-	dbc := DBConnection{}
-	err = json.Unmarshal(body, &dbc)
-	if dbc.URL == "" {
-		return nil, fmt.Errorf("Missing DB URL in response: %s\n", body)
+// SetWithMetadata sets key to value along with its Content-Type and
+// X-Meta-* headers. md may be nil.
+func (db *DBConnection) SetWithMetadata(ctx context.Context, key string, value []byte, md *Metadata) error {
+	r := db.request("PUT", "/"+key, "set key("+key+")", http.StatusOK)
+	r.body = value
+	r.header = http.Header{}
+	if value == nil {
+		r.header.Set("X-Null", "true")
+	}
+	if md != nil {
+		if md.ContentType != "" {
+			r.header.Set("Content-Type", md.ContentType)
+		}
+		for k, v := range md.Meta {
+			r.header.Set(MetaPrefix+k, v)
+		}
+		if md.TTL > 0 {
+			r.header.Set("X-TTL", strconv.FormatFloat(md.TTL.Seconds(), 'f',
+				-1, 64))
+		}
 	}
+	_, err := db.client().do(ctx, r)
+	return err
+}
 
-	return &DBConnection{
-		URL:      dbc.URL,
-		User:     dbc.User,
-		Password: dbc.Password,
-	}, nil
+func (db *DBConnection) SetContext(ctx context.Context, key string, value string) error {
+	return db.SetAsBytesContext(ctx, key, []byte(value))
 }
 
-// Take admin user/password
-func DeleteDB(url string, u, p string) error {
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		fmt.Printf("Can't create connection: %s\n", err)
-		return nil
+func (db *DBConnection) SetAsBytesContext(ctx context.Context, key string, value []byte) error {
+	return db.SetWithMetadata(ctx, key, value, nil)
+}
+
+// GetReader returns the value of key as a stream, so large values don't
+// need to be held in memory. The caller must close it. A nil value is
+// returned as an empty stream. The Client's Timeout doesn't apply.
+func (db *DBConnection) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return db.getReader(ctx, key, "")
+}
+
+// GetRangeReader is like GetReader but only returns length bytes starting
+// at offset. A length of -1 means to the end of the value.
+func (db *DBConnection) GetRangeReader(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
 	}
+	return db.getReader(ctx, key, rng)
+}
 
-	if u != "" {
-		req.SetBasicAuth(u, p)
+func (db *DBConnection) getReader(ctx context.Context, key, rng string) (io.ReadCloser, error) {
+	r := db.request("GET", "/"+key, "get data")
+	if rng != "" {
+		r.header = http.Header{"Range": {rng}}
 	}
 
-	client := &http.Client{}
+	res, err := db.client().send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusNoContent:
+		res.Body.Close()
+		return http.NoBody, nil
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return nil, newError(r.op, res.StatusCode, body)
+}
 
-	res, err := client.Do(req)
+// SetReader sets key to the contents of value. If size is -1 the value is
+// sent chunked. Since value can't be re-read this isn't retried. Only the
+// client streams: the server reads the whole value before storing it.
+func (db *DBConnection) SetReader(ctx context.Context, key string, value io.Reader, size int64) error {
+	r := db.request("PUT", "/"+key, "set key("+key+")", http.StatusOK)
+	r.reader = value
+	r.size = size
+	_, err := db.client().do(ctx, r)
+	return err
+}
+
+func (db *DBConnection) DeleteKeyContext(ctx context.Context, key string) error {
+	_, err := db.client().do(ctx, db.request("DELETE", "/"+key,
+		"delete key", http.StatusOK))
+	return err
+}
+
+func (db *DBConnection) DeleteDBContext(ctx context.Context) error {
+	_, err := db.client().do(ctx, db.request("DELETE", "",
+		"delete DB", http.StatusOK))
+	return err
+}
+
+func (db *DBConnection) KeysContext(ctx context.Context, prefix string) ([]string, error) {
+	r := db.request("GET", "/_keys", "get keys", http.StatusOK)
+	if prefix != "" {
+		r.url += "?" + url.Values{"prefix": {prefix}}.Encode()
+	}
+	keys := []string{}
+	if err := db.client().getJSON(ctx, r, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeyRange returns, in order, up to limit (0 means no limit) keys that are
+// >= start and < end ("" means no end). If there are more, next is the
+// start to use to get the next page, otherwise it's "".
+func (db *DBConnection) KeyRange(ctx context.Context, start, end string, limit int) (keys []string, next string, err error) {
+	query := url.Values{}
+	if start != "" {
+		query.Set("start", start)
+	}
+	if end != "" {
+		query.Set("end", end)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	r := db.request("GET", "/_keys", "get keys", http.StatusOK)
+	if len(query) > 0 {
+		r.url += "?" + query.Encode()
+	}
+	res, err := db.client().do(ctx, r)
 	if err != nil {
-		return fmt.Errorf("Can't create connection: %s\n", err)
+		return nil, "", err
+	}
+	keys = []string{}
+	if err = json.Unmarshal(res.body, &keys); err != nil {
+		return nil, "", fmt.Errorf("Can't parse the response: %s", err)
+	}
+	return keys, res.header.Get("X-Next-Key"), nil
+}
+
+type WatchEvent struct {
+	Op    string `json:"op"` // set or delete
+	Key   string `json:"key"`
+	Field string `json:"field,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Null  bool   `json:"null,omitempty"`
+}
+
+// WatchContext calls fn for each change to a key that starts with
+// prefix. It returns when fn returns false, when the server ends the
+// stream, or when ctx is done. The Client's Timeout doesn't apply.
+func (db *DBConnection) WatchContext(ctx context.Context, prefix string, fn func(*WatchEvent) bool) error {
+	r := db.request("GET", "/_watch", "watch keys")
+	if prefix != "" {
+		r.url += "?" + url.Values{"prefix": {prefix}}.Encode()
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+
+	res, err := db.client().send(ctx, r)
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
+
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("Can't delete DB: %s(%s)", string(body), res.Status)
+		body, _ := ioutil.ReadAll(res.Body)
+		return newError(r.op, res.StatusCode, body)
+	}
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		ev := &WatchEvent{}
+		if err := dec.Decode(ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("Error reading watch stream: %s", err)
+		}
+		if !fn(ev) {
+			return nil
+		}
 	}
-	return nil
 }
 
+// These are the same as the ...Context versions but w/o a context
+
 func (db *DBConnection) Get(key string) (string, error) {
-	v, err := db.GetAsBytes(key)
-	return string(v), err
+	return db.GetContext(context.Background(), key)
 }
 
 func (db *DBConnection) GetAsBytes(key string) ([]byte, error) {
-	req, err := http.NewRequest("GET", db.URL+"/"+key, nil)
+	return db.GetAsBytesContext(context.Background(), key)
+}
+
+func (db *DBConnection) Set(key string, value string) error {
+	return db.SetContext(context.Background(), key, value)
+}
+
+func (db *DBConnection) SetAsBytes(key string, value []byte) error {
+	return db.SetAsBytesContext(context.Background(), key, value)
+}
+
+func (db *DBConnection) DeleteKey(key string) error {
+	return db.DeleteKeyContext(context.Background(), key)
+}
+
+func (db *DBConnection) DeleteDB() error {
+	return db.DeleteDBContext(context.Background())
+}
+
+func (db *DBConnection) Keys(prefix string) ([]string, error) {
+	return db.KeysContext(context.Background(), prefix)
+}
+
+func (db *DBConnection) Watch(prefix string, fn func(*WatchEvent) bool) error {
+	return db.WatchContext(context.Background(), prefix, fn)
+}
+
+/* List Stuff */
+/**************/
+
+// LPush adds item to the front of the list in key, and returns the new
+// length of the list
+func (db *DBConnection) LPush(ctx context.Context, key string, item []byte) (int, error) {
+	return db.push(ctx, key, "lpush", item)
+}
+
+// RPush adds item to the end of the list in key, and returns the new
+// length of the list
+func (db *DBConnection) RPush(ctx context.Context, key string, item []byte) (int, error) {
+	return db.push(ctx, key, "rpush", item)
+}
+
+func (db *DBConnection) push(ctx context.Context, key, op string, item []byte) (int, error) {
+	r := db.listRequest("POST", key, op, http.StatusOK)
+	if item == nil {
+		item = []byte{}
+	}
+	r.body = item
+	res, err := db.client().do(ctx, r)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create http request: %s\n", err)
+		return 0, err
 	}
+	return strconv.Atoi(res.header.Get("X-Length"))
+}
+
+// LPop removes and returns the first item of the list in key. If the list
+// is empty it returns ErrEmpty.
+func (db *DBConnection) LPop(ctx context.Context, key string) ([]byte, error) {
+	return db.pop(ctx, key, "lpop", 0)
+}
+
+// RPop removes and returns the last item of the list in key
+func (db *DBConnection) RPop(ctx context.Context, key string) ([]byte, error) {
+	return db.pop(ctx, key, "rpop", 0)
+}
 
-	if db.User != "" {
-		req.SetBasicAuth(db.User, db.Password)
+// BLPop is like LPop but waits up to timeout for an item to show up
+func (db *DBConnection) BLPop(ctx context.Context, key string, timeout time.Duration) ([]byte, error) {
+	return db.pop(ctx, key, "lpop", timeout)
+}
+
+// BRPop is like RPop but waits up to timeout for an item to show up
+func (db *DBConnection) BRPop(ctx context.Context, key string, timeout time.Duration) ([]byte, error) {
+	return db.pop(ctx, key, "rpop", timeout)
+}
+
+func (db *DBConnection) pop(ctx context.Context, key, op string, timeout time.Duration) ([]byte, error) {
+	r := db.listRequest("POST", key, op, http.StatusOK, http.StatusNoContent)
+	if timeout > 0 {
+		r.url += "&timeout=" + timeout.String()
+		r.wait = true
+	}
+	res, err := db.client().do(ctx, r)
+	if err != nil {
+		return nil, err
 	}
+	if res.code == http.StatusNoContent {
+		return nil, ErrEmpty
+	}
+	return res.body, nil
+}
+
+// LRange returns the items of the list in key from start to stop,
+// inclusive. Negative numbers count from the end, so 0,-1 is everything.
+func (db *DBConnection) LRange(ctx context.Context, key string, start, stop int) ([][]byte, error) {
+	items, _, err := db.lrange(ctx, key, start, stop)
+	return items, err
+}
 
-	client := &http.Client{}
+// LLen returns the length of the list in key, 0 if it doesn't exist
+func (db *DBConnection) LLen(ctx context.Context, key string) (int, error) {
+	_, length, err := db.lrange(ctx, key, 1, 0)
+	return length, err
+}
 
-	res, err := client.Do(req)
+func (db *DBConnection) lrange(ctx context.Context, key string, start, stop int) ([][]byte, int, error) {
+	r := db.listRequest("GET", key, "", http.StatusOK)
+	r.url += fmt.Sprintf("?start=%d&stop=%d", start, stop)
+	res, err := db.client().do(ctx, r)
 	if err != nil {
-		return nil, fmt.Errorf("Can't create connection: %s\n", err)
+		return nil, 0, err
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+	items := [][]byte{}
+	if err = json.Unmarshal(res.body, &items); err != nil {
+		return nil, 0, fmt.Errorf("Can't parse the list: %s", err)
 	}
+	length, _ := strconv.Atoi(res.header.Get("X-Length"))
+	return items, length, nil
+}
 
-	if res.StatusCode == http.StatusNoContent {
-		return nil, nil
+func (db *DBConnection) listRequest(method, key, op string, okCodes ...int) *request {
+	r := db.request(method, "/"+key+"/_list", "", okCodes...)
+	if op != "" {
+		r.url += "?op=" + op
+		r.op = op + " key(" + key + ")"
+	} else {
+		r.op = "get list(" + key + ")"
 	}
+	return r
+}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Can't get data: %s(%s)", body, res.Status)
+/* Hash Stuff */
+/**************/
+
+func (db *DBConnection) hashURL(key, field string) string {
+	path := "/" + key + "/_hash"
+	if field != "" {
+		path += "/" + url.PathEscape(field)
 	}
+	return path
+}
 
-	return body, nil
+// HSet sets one field of the hash in key, and returns the number of
+// fields in the hash
+func (db *DBConnection) HSet(ctx context.Context, key, field string, value []byte) (int, error) {
+	r := db.request("PUT", db.hashURL(key, field), "set field("+field+")",
+		http.StatusOK)
+	if value == nil {
+		value = []byte{}
+	}
+	r.body = value
+	res, err := db.client().do(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res.header.Get("X-Length"))
 }
 
-func (db *DBConnection) Set(key string, value string) error {
-	return db.SetAsBytes(key, []byte(value))
+// HGet returns one field of the hash in key. Missing fields return
+// ErrNotFound.
+func (db *DBConnection) HGet(ctx context.Context, key, field string) ([]byte, error) {
+	res, err := db.client().do(ctx, db.request("GET", db.hashURL(key, field),
+		"get field("+field+")", http.StatusOK))
+	if err != nil {
+		return nil, err
+	}
+	return res.body, nil
 }
 
-func (db *DBConnection) SetAsBytes(key string, value []byte) error {
-	req, err := http.NewRequest("PUT", db.URL+"/"+key, bytes.NewReader(value))
+// HDel removes one field of the hash in key
+func (db *DBConnection) HDel(ctx context.Context, key, field string) error {
+	_, err := db.client().do(ctx, db.request("DELETE",
+		db.hashURL(key, field), "delete field("+field+")", http.StatusOK))
+	return err
+}
+
+// HGetAll returns all of the fields of the hash in key
+func (db *DBConnection) HGetAll(ctx context.Context, key string) (map[string][]byte, error) {
+	fields := map[string][]byte{}
+	err := db.client().getJSON(ctx, db.request("GET", db.hashURL(key, ""),
+		"get hash("+key+")", http.StatusOK), &fields)
 	if err != nil {
-		return fmt.Errorf("Can't create http request: %s\n", err)
+		return nil, err
 	}
+	return fields, nil
+}
+
+/* Set Stuff */
+/*************/
 
-	if db.User != "" {
-		req.SetBasicAuth(db.User, db.Password)
+func (db *DBConnection) setURL(key, member string) string {
+	path := "/" + key + "/_set"
+	if member != "" {
+		path += "/" + url.PathEscape(member)
 	}
+	return path
+}
 
-	if value == nil {
-		req.Header.Add("X-NULL", "true")
+// SAdd adds member to the set in key, and returns the size of the set
+func (db *DBConnection) SAdd(ctx context.Context, key, member string) (int, error) {
+	res, err := db.client().do(ctx, db.request("PUT", db.setURL(key, member),
+		"add member("+member+")", http.StatusOK))
+	if err != nil {
+		return 0, err
 	}
+	return strconv.Atoi(res.header.Get("X-Length"))
+}
 
-	client := &http.Client{}
+// SRem removes member from the set in key. Returns ErrNotFound if it
+// wasn't there.
+func (db *DBConnection) SRem(ctx context.Context, key, member string) error {
+	_, err := db.client().do(ctx, db.request("DELETE",
+		db.setURL(key, member), "remove member("+member+")", http.StatusOK))
+	return err
+}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("Can't create connection: %s\n", err)
+// SIsMember returns true if member is in the set in key
+func (db *DBConnection) SIsMember(ctx context.Context, key, member string) (bool, error) {
+	isMember := false
+	err := db.client().getJSON(ctx, db.request("GET", db.setURL(key, member),
+		"check member("+member+")", http.StatusOK), &isMember)
+	return isMember, err
+}
+
+// SMembers returns the sorted members of the set in key
+func (db *DBConnection) SMembers(ctx context.Context, key string) ([]string, error) {
+	return db.setOp(ctx, key, "", nil)
+}
+
+// SUnion returns the members that are in any of the sets
+func (db *DBConnection) SUnion(ctx context.Context, keys ...string) ([]string, error) {
+	if len(keys) == 0 {
+		return []string{}, nil
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+	return db.setOp(ctx, keys[0], "union", keys[1:])
+}
+
+// SInter returns the members that are in all of the sets
+func (db *DBConnection) SInter(ctx context.Context, keys ...string) ([]string, error) {
+	if len(keys) == 0 {
+		return []string{}, nil
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("Can't set key(%s): %s(%s)", key,
-			string(body), res.Status)
+	return db.setOp(ctx, keys[0], "inter", keys[1:])
+}
+
+func (db *DBConnection) setOp(ctx context.Context, key, op string, with []string) ([]string, error) {
+	r := db.request("GET", db.setURL(key, ""), "get set("+key+")",
+		http.StatusOK)
+	if op != "" {
+		r.url += "?" + url.Values{"op": {op}, "with": with}.Encode()
 	}
-	return nil
+	members := []string{}
+	if err := db.client().getJSON(ctx, r, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
 }
 
-func (db *DBConnection) DeleteKey(key string) error {
-	req, err := http.NewRequest("DELETE", db.URL+"/"+key, nil)
+/* Sorted Set Stuff */
+/********************/
+
+// ZItem is one member of a sorted set
+type ZItem struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// ZRankInfo is the score and rank of one member of a sorted set
+type ZRankInfo struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	Rank   int     `json:"rank"`
+}
+
+func (db *DBConnection) zsetURL(key, member string) string {
+	path := "/" + key + "/_zset"
+	if member != "" {
+		path += "/" + url.PathEscape(member)
+	}
+	return path
+}
+
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ZAdd sets the score of member in the sorted set in key, and returns the
+// size of the set
+func (db *DBConnection) ZAdd(ctx context.Context, key, member string, score float64) (int, error) {
+	r := db.request("PUT", db.zsetURL(key, member),
+		"add member("+member+")", http.StatusOK)
+	r.url += "?score=" + url.QueryEscape(formatScore(score))
+	res, err := db.client().do(ctx, r)
 	if err != nil {
-		return fmt.Errorf("Can't create http request: %s\n", err)
+		return 0, err
 	}
+	return strconv.Atoi(res.header.Get("X-Length"))
+}
 
-	if db.User != "" {
-		req.SetBasicAuth(db.User, db.Password)
+// ZIncr adds by to the score of member (starting at 0) and returns the new
+// score
+func (db *DBConnection) ZIncr(ctx context.Context, key, member string, by float64) (float64, error) {
+	r := db.request("POST", db.zsetURL(key, member),
+		"incr member("+member+")", http.StatusOK)
+	r.url += "?op=incr&by=" + url.QueryEscape(formatScore(by))
+	res, err := db.client().do(ctx, r)
+	if err != nil {
+		return 0, err
 	}
+	return strconv.ParseFloat(string(res.body), 64)
+}
 
-	client := &http.Client{}
+// ZRem removes member from the sorted set in key. Returns ErrNotFound if
+// it wasn't there.
+func (db *DBConnection) ZRem(ctx context.Context, key, member string) error {
+	_, err := db.client().do(ctx, db.request("DELETE",
+		db.zsetURL(key, member), "remove member("+member+")", http.StatusOK))
+	return err
+}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("Can't create connection: %s\n", err)
+// ZRank returns the score and rank of member, lowest score first or
+// highest first if rev is true. Returns ErrNotFound if it isn't there.
+func (db *DBConnection) ZRank(ctx context.Context, key, member string, rev bool) (*ZRankInfo, error) {
+	r := db.request("GET", db.zsetURL(key, member),
+		"get member("+member+")", http.StatusOK)
+	if rev {
+		r.url += "?rev=true"
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+	info := &ZRankInfo{}
+	if err := db.client().getJSON(ctx, r, info); err != nil {
+		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("Can't delete key: %s(%s)\n", res.Status,
-			string(body))
+	return info, nil
+}
+
+// ZRange returns the members from rank start to stop, inclusive. Negative
+// ranks count from the end, so 0 and -1 returns them all.
+func (db *DBConnection) ZRange(ctx context.Context, key string, start, stop int, rev bool) ([]ZItem, error) {
+	query := url.Values{
+		"start": {strconv.Itoa(start)},
+		"stop":  {strconv.Itoa(stop)},
 	}
-	return nil
+	if rev {
+		query.Set("rev", "true")
+	}
+	return db.zsetRange(ctx, key, query)
 }
 
-func (db *DBConnection) DeleteDB() error {
-	req, err := http.NewRequest("DELETE", db.URL, nil)
-	if err != nil {
-		return fmt.Errorf("Can't create http request: %s\n", err)
+// ZRangeByScore returns up to limit (0 means all) members with scores
+// from min to max, inclusive. Use math.Inf for open ended ranges.
+func (db *DBConnection) ZRangeByScore(ctx context.Context, key string, min, max float64, rev bool, limit int) ([]ZItem, error) {
+	query := url.Values{
+		"min": {formatScore(min)},
+		"max": {formatScore(max)},
+	}
+	if rev {
+		query.Set("rev", "true")
 	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	return db.zsetRange(ctx, key, query)
+}
 
-	if db.User != "" {
-		req.SetBasicAuth(db.User, db.Password)
+func (db *DBConnection) zsetRange(ctx context.Context, key string, query url.Values) ([]ZItem, error) {
+	r := db.request("GET", db.zsetURL(key, ""), "get sorted set("+key+")",
+		http.StatusOK)
+	r.url += "?" + query.Encode()
+	items := []ZItem{}
+	if err := db.client().getJSON(ctx, r, &items); err != nil {
+		return nil, err
 	}
+	return items, nil
+}
+
+/* Pub/Sub Stuff */
+/*****************/
+
+// Message is what subscribers of a channel get
+type Message struct {
+	Channel string `json:"channel"`
+	Data    []byte `json:"data"`
+}
 
-	client := &http.Client{}
+func pubSubURL(kind, channel string) string {
+	return "/" + kind + "/" + url.PathEscape(channel)
+}
 
-	res, err := client.Do(req)
+// Publish sends data to the current subscribers of channel and returns
+// how many of them got it. Messages aren't saved, so if there aren't any
+// subscribers it's just dropped.
+func (db *DBConnection) Publish(ctx context.Context, channel string, data []byte) (int, error) {
+	r := db.request("POST", pubSubURL("_pub", channel),
+		"publish to("+channel+")", http.StatusOK)
+	if data == nil {
+		data = []byte{}
+	}
+	r.body = data
+	res, err := db.client().do(ctx, r)
 	if err != nil {
-		return fmt.Errorf("Can't create connection: %s\n", err)
+		return 0, err
 	}
-	body := []byte{}
-	if res.Body != nil {
-		defer res.Body.Close()
-		body, _ = ioutil.ReadAll(res.Body)
+	return strconv.Atoi(string(res.body))
+}
+
+// Subscribe calls fn for each message sent to channel. It returns when fn
+// returns false, when the server ends the stream, or when ctx is done.
+// The Client's Timeout doesn't apply.
+func (db *DBConnection) Subscribe(ctx context.Context, channel string, fn func(*Message) bool) error {
+	r := db.request("GET", pubSubURL("_sub", channel),
+		"subscribe to("+channel+")")
+	r.header = http.Header{"Accept": {"text/event-stream"}}
+
+	res, err := db.client().send(ctx, r)
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
+
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("Can't delete DB: %s(%s)", string(body), res.Status)
+		body, _ := ioutil.ReadAll(res.Body)
+		return newError(r.op, res.StatusCode, body)
+	}
+
+	// Server-Sent Events: "field: value" lines, with a blank line at the
+	// end of each event. Lines starting with ":" are comments.
+	reader := bufio.NewReader(res.Body)
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("Error reading subscription: %s", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line != "" {
+			if strings.HasPrefix(line, "data:") {
+				if data != "" {
+					data += "\n"
+				}
+				data += strings.TrimPrefix(line[5:], " ")
+			}
+			continue
+		}
+		if data == "" {
+			continue
+		}
+
+		msg := &Message{}
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			return fmt.Errorf("Error parsing message: %s", err)
+		}
+		data = ""
+		if !fn(msg) {
+			return nil
+		}
+	}
+}
+
+/* Export/Import Stuff */
+/***********************/
+
+// ExportRecord is one key of an export. Just the field for the key's Type
+// is set, e.g. Value for plain values ("" type). TTL is how many seconds
+// the key had left when it was exported, 0 means it doesn't expire.
+type ExportRecord struct {
+	Key         string            `json:"key"`
+	Type        string            `json:"type,omitempty"`
+	Value       []byte            `json:"value,omitempty"`
+	Null        bool              `json:"null,omitempty"`
+	List        [][]byte          `json:"list,omitempty"`
+	Hash        map[string][]byte `json:"hash,omitempty"`
+	Set         []string          `json:"set,omitempty"`
+	ZSet        []ZItem           `json:"zset,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	TTL         float64           `json:"ttl,omitempty"`
+}
+
+// ImportResult says what an Import did
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Deleted  int `json:"deleted"` // Keys that weren't in a replace
+}
+
+// Export writes all of the keys of the DB to w, as NDJSON (one
+// ExportRecord per line), or as a JSON array if asJSON is true. The
+// Client's Timeout doesn't apply.
+func (db *DBConnection) Export(ctx context.Context, w io.Writer, asJSON bool) error {
+	r := db.request("GET", "/_export", "export DB")
+	if asJSON {
+		r.url += "?format=json"
+	}
+
+	res, err := db.client().send(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return newError(r.op, res.StatusCode, body)
+	}
+	if _, err = io.Copy(w, res.Body); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("Error reading export: %s", err)
 	}
 	return nil
 }
+
+// ExportRecords calls fn for each key of the DB, in order, until fn
+// returns false
+func (db *DBConnection) ExportRecords(ctx context.Context, fn func(*ExportRecord) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.Export(ctx, pw, false))
+	}()
+	defer pr.Close()
+
+	dec := json.NewDecoder(pr)
+	for {
+		rec := &ExportRecord{}
+		if err := dec.Decode(rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+}
+
+// Import loads the keys in r, which is an export in either format, into
+// the DB. If replace is true, keys that aren't in r are deleted. The
+// server checks all of r before changing anything. Since r can't be
+// re-read this isn't retried.
+func (db *DBConnection) Import(ctx context.Context, r io.Reader, replace bool) (*ImportResult, error) {
+	req := db.request("POST", "/_import", "import DB", http.StatusOK)
+	if replace {
+		req.url += "?mode=replace"
+	}
+	req.reader = r
+	req.size = -1
+	req.wait = true
+
+	result := &ImportResult{}
+	if err := db.client().getJSON(ctx, req, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ImportRecords is like Import but for records built in code, e.g. to
+// seed a DB with test data
+func (db *DBConnection) ImportRecords(ctx context.Context, recs []*ExportRecord, replace bool) (*ImportResult, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return nil, fmt.Errorf("Can't serialize %q: %s", rec.Key, err)
+		}
+	}
+	return db.Import(ctx, buf, replace)
+}
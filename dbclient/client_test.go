@@ -0,0 +1,156 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/duglin/osbdb/server"
+)
+
+func TestTypedErrors(t *testing.T) {
+	srv, err := server.NewServer(server.Config{
+		BrokerUser:     "user",
+		BrokerPassword: "passw0rd",
+	})
+	if err != nil {
+		t.Fatalf("Can't create server: %s", err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := NewClient()
+	url := ts.URL + "/db"
+
+	db, err := client.NewDBByID(ctx, url, "1", "user", "passw0rd")
+	if err != nil {
+		t.Fatalf("Can't create DB: %s", err)
+	}
+	if db.Client != client {
+		t.Fatalf("DB should use the client that created it")
+	}
+
+	_, err = client.NewDBByID(ctx, url, "1", "user", "passw0rd")
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Dup DB should be a conflict: %v", err)
+	}
+
+	_, err = client.GetDB(ctx, url, "2", "user", "passw0rd")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Missing DB should be not found: %v", err)
+	}
+
+	_, err = client.GetDBs(ctx, url, "user", "bad")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Bad password should be unauthorized: %v", err)
+	}
+
+	if err = db.SetContext(ctx, "a", "b"); err != nil {
+		t.Fatalf("Can't set key: %s", err)
+	}
+	if v, err := db.GetContext(ctx, "a"); err != nil || v != "b" {
+		t.Fatalf("Bad get: %q %v", v, err)
+	}
+	if _, err = db.GetContext(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Missing key should be not found: %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Fail the first 2 calls
+			if atomic.AddInt32(&calls, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.Method == "POST" {
+				w.WriteHeader(http.StatusCreated)
+			}
+			w.Write([]byte(`{"URL":"http://x/db/1"}`))
+		}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := NewClient()
+	client.RetryBackoff = time.Millisecond
+
+	db := &DBConnection{URL: ts.URL, Client: client}
+	if _, err := db.GetContext(ctx, "a"); err != nil {
+		t.Fatalf("GET should have been retried: %s", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("Should have been 3 calls, not %d", n)
+	}
+
+	// POST isn't idempotent so no retries
+	atomic.StoreInt32(&calls, 0)
+	_, err := client.NewDB(ctx, ts.URL, "", "")
+	n := atomic.LoadInt32(&calls)
+	if n != 1 || StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("POST shouldn't be retried: %d %v", n, err)
+	}
+
+	// Give up after MaxRetries
+	atomic.StoreInt32(&calls, -10)
+	_, err = db.GetContext(ctx, "a")
+	if n := atomic.LoadInt32(&calls); n != -7 || err == nil {
+		t.Fatalf("Should have stopped after %d retries: %d %v",
+			client.MaxRetries, n, err)
+	}
+
+	// Canceled contexts should stop things right away
+	atomic.StoreInt32(&calls, -10)
+	client.RetryBackoff = time.Hour
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = db.GetContext(cctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("Should have timed out: %v", err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	srv, err := server.NewServer(server.Config{
+		BrokerUser:     "user",
+		BrokerPassword: "passw0rd",
+		Authenticators: []server.Authenticator{
+			&server.TokenAuthenticator{Tokens: map[string]bool{"tok": true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Can't create server: %s", err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := NewClient()
+	client.Token = "tok"
+	url := ts.URL + "/db"
+
+	// The token is used in place of the (bad) admin password
+	if _, err := client.NewDBByID(ctx, url, "1", "user", "bad"); err != nil {
+		t.Fatalf("Can't create DB with a token: %s", err)
+	}
+	db, err := client.GetDB(ctx, url, "1", "", "")
+	if err != nil {
+		t.Fatalf("Can't get DB with a token: %s", err)
+	}
+
+	// DBs still use their own credentials
+	if err = db.SetContext(ctx, "a", "b"); err != nil {
+		t.Fatalf("Can't set key: %s", err)
+	}
+
+	client.Token = "bad"
+	if _, err = client.GetDBs(ctx, url, "", ""); !errors.Is(err,
+		ErrUnauthorized) {
+		t.Fatalf("Bad token should be unauthorized: %v", err)
+	}
+}
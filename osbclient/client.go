@@ -0,0 +1,576 @@
+package osbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAPIVersion is sent as X-Broker-API-Version unless overridden
+const DefaultAPIVersion = "2.14"
+
+// How long to wait between last_operation calls if the broker doesn't
+// send a Retry-After header
+var DefaultPollInterval = 2 * time.Second
+
+// DefaultTimeout is the Timeout of clients made by NewClient, and of the
+// http.Client used when HTTPClient isn't set
+var DefaultTimeout = 30 * time.Second
+
+type Client struct {
+	URL        string // Base URL of the broker, e.g. http://localhost
+	User       string
+	Password   string
+	Token      string // Used as a bearer token instead of User/Password
+	APIVersion string
+
+	// Send accepts_incomplete=true so the broker can do things async.
+	// Check the Async field of responses to see if it did.
+	AcceptsIncomplete bool
+
+	HTTPClient *http.Client  // Defaults to one with DefaultTimeout
+	Timeout    time.Duration // Per request, 0 means no timeout
+}
+
+var defaultHTTPClient = &http.Client{Timeout: DefaultTimeout}
+
+// Takes broker user/password
+func NewClient(url string, user, password string) *Client {
+	return &Client{
+		URL:        strings.TrimRight(url, "/"),
+		User:       user,
+		Password:   password,
+		APIVersion: DefaultAPIVersion,
+		Timeout:    DefaultTimeout,
+	}
+}
+
+// Error is returned for any non-successful response from the broker. If
+// the body was an OSB error ({"error":...,"description":...}) then
+// ErrorCode and Description are filled in.
+type Error struct {
+	StatusCode  int    `json:"-"`
+	ErrorCode   string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
+	Body        string `json:"-"` // Raw body, if it wasn't an OSB error
+}
+
+func (e *Error) Error() string {
+	str := fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.ErrorCode != "" {
+		str += ": " + e.ErrorCode
+	}
+	if e.Description != "" {
+		str += ": " + e.Description
+	}
+	if e.ErrorCode == "" && e.Description == "" && e.Body != "" {
+		str += ": " + e.Body
+	}
+	return str
+}
+
+// Error codes defined by the OSB API spec
+const (
+	AsyncRequired           = "AsyncRequired"
+	ConcurrencyError        = "ConcurrencyError"
+	RequiresApp             = "RequiresApp"
+	MaintenanceInfoConflict = "MaintenanceInfoConflict"
+)
+
+// StatusCode returns the HTTP status code of an *Error, or 0
+func StatusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+func IsGone(err error) bool     { return StatusCode(err) == http.StatusGone }
+func IsNotFound(err error) bool { return StatusCode(err) == http.StatusNotFound }
+func IsConflict(err error) bool { return StatusCode(err) == http.StatusConflict }
+
+func IsAsyncRequired(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.ErrorCode == AsyncRequired
+}
+
+func decodeError(code int, body []byte) *Error {
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil {
+		e = &Error{Body: strings.TrimSpace(string(body))}
+	}
+	e.StatusCode = code
+	return e
+}
+
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+type Service struct {
+	Name                 string                 `json:"name"`
+	ID                   string                 `json:"id"`
+	Description          string                 `json:"description"`
+	Tags                 []string               `json:"tags,omitempty"`
+	Requires             []string               `json:"requires,omitempty"`
+	Bindable             bool                   `json:"bindable"`
+	InstancesRetrievable bool                   `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool                   `json:"bindings_retrievable,omitempty"`
+	Metadata             map[string]interface{} `json:"metadata,omitempty"`
+	DashboardClient      interface{}            `json:"dashboard_client,omitempty"`
+	PlanUpdateable       bool                   `json:"plan_updateable,omitempty"`
+	Plans                []Plan                 `json:"plans"`
+}
+
+type Plan struct {
+	ID              string                 `json:"id"`
+	Name            string                 `json:"name"`
+	Description     string                 `json:"description,omitempty"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	Free            bool                   `json:"free,omitempty"`
+	Bindable        bool                   `json:"bindable,omitempty"`
+	Schemas         interface{}            `json:"schemas,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type ProvisionRequest struct {
+	ServiceID       string                 `json:"service_id"`
+	PlanID          string                 `json:"plan_id"`
+	Context         map[string]interface{} `json:"context,omitempty"`
+	OrgID           string                 `json:"organization_guid"`
+	SpaceID         string                 `json:"space_guid"`
+	Parameters      map[string]string      `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+type ProvisionResponse struct {
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+	Async        bool   `json:"-"` // Broker returned 202
+	Exists       bool   `json:"-"` // Broker returned 200, already there
+}
+
+type UpdateRequest struct {
+	ServiceID       string                 `json:"service_id"`
+	PlanID          string                 `json:"plan_id,omitempty"`
+	Context         map[string]interface{} `json:"context,omitempty"`
+	Parameters      map[string]string      `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+type UpdateResponse struct {
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+	Async        bool   `json:"-"`
+}
+
+// OperationResponse is returned by calls that delete things
+type OperationResponse struct {
+	Operation string `json:"operation,omitempty"`
+	Async     bool   `json:"-"`
+}
+
+type InstanceResponse struct {
+	ServiceID       string                 `json:"service_id,omitempty"`
+	PlanID          string                 `json:"plan_id,omitempty"`
+	DashboardURL    string                 `json:"dashboard_url,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+type BindRequest struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	Context      map[string]interface{} `json:"context,omitempty"`
+	BindResource map[string]interface{} `json:"bind_resource,omitempty"`
+	Parameters   map[string]string      `json:"parameters,omitempty"`
+}
+
+type BindResponse struct {
+	Credentials     map[string]interface{} `json:"credentials,omitempty"`
+	SyslogDrainURL  string                 `json:"syslog_drain_url,omitempty"`
+	RouteServiceURL string                 `json:"route_service_url,omitempty"`
+	VolumeMounts    []interface{}          `json:"volume_mounts,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	Operation       string                 `json:"operation,omitempty"`
+	Async           bool                   `json:"-"`
+	Exists          bool                   `json:"-"`
+}
+
+// States of an async operation
+const (
+	InProgress = "in progress"
+	Succeeded  = "succeeded"
+	Failed     = "failed"
+)
+
+type LastOperationResponse struct {
+	State       string        `json:"state"`
+	Description string        `json:"description,omitempty"`
+	RetryAfter  time.Duration `json:"-"` // From the Retry-After header
+
+	hasRetryAfter bool
+}
+
+// do sends the request and returns the response, with the body already
+// read. obj, if not nil, is sent as the JSON body.
+func (c *Client) do(ctx context.Context, method, path string,
+	query url.Values, obj interface{}) (*http.Response, []byte, error) {
+
+	var reqBody []byte
+	if obj != nil {
+		var err error
+		if reqBody, err = json.Marshal(obj); err != nil {
+			return nil, nil, fmt.Errorf("Can't serialize request: %s", err)
+		}
+	}
+
+	if c.AcceptsIncomplete && method != "GET" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("accepts_incomplete", "true")
+	}
+
+	u := c.URL + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u,
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't create http request: %s", err)
+	}
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	version := c.APIVersion
+	if version == "" {
+		version = DefaultAPIVersion
+	}
+	req.Header.Set("X-Broker-API-Version", version)
+	if obj != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		// Make it easy to check for a timeout or cancel
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		return nil, nil, fmt.Errorf("Can't create connection: %s", err)
+	}
+	body := []byte{}
+	if res.Body != nil {
+		defer res.Body.Close()
+		if body, err = ioutil.ReadAll(res.Body); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, nil, ctxErr
+			}
+			return nil, nil, fmt.Errorf("Can't read response: %s", err)
+		}
+	}
+	return res, body, nil
+}
+
+// call does the request and, if the status code is one of okCodes,
+// parses the response into result (if not nil). Otherwise an *Error.
+func (c *Client) call(ctx context.Context, method, path string,
+	query url.Values, obj interface{}, result interface{},
+	okCodes ...int) (*http.Response, error) {
+
+	res, body, err := c.do(ctx, method, path, query, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range okCodes {
+		if res.StatusCode != code {
+			continue
+		}
+		if result != nil && len(bytes.TrimSpace(body)) != 0 {
+			if err = json.Unmarshal(body, result); err != nil {
+				return res, fmt.Errorf("Can't parse response: %s", err)
+			}
+		}
+		return res, nil
+	}
+	return res, decodeError(res.StatusCode, body)
+}
+
+func instancePath(instanceID string) string {
+	return "/v2/service_instances/" + url.PathEscape(instanceID)
+}
+
+func bindingPath(instanceID, bindingID string) string {
+	return instancePath(instanceID) + "/service_bindings/" +
+		url.PathEscape(bindingID)
+}
+
+func idsQuery(serviceID, planID string) url.Values {
+	query := url.Values{}
+	if serviceID != "" {
+		query.Set("service_id", serviceID)
+	}
+	if planID != "" {
+		query.Set("plan_id", planID)
+	}
+	return query
+}
+
+func (c *Client) Catalog(ctx context.Context) (*Catalog, error) {
+	catalog := &Catalog{}
+	_, err := c.call(ctx, "GET", "/v2/catalog", nil, nil, catalog,
+		http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func (c *Client) Provision(ctx context.Context, instanceID string,
+	pReq *ProvisionRequest) (*ProvisionResponse, error) {
+
+	pRes := &ProvisionResponse{}
+	res, err := c.call(ctx, "PUT", instancePath(instanceID), nil, pReq, pRes,
+		http.StatusOK, http.StatusCreated, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	pRes.Async = res.StatusCode == http.StatusAccepted
+	pRes.Exists = res.StatusCode == http.StatusOK
+	return pRes, nil
+}
+
+func (c *Client) Update(ctx context.Context, instanceID string,
+	uReq *UpdateRequest) (*UpdateResponse, error) {
+
+	uRes := &UpdateResponse{}
+	res, err := c.call(ctx, "PATCH", instancePath(instanceID), nil, uReq, uRes,
+		http.StatusOK, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	uRes.Async = res.StatusCode == http.StatusAccepted
+	return uRes, nil
+}
+
+func (c *Client) Deprovision(ctx context.Context, instanceID, serviceID,
+	planID string) (*OperationResponse, error) {
+
+	oRes := &OperationResponse{}
+	res, err := c.call(ctx, "DELETE", instancePath(instanceID),
+		idsQuery(serviceID, planID), nil, oRes,
+		http.StatusOK, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	oRes.Async = res.StatusCode == http.StatusAccepted
+	return oRes, nil
+}
+
+// GetInstance fetches an instance. Needs API version 2.14+.
+func (c *Client) GetInstance(ctx context.Context,
+	instanceID string) (*InstanceResponse, error) {
+
+	iRes := &InstanceResponse{}
+	_, err := c.call(ctx, "GET", instancePath(instanceID), nil, nil, iRes,
+		http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return iRes, nil
+}
+
+func (c *Client) Bind(ctx context.Context, instanceID, bindingID string,
+	bReq *BindRequest) (*BindResponse, error) {
+
+	bRes := &BindResponse{}
+	res, err := c.call(ctx, "PUT", bindingPath(instanceID, bindingID), nil, bReq,
+		bRes, http.StatusOK, http.StatusCreated, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	bRes.Async = res.StatusCode == http.StatusAccepted
+	bRes.Exists = res.StatusCode == http.StatusOK
+	return bRes, nil
+}
+
+func (c *Client) Unbind(ctx context.Context, instanceID, bindingID,
+	serviceID, planID string) (*OperationResponse, error) {
+
+	oRes := &OperationResponse{}
+	res, err := c.call(ctx, "DELETE", bindingPath(instanceID, bindingID),
+		idsQuery(serviceID, planID), nil, oRes,
+		http.StatusOK, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	oRes.Async = res.StatusCode == http.StatusAccepted
+	return oRes, nil
+}
+
+// GetBinding fetches a binding, including its credentials. Needs API
+// version 2.14+.
+func (c *Client) GetBinding(ctx context.Context, instanceID,
+	bindingID string) (*BindResponse, error) {
+
+	bRes := &BindResponse{}
+	_, err := c.call(ctx, "GET", bindingPath(instanceID, bindingID), nil, nil,
+		bRes, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return bRes, nil
+}
+
+// parseRetryAfter handles both forms of Retry-After (seconds or a date).
+// Returns false if there's no valid value.
+func parseRetryAfter(str string) (time.Duration, bool) {
+	if str == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(str); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(str); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (c *Client) lastOperation(ctx context.Context, path, serviceID,
+	planID, operation string) (*LastOperationResponse, error) {
+
+	query := idsQuery(serviceID, planID)
+	if operation != "" {
+		query.Set("operation", operation)
+	}
+
+	loRes := &LastOperationResponse{}
+	res, err := c.call(ctx, "GET", path+"/last_operation", query, nil, loRes,
+		http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	loRes.RetryAfter, loRes.hasRetryAfter =
+		parseRetryAfter(res.Header.Get("Retry-After"))
+	return loRes, nil
+}
+
+// LastOperation gets the state of an async operation on an instance.
+// operation is whatever the broker returned when the operation started.
+func (c *Client) LastOperation(ctx context.Context, instanceID, serviceID,
+	planID, operation string) (*LastOperationResponse, error) {
+
+	return c.lastOperation(ctx, instancePath(instanceID), serviceID,
+		planID, operation)
+}
+
+// BindingLastOperation gets the state of an async operation on a binding
+func (c *Client) BindingLastOperation(ctx context.Context, instanceID,
+	bindingID, serviceID, planID,
+	operation string) (*LastOperationResponse, error) {
+
+	return c.lastOperation(ctx, bindingPath(instanceID, bindingID),
+		serviceID, planID, operation)
+}
+
+// poll calls check until the operation isn't "in progress" anymore,
+// sleeping for the Retry-After time (or DefaultPollInterval) in between.
+// If the operation failed an *Error is returned along with the response.
+func poll(ctx context.Context, check func() (*LastOperationResponse,
+	error)) (*LastOperationResponse, error) {
+
+	for {
+		loRes, err := check()
+		if err != nil {
+			return nil, err
+		}
+
+		switch loRes.State {
+		case Succeeded:
+			return loRes, nil
+		case Failed:
+			return loRes, &Error{StatusCode: http.StatusOK,
+				ErrorCode: "OperationFailed", Description: loRes.Description}
+		case InProgress:
+		default:
+			return loRes, fmt.Errorf("Unknown state %q", loRes.State)
+		}
+
+		wait := loRes.RetryAfter
+		if !loRes.hasRetryAfter {
+			wait = DefaultPollInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return loRes, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// WaitForOperation polls last_operation of an instance until the
+// operation is done or ctx is. Deleting an instance is done when the
+// broker returns 410 Gone, so that's treated as success.
+func (c *Client) WaitForOperation(ctx context.Context, instanceID, serviceID,
+	planID, operation string) (*LastOperationResponse, error) {
+
+	return poll(ctx, func() (*LastOperationResponse, error) {
+		loRes, err := c.LastOperation(ctx, instanceID, serviceID, planID,
+			operation)
+		if IsGone(err) {
+			return &LastOperationResponse{State: Succeeded}, nil
+		}
+		return loRes, err
+	})
+}
+
+// WaitForBindingOperation is WaitForOperation for bindings
+func (c *Client) WaitForBindingOperation(ctx context.Context, instanceID,
+	bindingID, serviceID, planID,
+	operation string) (*LastOperationResponse, error) {
+
+	return poll(ctx, func() (*LastOperationResponse, error) {
+		loRes, err := c.BindingLastOperation(ctx, instanceID, bindingID,
+			serviceID, planID, operation)
+		if IsGone(err) {
+			return &LastOperationResponse{State: Succeeded}, nil
+		}
+		return loRes, err
+	})
+}
@@ -0,0 +1,221 @@
+package osbclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duglin/osbdb/server"
+)
+
+func TestOSBDB(t *testing.T) {
+	ctx := context.Background()
+	srv, err := server.NewServer(server.Config{
+		BrokerUser:     "user",
+		BrokerPassword: "passw0rd",
+	})
+	if err != nil {
+		t.Fatalf("Can't create server: %s", err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	client := NewClient(ts.URL, "user", "passw0rd")
+
+	catalog, err := client.Catalog(ctx)
+	if err != nil || len(catalog.Services) == 0 {
+		t.Fatalf("Bad catalog: %v %v", catalog, err)
+	}
+	svc := catalog.Services[0]
+	planID := svc.Plans[0].ID
+
+	pReq := &ProvisionRequest{ServiceID: svc.ID, PlanID: planID}
+	pRes, err := client.Provision(ctx, "i1", pReq)
+	if err != nil || pRes.Exists || pRes.Async {
+		t.Fatalf("Bad provision: %v %v", pRes, err)
+	}
+
+	pRes, err = client.Provision(ctx, "i1", pReq)
+	if err != nil || !pRes.Exists {
+		t.Fatalf("Second provision should say it exists: %v %v", pRes, err)
+	}
+
+	pReq.Parameters = map[string]string{"a": "b"}
+	_, err = client.Provision(ctx, "i1", pReq)
+	if !IsConflict(err) {
+		t.Fatalf("Provision with new params should conflict: %v", err)
+	}
+	if e, ok := err.(*Error); !ok || e.ErrorCode == "" {
+		t.Fatalf("OSB error should have been decoded: %#v", err)
+	}
+
+	iRes, err := client.GetInstance(ctx, "i1")
+	if err != nil || iRes.PlanID != planID {
+		t.Fatalf("Bad fetch: %v %v", iRes, err)
+	}
+
+	bReq := &BindRequest{ServiceID: svc.ID, PlanID: planID}
+	bRes, err := client.Bind(ctx, "i1", "b1", bReq)
+	if err != nil || bRes.Credentials["url"] == nil {
+		t.Fatalf("Bad bind: %v %v", bRes, err)
+	}
+
+	bRes, err = client.GetBinding(ctx, "i1", "b1")
+	if err != nil || bRes.Credentials["password"] == nil {
+		t.Fatalf("Bad binding fetch: %v %v", bRes, err)
+	}
+
+	_, err = client.Unbind(ctx, "i1", "b1", svc.ID, planID)
+	if err != nil {
+		t.Fatalf("Bad unbind: %v", err)
+	}
+
+	_, err = client.Unbind(ctx, "i1", "b1", svc.ID, planID)
+	if !IsGone(err) {
+		t.Fatalf("Second unbind should be gone: %v", err)
+	}
+
+	_, err = client.Deprovision(ctx, "i1", svc.ID, planID)
+	if err != nil {
+		t.Fatalf("Bad deprovision: %v", err)
+	}
+
+	_, err = client.GetInstance(ctx, "i1")
+	if !IsNotFound(err) {
+		t.Fatalf("Fetch of deleted instance should 404: %v", err)
+	}
+
+	client.Password = "bad"
+	_, err = client.Catalog(ctx)
+	if StatusCode(err) != http.StatusUnauthorized {
+		t.Fatalf("Bad password should fail: %v", err)
+	}
+}
+
+// asyncBroker pretends to be a broker that does everything async. Each
+// operation stays "in progress" for the first 2 last_operation calls.
+type asyncBroker struct {
+	mutex      sync.Mutex
+	polls      int
+	state      string // What to return after polling is done
+	query      string // Query of the last last_operation call
+	retryAfter string // Retry-After header to send, if any
+}
+
+func (ab *asyncBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	if r.URL.Query().Get("accepts_incomplete") != "true" &&
+		r.Method != "GET" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, `{"error":"AsyncRequired"}`)
+		return
+	}
+
+	if r.Method == "GET" {
+		ab.query = r.URL.RawQuery
+		ab.polls++
+		if ab.polls <= 2 {
+			if ab.retryAfter != "" {
+				w.Header().Set("Retry-After", ab.retryAfter)
+			}
+			fmt.Fprintf(w, `{"state":"in progress"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"state":%q,"description":"all done"}`, ab.state)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, `{"operation":"op1"}`)
+}
+
+func TestAsync(t *testing.T) {
+	ab := &asyncBroker{state: Succeeded, retryAfter: "0"}
+	ts := httptest.NewServer(ab)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewClient(ts.URL, "", "")
+	pReq := &ProvisionRequest{ServiceID: "s", PlanID: "p"}
+
+	_, err := client.Provision(ctx, "i1", pReq)
+	if !IsAsyncRequired(err) {
+		t.Fatalf("Should have gotten AsyncRequired: %v", err)
+	}
+
+	client.AcceptsIncomplete = true
+	pRes, err := client.Provision(ctx, "i1", pReq)
+	if err != nil || !pRes.Async || pRes.Operation != "op1" {
+		t.Fatalf("Bad async provision: %v %v", pRes, err)
+	}
+
+	loRes, err := client.WaitForOperation(ctx, "i1", "s", "p", pRes.Operation)
+	if err != nil || loRes.State != Succeeded {
+		t.Fatalf("Bad wait: %v %v", loRes, err)
+	}
+	if ab.polls != 3 {
+		t.Fatalf("Should have polled 3 times, not %d", ab.polls)
+	}
+	if ab.query != "operation=op1&plan_id=p&service_id=s" {
+		t.Fatalf("Bad last_operation query: %s", ab.query)
+	}
+
+	// A failed operation should be an error
+	ab.polls = 0
+	ab.state = Failed
+	loRes, err = client.WaitForBindingOperation(ctx, "i1", "b1", "s", "p", "")
+	if err == nil || loRes.Description != "all done" {
+		t.Fatalf("Failed operation should be an error: %v %v", loRes, err)
+	}
+
+	// W/o a Retry-After we should use DefaultPollInterval, and stop
+	// when the context is done
+	ab.polls = 0
+	ab.retryAfter = ""
+	savePoll := DefaultPollInterval
+	DefaultPollInterval = time.Hour
+	defer func() { DefaultPollInterval = savePoll }()
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer shortCancel()
+	_, err = client.WaitForOperation(shortCtx, "i1", "s", "p", "")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Should have timed out: %v", err)
+	}
+}
+
+func TestHungBroker(t *testing.T) {
+	// Never answers, until the client gives up
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL, "", "")
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.WaitForOperation(ctx, "i1", "s", "p", "")
+	if err != context.DeadlineExceeded || time.Since(start) > 5*time.Second {
+		t.Fatalf("Should have timed out: %v", err)
+	}
+
+	// Without a deadline, Timeout stops each request
+	client.Timeout = 100 * time.Millisecond
+	_, err = client.Catalog(context.Background())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Should have timed out: %v", err)
+	}
+}
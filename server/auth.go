@@ -0,0 +1,383 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Auth Stuff */
+/**************/
+
+// Authenticator is something that can decide whether an incoming request
+// is allowed to access the broker (OSB and admin) APIs. Basic Auth using
+// BrokerUser/BrokerPassword is always checked first, these are extras.
+type Authenticator interface {
+	Authenticate(r *http.Request) bool
+}
+
+func (s *Server) AddAuthenticator(a Authenticator) {
+	s.config.Authenticators = append(s.config.Authenticators, a)
+}
+
+// VerifyBrokerAuth checks the request against the broker's admin
+// credentials and then against any of the registered Authenticators.
+func (s *Server) VerifyBrokerAuth(w http.ResponseWriter, r *http.Request) bool {
+	if s.VerifyBasicAuth(w, r, s.config.BrokerUser, s.config.BrokerPassword) {
+		return true
+	}
+
+	for _, a := range s.config.Authenticators {
+		if a.Authenticate(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// BearerToken returns the token from an "Authorization: Bearer xxx" header
+func BearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// TokenAuthenticator accepts a fixed set of bearer tokens
+type TokenAuthenticator struct {
+	Tokens map[string]bool
+}
+
+// NewTokenAuthenticator loads the list of tokens from a file. One token
+// per line, blank lines and lines starting with '#' are ignored.
+func NewTokenAuthenticator(file string) (*TokenAuthenticator, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read tokens file %q: %s", file, err)
+	}
+
+	ta := &TokenAuthenticator{
+		Tokens: map[string]bool{},
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		ta.Tokens[line] = true
+	}
+	return ta, nil
+}
+
+// Authenticate compares the token with every one of ours, in constant time,
+// so how long it takes doesn't give away how much of a token was right.
+// The hashes are compared so the lengths aren't given away either.
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) bool {
+	token := BearerToken(r)
+	if token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	found := 0
+	for t := range ta.Tokens {
+		tSum := sha256.Sum256([]byte(t))
+		found |= subtle.ConstantTimeCompare(sum[:], tSum[:])
+	}
+	return found == 1
+}
+
+// JWTAuthenticator accepts bearer tokens that are JWTs signed by one of
+// the keys in a JWKS file. Tokens must have an "exp". Issuer and Audience
+// are only checked if set.
+type JWTAuthenticator struct {
+	Keys     map[string]crypto.PublicKey // kid -> key
+	Algs     map[string]string           // kid -> alg, if the JWK has one
+	Issuer   string
+	Audience string
+}
+
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func decodeBigInt(str string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Bad 'n' in key %q: %s", k.Kid, err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("Bad 'e' in key %q: %s", k.Kid, err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %q in key %q",
+				k.Crv, k.Kid)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("Bad 'x' in key %q: %s", k.Kid, err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("Bad 'y' in key %q: %s", k.Kid, err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %q in key %q", k.Kty, k.Kid)
+}
+
+// NewJWTAuthenticator loads the signing keys from a local JWKS file
+func NewJWTAuthenticator(file, issuer, audience string) (*JWTAuthenticator, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read JWKS file %q: %s", file, err)
+	}
+
+	jwks := JWKS{}
+	if err = json.Unmarshal(buf, &jwks); err != nil {
+		return nil, fmt.Errorf("Can't parse JWKS file %q: %s", file, err)
+	}
+
+	ja := &JWTAuthenticator{
+		Keys:     map[string]crypto.PublicKey{},
+		Algs:     map[string]string{},
+		Issuer:   issuer,
+		Audience: audience,
+	}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		ja.Keys[k.Kid] = key
+		if k.Alg != "" {
+			ja.Algs[k.Kid] = k.Alg
+		}
+	}
+	if len(ja.Keys) == 0 {
+		return nil, fmt.Errorf("No signing keys found in JWKS file %q", file)
+	}
+	return ja, nil
+}
+
+type JWTHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type JWTClaims struct {
+	Issuer    string      `json:"iss,omitempty"`
+	Subject   string      `json:"sub,omitempty"`
+	Audience  interface{} `json:"aud,omitempty"` // string or []string
+	ExpiresAt int64       `json:"exp,omitempty"`
+	NotBefore int64       `json:"nbf,omitempty"`
+	IssuedAt  int64       `json:"iat,omitempty"`
+}
+
+func (c *JWTClaims) HasAudience(aud string) bool {
+	switch a := c.Audience.(type) {
+	case string:
+		return a == aud
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, obj interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, obj)
+}
+
+func (ja *JWTAuthenticator) Authenticate(r *http.Request) bool {
+	token := BearerToken(r)
+	if token == "" {
+		return false
+	}
+	_, err := ja.Verify(token)
+	return err == nil
+}
+
+// Verify checks the signature and claims of the JWT and returns the claims
+func (ja *JWTAuthenticator) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+
+	header := JWTHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Can't parse header: %s", err)
+	}
+
+	var key crypto.PublicKey
+	kid := header.Kid
+	if kid != "" {
+		key = ja.Keys[kid]
+	} else if len(ja.Keys) == 1 {
+		for id, k := range ja.Keys {
+			kid, key = id, k
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("Unknown key %q", header.Kid)
+	}
+	// Don't let the token pick a different alg than the key is for
+	if alg := ja.Algs[kid]; alg != "" && alg != header.Alg {
+		return nil, fmt.Errorf("Key %q is for alg %q, not %q", kid, alg,
+			header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Can't decode signature: %s", err)
+	}
+
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1],
+		sig); err != nil {
+		return nil, err
+	}
+
+	claims := JWTClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Can't parse claims: %s", err)
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("Token has no expiry")
+	}
+	if now >= claims.ExpiresAt {
+		return nil, fmt.Errorf("Token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("Token not valid yet")
+	}
+	if ja.Issuer != "" && claims.Issuer != ja.Issuer {
+		return nil, fmt.Errorf("Wrong issuer %q", claims.Issuer)
+	}
+	if ja.Audience != "" && !claims.HasAudience(ja.Audience) {
+		return nil, fmt.Errorf("Wrong audience")
+	}
+	return &claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string,
+	sig []byte) error {
+
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported alg %q", alg)
+	}
+
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "512":
+		h, ch = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported alg %q", alg)
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Key doesn't match alg %q", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, ch, digest, sig); err != nil {
+			return fmt.Errorf("Bad signature")
+		}
+		return nil
+
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Key doesn't match alg %q", alg)
+		}
+		if err := rsa.VerifyPSS(k, ch, digest, sig, nil); err != nil {
+			return fmt.Errorf("Bad signature")
+		}
+		return nil
+
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Key doesn't match alg %q", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("Bad signature")
+		}
+		rInt := new(big.Int).SetBytes(sig[:size])
+		sInt := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, rInt, sInt) {
+			return fmt.Errorf("Bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported alg %q", alg)
+}
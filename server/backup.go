@@ -0,0 +1,326 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Backup Stuff */
+/****************/
+
+// A backup is a point-in-time export of an instance's DB, kept in
+// Config.DataDir/backups as {name}.ndjson (in the _export format) along
+// with {name}.json, its BackupInfo. Backups outlive their instance, so
+// they can be used to reset an instance, or create a new one, via the
+// "restore_from" parameter of a provision or update:
+//
+//	POST   /admin/instances/{iID}/backups?name=...  name is optional
+//	GET    /admin/instances/{iID}/backups
+//	GET    /admin/backups
+//	DELETE /admin/backups/{name}
+
+// RestoreFromParam is the provision/update parameter naming the backup
+// to load into the instance's DB
+const RestoreFromParam = "restore_from"
+
+type BackupInfo struct {
+	Name       string    `json:"name"`
+	InstanceID string    `json:"instance_id"`
+	DBID       string    `json:"db_id"`
+	Created    time.Time `json:"created"`
+	Keys       int       `json:"keys"`
+	Size       int64     `json:"size"` // Bytes in the backup
+}
+
+var backupNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]*$`)
+
+func (s *Server) backupDir() string {
+	return filepath.Join(s.config.DataDir, "backups")
+}
+
+func (s *Server) backupPath(name, ext string) string {
+	return filepath.Join(s.backupDir(), name+ext)
+}
+
+// checkBackups makes sure backups are possible, and name (if not "") is a
+// valid name for one
+func (s *Server) checkBackups(name string) error {
+	if s.config.DataDir == "" {
+		return fmt.Errorf("Backups need a data dir to be configured")
+	}
+	if name != "" && !backupNameRE.MatchString(name) {
+		return fmt.Errorf("Invalid backup name %q", name)
+	}
+	return nil
+}
+
+// CreateBackup saves the current contents of the instance's DB as backup
+// name. An empty name means one is made up.
+func (s *Server) CreateBackup(instanceID string, instance *Instance, name string) (*BackupInfo, error) {
+	if err := s.checkBackups(name); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if name == "" {
+		name = now.Format("20060102-150405.000000")
+		if backupNameRE.MatchString(instanceID) {
+			name = instanceID + "-" + name
+		}
+	}
+	// Just a quick check, the links below are what make sure two backups
+	// don't get the same name
+	if _, err := os.Stat(s.backupPath(name, ".json")); err == nil {
+		return nil, os.ErrExist
+	}
+	if err := os.MkdirAll(s.backupDir(), 0700); err != nil {
+		return nil, fmt.Errorf("Can't create backup dir: %s", err)
+	}
+
+	// Write to temp files first so a failure doesn't leave half a backup.
+	// Each call gets its own so concurrent ones can't write to the same.
+	file, err := ioutil.TempFile(s.backupDir(), name+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Can't create backup: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	info := &BackupInfo{
+		Name:       name,
+		InstanceID: instanceID,
+		DBID:       instance.DB.ID,
+		Created:    now,
+	}
+	info.Keys, err = instance.DB.Export(file, false)
+	if err == nil {
+		err = file.Sync()
+	}
+	if stat, sErr := file.Stat(); err == nil && sErr == nil {
+		info.Size = stat.Size()
+	}
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't write backup: %s", err)
+	}
+
+	infoFile, err := ioutil.TempFile(s.backupDir(), name+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Can't write backup: %s", err)
+	}
+	defer os.Remove(infoFile.Name())
+	buf, _ := json.MarshalIndent(info, "", "  ")
+	_, err = infoFile.Write(buf)
+	if cErr := infoFile.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't write backup: %s", err)
+	}
+
+	// Unlike a rename, a link fails if the name is already taken. The
+	// data goes first since the info file is what makes it a backup.
+	path := s.backupPath(name, ".ndjson")
+	infoPath := s.backupPath(name, ".json")
+	if err = os.Link(file.Name(), path); err == nil {
+		if err = os.Link(infoFile.Name(), infoPath); err != nil {
+			os.Remove(path)
+		}
+	}
+	if os.IsExist(err) {
+		return nil, os.ErrExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't write backup: %s", err)
+	}
+
+	s.Debug(2, "Instance %s: Backed up DB %s to %q (%d keys)\n", instanceID,
+		instance.DB.ID, name, info.Keys)
+	return info, nil
+}
+
+// GetBackups returns the backups of an instance, or of all instances if
+// instanceID is "", oldest first
+func (s *Server) GetBackups(instanceID string) ([]*BackupInfo, error) {
+	infos := []*BackupInfo{}
+	if s.config.DataDir == "" {
+		return infos, nil
+	}
+
+	files, err := filepath.Glob(s.backupPath("*", ".json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read backup: %s", err)
+		}
+		info := &BackupInfo{}
+		if err = json.Unmarshal(buf, info); err != nil {
+			return nil, fmt.Errorf("Can't parse %q: %s", file, err)
+		}
+		if instanceID == "" || info.InstanceID == instanceID {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].Created.Before(infos[j].Created)
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// DeleteBackup returns os.ErrNotExist if there isn't one called name
+func (s *Server) DeleteBackup(name string) error {
+	if err := s.checkBackups(name); err != nil {
+		return err
+	}
+	// The info file goes first so a failure doesn't leave half a backup
+	if err := os.Remove(s.backupPath(name, ".json")); err != nil {
+		if os.IsNotExist(err) {
+			return os.ErrNotExist
+		}
+		return fmt.Errorf("Can't delete backup %q: %s", name, err)
+	}
+	os.Remove(s.backupPath(name, ".ndjson"))
+	s.Debug(2, "Deleted backup %q\n", name)
+	return nil
+}
+
+// readBackup returns the checked records and values in backup name
+func (s *Server) readBackup(name string) ([]*ExportRecord, []*Value, error) {
+	if err := s.checkBackups(name); err != nil {
+		return nil, nil, err
+	}
+	if _, err := os.Stat(s.backupPath(name, ".json")); err != nil {
+		return nil, nil, fmt.Errorf("Can't find backup %q", name)
+	}
+	file, err := os.Open(s.backupPath(name, ".ndjson"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't read backup %q: %s", name, err)
+	}
+	defer file.Close()
+
+	recs, err := readImport(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't read backup %q: %s", name, err)
+	}
+	values, err := s.checkImport(recs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't read backup %q: %s", name, err)
+	}
+	return recs, values, nil
+}
+
+// RestoreBackup replaces the contents of db with backup name. It returns
+// errOutOfMemory if there isn't room for it.
+func (s *Server) RestoreBackup(db *DB, name string) error {
+	recs, values, err := s.readBackup(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.importValues(db, recs, values, true); !ok {
+		return errOutOfMemory
+	}
+	s.Debug(2, "DB %s: Restored backup %q\n", db.ID, name)
+	return nil
+}
+
+func (s *Server) BackupCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	instanceID := mux.Vars(r)["iID"]
+	s.instanceMutex.Lock()
+	instance := s.Instances[instanceID]
+	s.instanceMutex.Unlock()
+	if instance == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Can't find instance with id: %s\n", instanceID)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if err := s.checkBackups(name); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	info, err := s.CreateBackup(instanceID, instance, name)
+	if err == os.ErrExist {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Backup %q already exists\n", name)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	w.Header().Set("Location", "/admin/backups/"+info.Name)
+	w.WriteHeader(http.StatusCreated)
+	WriteJSON(w, info)
+}
+
+// BackupListHandler does both the list for one instance and all of them
+func (s *Server) BackupListHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	instanceID := mux.Vars(r)["iID"]
+	s.instanceMutex.Lock()
+	instance := s.Instances[instanceID]
+	s.instanceMutex.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/admin/instances/") && instance == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Can't find instance with id: %s\n", instanceID)
+		return
+	}
+
+	infos, err := s.GetBackups(instanceID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	WriteJSON(w, infos)
+}
+
+func (s *Server) BackupDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	err := s.DeleteBackup(name)
+	switch {
+	case err == os.ErrNotExist:
+		w.WriteHeader(http.StatusNotFound)
+	case err != nil && s.checkBackups(name) != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s\n", err)
+	}
+}
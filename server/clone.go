@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/* Clone Stuff */
+/***************/
+
+// A provision with a "clone_from_instance" parameter gives the new
+// instance a copy of the keys in another instance's DB, as of the
+// provision. The other instance must be in the same org and space. When
+// both DBs are in memory the copy is copy-on-write: the two share keys
+// and plain values until either one changes them, and only lists,
+// hashes, sets and sorted sets (which are changed in place) are copied.
+// Otherwise, e.g. for the durable plan, each key is copied. Either way
+// keys keep their versions, TTLs and metadata but not their history.
+
+// CloneFromParam is the provision parameter naming the instance to copy
+const CloneFromParam = "clone_from_instance"
+
+var errOutOfMemory = errors.New("Out of memory")
+
+// CloneDB creates a new DB, with the given storage, holding a copy of the
+// keys in src
+func (s *Server) CloneDB(r *http.Request, src *DB, storage string) (*DB, error) {
+	var db *DB
+	var err error
+	if storage == StorageMemory && src.Storage == StorageMemory {
+		db = s.shareDB(r, src)
+	} else if db, err = s.copyDB(r, src, storage); err != nil {
+		return nil, err
+	}
+
+	db.mutex.Lock()
+	over := s.overBudget(db, 0)
+	db.mutex.Unlock()
+	if over {
+		s.DeleteDB(db)
+		return nil, errOutOfMemory
+	}
+
+	s.Debug(2, "DB %s: Cloned from DB %s\n", db.ID, src.ID)
+	return db, nil
+}
+
+// shareDB creates a memory DB that shares src's keys and values
+func (s *Server) shareDB(r *http.Request, src *DB) *DB {
+	src.mutex.Lock()
+	store := src.tracked().Store.(*MemStore).Clone()
+	typed := []string{}
+	store.Range("", "", func(key string, v *Value) bool {
+		if v.Type != TypeString {
+			typed = append(typed, key)
+		}
+		return true
+	})
+	for _, key := range typed {
+		store.Put(key, store.Get(key).Copy())
+	}
+	src.mutex.Unlock()
+
+	db := s.addDB(r, s.nextDBID(), StorageMemory, store)
+
+	// The keys didn't go through db.Data.Put so followers haven't seen them
+	s.replicateKeys(db)
+	return db
+}
+
+// copyDB creates a DB and copies each of src's keys into it. Neither DB is
+// locked for the whole copy.
+func (s *Server) copyDB(r *http.Request, src *DB, storage string) (*DB, error) {
+	db, err := s.NewDBWithStorage(r, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	src.mutex.Lock()
+	snap := src.Data.Snapshot()
+	src.mutex.Unlock()
+	defer snap.Close()
+
+	now := time.Now()
+	snap.Range("", "", func(key string, v *Value) bool {
+		if !v.Expires.IsZero() && !now.Before(v.Expires) {
+			return true
+		}
+		// Typed values are changed in place, under the lock
+		if v.Type != TypeString && src.Storage == StorageMemory {
+			src.mutex.Lock()
+			v = v.Copy()
+			src.mutex.Unlock()
+		}
+		db.mutex.Lock()
+		db.Data.Put(key, v)
+		err = db.Data.Err()
+		if err == nil && s.overBudget(db, 0) {
+			err = errOutOfMemory
+		}
+		db.mutex.Unlock()
+		return err == nil
+	})
+	if err == nil {
+		err = snap.Err()
+	}
+	if err != nil {
+		s.DeleteDB(db)
+		if err != errOutOfMemory {
+			err = fmt.Errorf("Can't copy DB %s: %s", src.ID, err)
+		}
+		return nil, err
+	}
+	return db, nil
+}
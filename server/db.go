@@ -0,0 +1,610 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Service(DB) Stuff */
+/*********************/
+
+// A DB's History is kept in memory, even for disk DBs, and only saved with
+// the snapshot, so a crash loses the versions made since the last save
+type DB struct {
+	ID       string
+	User     string
+	Password string
+	Data     Store               // key -> value
+	History  map[string][]*Value // key -> old values, oldest first
+	URL      string              // Access URL
+	Storage  string              // Kind of Store, e.g. StorageDisk
+	mutex    sync.Mutex
+
+	watchers    map[*Watcher]bool
+	pushed      map[string]chan struct{}        // key -> closed on next list push
+	subscribers map[string]map[*Subscriber]bool // channel -> subscribers
+
+	historyUsed int64             // Memory used by History, see setHistory
+	memChanged  func(delta int64) // Called when historyUsed changes
+	evicted     int64             // Keys evicted to make room
+	expired     int64             // Keys removed since they expired
+
+	historyChanged func(key string, h []*Value) // See setHistory
+}
+
+// Value is what's stored for each key. For plain values a nil Data means
+// the value was set via X-NULL. Other types of values keep their data in
+// the field for that type, and are changed in place, under the DB lock,
+// rather than replaced (but still Put back into the Store).
+type Value struct {
+	Type string            `json:"type,omitempty"` // TypeString, TypeList...
+	Data []byte            `json:"data"`           // null vs "" matters
+	List [][]byte          `json:"list,omitempty"`
+	Hash map[string][]byte `json:"hash,omitempty"`
+	Set  map[string]bool   `json:"set,omitempty"`
+	ZSet *SortedSet        `json:"zset,omitempty"`
+	ValueMeta
+
+	listBuf [][]byte // List is the end of this, see pushFront
+}
+
+// Types of values
+const (
+	TypeString = ""
+	TypeList   = "list"
+	TypeHash   = "hash"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+// CheckType returns true if v is nil or of type want. If not, it returns
+// a 409 since the key is being used as the wrong type.
+func CheckType(w http.ResponseWriter, key string, v *Value, want string) bool {
+	if v == nil || v.Type == want {
+		return true
+	}
+	w.WriteHeader(http.StatusConflict)
+	fmt.Fprintf(w, "Key %q is a %s\n", key, typeName(v.Type))
+	return false
+}
+
+// Key names that the routes in NewRouter take over, so they couldn't be
+// read back if they were set
+var reservedNames = []string{"_keys", "_watch", "_ws", "_export", "_import",
+	"_pub", "_sub"}
+var reservedSuffixes = []string{"_history", "_restore", "_list", "_hash",
+	"_set", "_zset"}
+
+// ReservedKey returns true if key can't be used for a plain value because
+// a GET of it would go to one of the other APIs
+func ReservedKey(key string) bool {
+	first, _, _ := strings.Cut(key, "/")
+	for _, name := range reservedNames {
+		if first == name {
+			return true
+		}
+	}
+	for _, name := range reservedSuffixes {
+		if strings.HasSuffix(key, "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) getDB(id string) *DB {
+	s.dbMapMutex.Lock()
+	defer s.dbMapMutex.Unlock()
+	return s.DBs[id]
+}
+
+// typedDB does the DB lookup and auth checking for the calls on typed
+// values
+func (s *Server) typedDB(w http.ResponseWriter, r *http.Request) *DB {
+	db := s.getDB(mux.Vars(r)["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	return db
+}
+
+func typeName(t string) string {
+	if t == TypeString {
+		return "plain value"
+	}
+	return t
+}
+
+// NewTypedValue creates an empty value of type t for key and stores it.
+// Must be called with db.mutex held.
+func (db *DB) NewTypedValue(key string, t string) *Value {
+	v := &Value{Type: t}
+	switch t {
+	case TypeList:
+		v.List = [][]byte{}
+	case TypeHash:
+		v.Hash = map[string][]byte{}
+	case TypeSet:
+		v.Set = map[string]bool{}
+	case TypeZSet:
+		v.ZSet = NewSortedSet()
+	}
+	v.Modified = time.Now().UTC()
+	v.Version = db.lastVersion(key) + 1
+	db.Data.Put(key, v)
+	return v
+}
+
+// Copy returns a copy of v that can be used w/o holding the DB lock
+func (v *Value) Copy() *Value {
+	tmp := *v
+	tmp.listBuf = nil
+	if v.List != nil {
+		tmp.List = append([][]byte{}, v.List...)
+	}
+	if v.Hash != nil {
+		tmp.Hash = map[string][]byte{}
+		for k, val := range v.Hash {
+			tmp.Hash[k] = val
+		}
+	}
+	if v.Set != nil {
+		tmp.Set = map[string]bool{}
+		for k := range v.Set {
+			tmp.Set[k] = true
+		}
+	}
+	if v.ZSet != nil {
+		tmp.ZSet = v.ZSet.Copy()
+	}
+	return &tmp
+}
+
+// ValueMeta is the info about a value that's returned as HTTP headers
+type ValueMeta struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"` // X-Meta-* headers
+	Modified    time.Time         `json:"modified"`
+	Version     int               `json:"version"`
+	Expires     time.Time         `json:"expires,omitzero"` // See TTLHeader
+}
+
+// MetaPrefix is the prefix of the HTTP headers that hold user metadata
+const MetaPrefix = "X-Meta-"
+
+// ParseValueMeta pulls the Content-Type and X-Meta-* headers out of a
+// request
+func ParseValueMeta(header http.Header) ValueMeta {
+	vm := ValueMeta{
+		ContentType: header.Get("Content-Type"),
+		Modified:    time.Now().UTC(),
+	}
+	for k, v := range header {
+		if !strings.HasPrefix(k, MetaPrefix) || len(k) == len(MetaPrefix) {
+			continue
+		}
+		if vm.Meta == nil {
+			vm.Meta = map[string]string{}
+		}
+		vm.Meta[k[len(MetaPrefix):]] = strings.Join(v, ", ")
+	}
+	return vm
+}
+
+// SetHeaders adds the metadata to a response
+func (vm *ValueMeta) SetHeaders(header http.Header) {
+	if vm.ContentType != "" {
+		header.Set("Content-Type", vm.ContentType)
+	}
+	for k, v := range vm.Meta {
+		header.Set(MetaPrefix+k, v)
+	}
+	header.Set(VersionHeader, strconv.Itoa(vm.Version))
+	if !vm.Expires.IsZero() {
+		header.Set(ExpiresHeader, vm.Expires.Format(http.TimeFormat))
+	}
+}
+
+// DefaultMaxValueSize is used when Config.MaxValueSize isn't set
+const DefaultMaxValueSize = 64 * 1024 * 1024
+
+type DBInfo struct {
+	URL      string
+	User     string
+	Password string
+}
+
+// NewDB creates a DB that's kept in memory
+func (s *Server) NewDB(r *http.Request) *DB {
+	db, _ := s.NewDBWithStorage(r, StorageMemory)
+	return db
+}
+
+// newStore creates, or opens, the Store for DB id
+func (s *Server) newStore(id, storage string) (Store, error) {
+	switch storage {
+	case StorageMemory:
+		return NewMemStore(), nil
+	case StorageDisk:
+		if s.config.DataDir == "" {
+			return nil, fmt.Errorf("Disk storage needs a data dir to be " +
+				"configured")
+		}
+		return OpenDiskStore(filepath.Join(s.config.DataDir, "dbs",
+			id+".log"))
+	}
+	return nil, fmt.Errorf("Unknown storage type %q", storage)
+}
+
+func (s *Server) NewDBWithStorage(r *http.Request, storage string) (*DB, error) {
+	strID := s.nextDBID()
+	store, err := s.newStore(strID, storage)
+	if err != nil {
+		return nil, err
+	}
+	return s.addDB(r, strID, storage, store), nil
+}
+
+func (s *Server) nextDBID() string {
+	strID := ""
+
+	s.newDBIDMutex.Lock()
+	for {
+		s.lastID++
+		strID = strconv.Itoa(s.lastID)
+		if s.DBs[strID] == nil {
+			break
+		}
+	}
+	s.newDBIDMutex.Unlock()
+	return strID
+}
+
+// addDB creates DB strID, with its data in store, and adds it to the server
+func (s *Server) addDB(r *http.Request, strID, storage string, store Store) *DB {
+	host := r.Host
+	if s.config.HostString != "" {
+		host = s.config.HostString
+	}
+
+	db := &DB{
+		ID:       strID,
+		User:     "user1",
+		Password: GeneratePassword(),
+		Data:     store,
+		URL:      fmt.Sprintf("http://%s/db/"+strID, host),
+		Storage:  storage,
+		mutex:    sync.Mutex{},
+	}
+	s.registerDB(db)
+	return db
+}
+
+// registerDB starts tracking db and adds it to the server. Returns false,
+// and does nothing, if there's already a DB with its ID.
+func (s *Server) registerDB(db *DB) bool {
+	s.trackDB(db)
+
+	s.dbMapMutex.Lock()
+	if _, ok := s.DBs[db.ID]; ok {
+		s.dbMapMutex.Unlock()
+		s.untrackDB(db)
+		return false
+	}
+	s.DBs[db.ID] = db
+	s.replicateDB(db)
+	s.dbMapMutex.Unlock()
+	s.stateChanged()
+
+	s.Debug(2, "DB %s: created\n", db.ID)
+	return true
+}
+
+func (s *Server) NewDBByID(r *http.Request, id string) *DB {
+	host := r.Host
+	if s.config.HostString != "" {
+		host = s.config.HostString
+	}
+
+	db := &DB{
+		ID:       id,
+		User:     "user1",
+		Password: GeneratePassword(),
+		Data:     NewMemStore(),
+		URL:      fmt.Sprintf("http://%s/db/"+id, host),
+		mutex:    sync.Mutex{},
+	}
+	if !s.registerDB(db) {
+		return nil
+	}
+	return db
+}
+
+func (s *Server) DeleteDB(db *DB) {
+	s.dbMapMutex.Lock()
+	delete(s.DBs, db.ID)
+	s.replicateDropDB(db)
+	s.dbMapMutex.Unlock()
+	s.stateChanged()
+	db.CloseWatchers()
+	db.CloseSubscribers()
+
+	db.mutex.Lock()
+	s.untrackDB(db)
+	if err := db.Data.Drop(); err != nil {
+		s.Debug(1, "DB %s: Error removing its data: %s\n", db.ID, err)
+	}
+	db.mutex.Unlock()
+	s.Debug(2, "DB %s: deleted\n", db.ID)
+}
+
+func (s *Server) DBAllHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	tmpDBs := []*DBInfo{}
+	s.dbMapMutex.Lock()
+	for _, db := range s.DBs {
+		tmpDB := &DBInfo{
+			URL:      db.URL,
+			User:     db.User,
+			Password: db.Password,
+		}
+		tmpDBs = append(tmpDBs, tmpDB)
+	}
+	s.dbMapMutex.Unlock()
+	WriteJSON(w, tmpDBs)
+}
+
+func (s *Server) DBHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if dbID := vars["dbID"]; dbID != "" {
+		if db := s.getDB(dbID); db != nil {
+			if !s.VerifyBasicAuth(w, r, db.User, db.Password) &&
+				!s.VerifyBrokerAuth(w, r) {
+
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tmpDB := DBInfo{
+				URL:      db.URL,
+				User:     db.User,
+				Password: db.Password,
+			}
+			WriteJSON(w, tmpDB)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) DBCreateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	dbID := vars["dbID"]
+
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if dbID == "" {
+		db := s.NewDB(r)
+		w.Header().Add("Location", "/db/"+db.ID)
+		w.WriteHeader(http.StatusCreated)
+		tmpDB := DBInfo{
+			URL:      db.URL,
+			User:     db.User,
+			Password: db.Password,
+		}
+		WriteJSON(w, tmpDB)
+		return
+	}
+
+	db := s.NewDBByID(r, dbID)
+	if db == nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// Add host:port
+	w.Header().Add("Location", "/db/"+dbID)
+
+	w.WriteHeader(http.StatusCreated)
+	tmpDB := DBInfo{
+		URL:      db.URL,
+		User:     db.User,
+		Password: db.Password,
+	}
+	WriteJSON(w, tmpDB)
+}
+
+func (s *Server) DBDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if dbID := vars["dbID"]; dbID != "" {
+		if db := s.getDB(dbID); db != nil {
+			if !s.VerifyBasicAuth(w, r, db.User, db.Password) &&
+				!s.VerifyBrokerAuth(w, r) {
+
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			s.DeleteDB(db)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) DBGetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if dbID := vars["dbID"]; dbID != "" {
+		if db := s.getDB(dbID); db != nil {
+			os.Stdout.Sync()
+			if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if key := vars["key"]; key != "" {
+				version := parseVersion(r)
+				if version < 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "Invalid 'version' query parameter\n")
+					return
+				}
+				db.mutex.Lock()
+				v := db.Data.Get(key)
+				if version > 0 {
+					v = db.GetVersion(key, version)
+				}
+				db.mutex.Unlock()
+				if !CheckType(w, key, v, TypeString) {
+					return
+				}
+				if v != nil {
+					v.SetHeaders(w.Header())
+					if v.Data == nil {
+						w.WriteHeader(http.StatusNoContent)
+						return
+					}
+					// Values are never modified in place so it's ok to
+					// do this w/o the lock. ServeContent does Range
+					// requests, HEAD and Content-Length for us, and
+					// sniffs the Content-Type if there isn't one.
+					http.ServeContent(w, r, "", v.Modified,
+						bytes.NewReader(v.Data))
+					return
+				}
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) DBSetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if db := s.getDB(vars["dbID"]); db != nil {
+		if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if key := vars["key"]; key != "" {
+			if ReservedKey(key) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Key %q is reserved\n", key)
+				return
+			}
+			var value []byte = nil
+			valueStr := "nil"
+			if r.Header.Get("X-NULL") == "" {
+				var err error
+				if value, err = s.ReadValue(w, r); err != nil {
+					WriteReadError(w, err)
+					return
+				}
+				valueStr = fmt.Sprintf("%q", value)
+				if len(value) > 100 {
+					valueStr = fmt.Sprintf("%d bytes", len(value))
+				}
+			}
+			expires, err := parseTTL(r.Header)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%s\n", err)
+				return
+			}
+			v := &Value{Data: value, ValueMeta: ParseValueMeta(r.Header)}
+			v.Expires = expires
+			db.mutex.Lock()
+			need := db.setNeed(key, v, s.config.MaxVersions)
+			if !s.MakeRoom(w, db, key, need) {
+				db.mutex.Unlock()
+				return
+			}
+			db.SetValue(key, v, s.config.MaxVersions)
+			db.mutex.Unlock()
+			s.Debug(3, "DB %s: Set %q to %s (version %d)\n", db.ID, key,
+				valueStr, v.Version)
+			w.Header().Set(VersionHeader, strconv.Itoa(v.Version))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// ReadValue reads the body of a request, which may be chunked, up to
+// MaxValueSize bytes. Stores hold whole values so the body isn't streamed
+// anywhere, it's all read into memory first.
+func (s *Server) ReadValue(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	max := s.config.MaxValueSize
+	if r.ContentLength > max {
+		return nil, &http.MaxBytesError{Limit: max}
+	}
+
+	buf := &bytes.Buffer{}
+	if r.ContentLength > 0 {
+		buf.Grow(int(r.ContentLength))
+	}
+	// Large uploads can take longer than the server's ReadTimeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	_, err := io.Copy(buf, http.MaxBytesReader(w, r.Body, max))
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return []byte{}, nil // nil means X-NULL
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteReadError sends back the error from ReadValue
+func WriteReadError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Value is larger than %d bytes\n", maxErr.Limit)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "Error reading value: %s\n", err)
+}
+
+func (s *Server) DBRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if db := s.getDB(vars["dbID"]); db != nil {
+		if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if key := vars["key"]; key != "" {
+			db.mutex.Lock()
+			if db.RemoveValue(key, s.config.MaxVersions) {
+				db.mutex.Unlock()
+				s.Debug(3, "DB %s: Removed %q\n", db.ID, key)
+				return
+			}
+			db.mutex.Unlock()
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
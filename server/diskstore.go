@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+/* Disk Store Stuff */
+/********************/
+
+// DiskStore is a Store that keeps values in a log file, with just an index
+// of where each key's latest value is kept in memory. Every Put or Delete
+// appends a record to the end of the file, and once most of the file is
+// old records it's compacted by copying the live ones into a new file.
+//
+// Each record is a 4 byte length, a 4 byte CRC32 of the payload, and then
+// the payload: a diskRecord as JSON. A partial record at the end of the
+// file (e.g. from a crash) is dropped when the file is opened, but a bad
+// record anywhere else means the file is corrupt and it won't be opened.
+//
+// Writes go straight to the OS, so they survive the broker crashing, but
+// they're only fsync'd on Close and compaction. Only the current values
+// are kept, a DB's History isn't (see DB).
+type DiskStore struct {
+	path     string
+	file     *diskFile
+	index    *treap // key -> diskLoc
+	size     int64  // Bytes in the file
+	live     int64  // Bytes in the file that are still in the index
+	readOnly bool
+	closed   bool
+	err      error
+}
+
+// diskFile is a log file shared by a DiskStore and its snapshots. It's
+// closed once none of them are using it.
+type diskFile struct {
+	*os.File
+	refs int32
+}
+
+func (f *diskFile) acquire() *diskFile {
+	atomic.AddInt32(&f.refs, 1)
+	return f
+}
+
+func (f *diskFile) release() error {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		return f.File.Close()
+	}
+	return nil
+}
+
+type diskLoc struct {
+	off  int64
+	size int64 // Including the header
+}
+
+type diskRecord struct {
+	Key   string `json:"k"`
+	Value *Value `json:"v,omitempty"` // nil means it was deleted
+}
+
+const diskHeaderSize = 8
+
+// Files smaller than this aren't worth compacting
+var DiskCompactMinSize int64 = 1024 * 1024
+
+var errReadOnly = errors.New("Store snapshot is read-only")
+
+// OpenDiskStore opens, or creates, the store kept in the file at path
+func OpenDiskStore(path string) (*DiskStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("Can't create dir for %q: %s", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open %q: %s", path, err)
+	}
+
+	d := &DiskStore{path: path, file: &diskFile{File: file, refs: 1},
+		index: newTreap()}
+	if err = d.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// load builds the index from the records in the file
+func (d *DiskStore) load() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return fmt.Errorf("Can't read %q: %s", d.path, err)
+	}
+	end := info.Size()
+
+	for d.size < end {
+		rec, size, err := d.readRecord(d.file.File, d.size, end)
+		if err != nil {
+			// Only the last record can be a write that didn't finish.
+			// Dropping a bad one in the middle would lose everything
+			// written after it.
+			if size != 0 && d.size+size < end {
+				return fmt.Errorf("Corrupt record in %q at offset %d: %s",
+					d.path, d.size, err)
+			}
+			if err = d.file.Truncate(d.size); err != nil {
+				return fmt.Errorf("Can't truncate %q: %s", d.path, err)
+			}
+			break
+		}
+		d.apply(rec.Key, rec.Value != nil, diskLoc{off: d.size, size: size})
+		d.size += size
+	}
+	return nil
+}
+
+// apply updates the index, and the count of live bytes, for a record that
+// was just added at loc
+func (d *DiskStore) apply(key string, isPut bool, loc diskLoc) {
+	var old interface{}
+	var ok bool
+	if isPut {
+		old = d.index.put(key, loc)
+		ok = old != nil
+		d.live += loc.size
+	} else {
+		old, ok = d.index.delete(key)
+	}
+	if ok {
+		d.live -= old.(diskLoc).size
+	}
+}
+
+// readRecord reads the record at off, which must end by end. If the record
+// is bad but its length could be read then its size is returned with the
+// error.
+func (d *DiskStore) readRecord(file *os.File, off, end int64) (*diskRecord, int64, error) {
+	header := make([]byte, diskHeaderSize)
+	if _, err := file.ReadAt(header, off); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if off+diskHeaderSize+int64(length) > end {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := diskHeaderSize + int64(length)
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, off+diskHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, size, fmt.Errorf("Bad checksum at offset %d", off)
+	}
+	rec := &diskRecord{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, size, err
+	}
+	return rec, size, nil
+}
+
+// setErr remembers the first error, see Err()
+func (d *DiskStore) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// write appends a record. The index is only updated if it worked.
+func (d *DiskStore) write(key string, v *Value) {
+	if d.readOnly {
+		d.setErr(errReadOnly)
+		return
+	}
+	payload, err := json.Marshal(&diskRecord{Key: key, Value: v})
+	if err != nil {
+		d.setErr(fmt.Errorf("Can't save %q: %s", key, err))
+		return
+	}
+	buf := make([]byte, diskHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	copy(buf[diskHeaderSize:], payload)
+
+	if _, err = d.file.WriteAt(buf, d.size); err != nil {
+		d.setErr(fmt.Errorf("Can't write to %q: %s", d.path, err))
+		return
+	}
+	loc := diskLoc{off: d.size, size: int64(len(buf))}
+	d.size += loc.size
+	d.apply(key, v != nil, loc)
+
+	if d.size > DiskCompactMinSize && d.size > 2*d.live {
+		d.compact()
+	}
+}
+
+func (d *DiskStore) read(key string, loc diskLoc) *Value {
+	rec, _, err := d.readRecord(d.file.File, loc.off, loc.off+loc.size)
+	if err != nil {
+		d.setErr(fmt.Errorf("Can't read %q from %q: %s", key, d.path, err))
+		return nil
+	}
+	return rec.Value
+}
+
+// compact copies the live records into a new file and switches to it.
+// Snapshots keep using the old file, which is closed once they're closed.
+func (d *DiskStore) compact() {
+	tmpPath := d.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		d.setErr(fmt.Errorf("Can't compact %q: %s", d.path, err))
+		return
+	}
+
+	index := newTreap()
+	size := int64(0)
+	d.index.walk("", "", func(key string, l interface{}) bool {
+		loc := l.(diskLoc)
+		buf := make([]byte, loc.size)
+		if _, err = d.file.ReadAt(buf, loc.off); err != nil {
+			return false
+		}
+		if _, err = tmp.WriteAt(buf, size); err != nil {
+			return false
+		}
+		index.put(key, diskLoc{off: size, size: loc.size})
+		size += loc.size
+		return true
+	})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, d.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		d.setErr(fmt.Errorf("Can't compact %q: %s", d.path, err))
+		return
+	}
+
+	old := d.file
+	d.file = &diskFile{File: tmp, refs: 1}
+	d.index, d.size, d.live = index, size, size
+	old.release()
+}
+
+func (d *DiskStore) Get(key string) *Value {
+	if loc, ok := d.index.get(key); ok {
+		return d.read(key, loc.(diskLoc))
+	}
+	return nil
+}
+
+func (d *DiskStore) Put(key string, v *Value) {
+	d.write(key, v)
+}
+
+func (d *DiskStore) Delete(key string) bool {
+	if _, ok := d.index.get(key); !ok {
+		return false
+	}
+	d.write(key, nil)
+	return true
+}
+
+func (d *DiskStore) Len() int {
+	return d.index.size
+}
+
+func (d *DiskStore) Range(start, end string, fn func(string, *Value) bool) {
+	d.index.walk(start, end, func(key string, loc interface{}) bool {
+		if v := d.read(key, loc.(diskLoc)); v != nil {
+			return fn(key, v)
+		}
+		return true
+	})
+}
+
+// Snapshot shares the file, which is ok since records are never changed
+// once they're written. The file stays open until the snapshot is closed.
+func (d *DiskStore) Snapshot() Store {
+	return &DiskStore{
+		path:     d.path,
+		file:     d.file.acquire(),
+		index:    d.index.clone(),
+		size:     d.size,
+		live:     d.live,
+		readOnly: true,
+	}
+}
+
+func (d *DiskStore) Err() error {
+	return d.err
+}
+
+func (d *DiskStore) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.readOnly {
+		return d.file.release()
+	}
+	err := d.file.Sync()
+	if cErr := d.file.release(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+func (d *DiskStore) Drop() error {
+	d.Close()
+	return os.Remove(d.path)
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/* Export/Import Stuff */
+/***********************/
+
+// An export is one ExportRecord per key, in key order, either as NDJSON
+// (one record per line, the default) or as a JSON array:
+//
+//	GET  /db/{dbID}/_export?format=ndjson|json
+//	POST /db/{dbID}/_import?mode=merge|replace
+//
+// Imports take either format. "merge", the default, leaves keys that
+// aren't in the import alone, "replace" deletes them. Nothing is changed
+// if any record is bad, or if the keys won't fit in the memory budget.
+// Imported keys get new versions, like a PUT.
+
+// DefaultMaxImportSize is used when Config.MaxImportSize isn't set
+const DefaultMaxImportSize = 1024 * 1024 * 1024
+
+// ImportTimeout is how long the body of an _import has to arrive, instead
+// of the server's ReadTimeout
+var ImportTimeout = 10 * time.Minute
+
+// ExportRecord is one key of an export. Values are base64 encoded in the
+// JSON. TTL is how many seconds the key had left when it was exported.
+type ExportRecord struct {
+	Key         string            `json:"key"`
+	Type        string            `json:"type,omitempty"`
+	Value       []byte            `json:"value,omitempty"`
+	Null        bool              `json:"null,omitempty"` // Like X-NULL
+	List        [][]byte          `json:"list,omitempty"`
+	Hash        map[string][]byte `json:"hash,omitempty"`
+	Set         []string          `json:"set,omitempty"`
+	ZSet        []ZItem           `json:"zset,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	TTL         float64           `json:"ttl,omitempty"`
+}
+
+// ImportResult is returned by _import
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Deleted  int `json:"deleted"`
+}
+
+func newExportRecord(key string, v *Value, now time.Time) *ExportRecord {
+	rec := &ExportRecord{
+		Key:         key,
+		Type:        v.Type,
+		ContentType: v.ContentType,
+		Meta:        v.Meta,
+	}
+	switch v.Type {
+	case TypeString:
+		rec.Value, rec.Null = v.Data, v.Data == nil
+	case TypeList:
+		rec.List = v.List
+	case TypeHash:
+		rec.Hash = v.Hash
+	case TypeSet:
+		rec.Set = make([]string, 0, len(v.Set))
+		for m := range v.Set {
+			rec.Set = append(rec.Set, m)
+		}
+		sort.Strings(rec.Set)
+	case TypeZSet:
+		rec.ZSet = v.ZSet.items
+	}
+	if !v.Expires.IsZero() {
+		rec.TTL = v.Expires.Sub(now).Seconds()
+	}
+	return rec
+}
+
+// value checks rec and turns it into a Value. nil means it's an empty
+// typed value, which we don't keep.
+func (rec *ExportRecord) value(maxSize int64, now time.Time) (*Value, error) {
+	if rec.Key == "" {
+		return nil, fmt.Errorf("Missing 'key'")
+	}
+	if rec.TTL < 0 || rec.TTL > maxTTL.Seconds() {
+		return nil, fmt.Errorf("Invalid 'ttl' of %q: %v", rec.Key, rec.TTL)
+	}
+
+	v := &Value{Type: rec.Type, ValueMeta: ValueMeta{
+		ContentType: rec.ContentType,
+		Meta:        rec.Meta,
+		Modified:    now.UTC(),
+	}}
+	if rec.TTL > 0 {
+		ttl := time.Duration(rec.TTL * float64(time.Second))
+		v.Expires = v.Modified.Add(ttl)
+	}
+
+	size := int64(0)
+	switch rec.Type {
+	case TypeString:
+		v.Data = rec.Value
+		if v.Data == nil && !rec.Null {
+			v.Data = []byte{}
+		}
+		size = int64(len(v.Data))
+	case TypeList:
+		v.List = rec.List
+		for _, item := range v.List {
+			size += int64(len(item))
+		}
+		if len(v.List) == 0 {
+			return nil, nil
+		}
+	case TypeHash:
+		v.Hash = rec.Hash
+		for _, val := range v.Hash {
+			size += int64(len(val))
+		}
+		if len(v.Hash) == 0 {
+			return nil, nil
+		}
+	case TypeSet:
+		v.Set = map[string]bool{}
+		for _, m := range rec.Set {
+			v.Set[m] = true
+		}
+		if len(v.Set) == 0 {
+			return nil, nil
+		}
+	case TypeZSet:
+		v.ZSet = NewSortedSet()
+		for _, item := range rec.ZSet {
+			if math.IsInf(item.Score, 0) || math.IsNaN(item.Score) {
+				return nil, fmt.Errorf("Score of %q in %q must be a finite "+
+					"number", item.Member, rec.Key)
+			}
+			v.ZSet.Add(item.Member, item.Score)
+		}
+		if v.ZSet.Len() == 0 {
+			return nil, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown type %q of %q", rec.Type, rec.Key)
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("Value of %q is larger than %d bytes",
+			rec.Key, maxSize)
+	}
+	return v, nil
+}
+
+// ImportValue makes v, of any type, the current value of key, with the
+// next version number. Must be called with db.mutex held.
+func (db *DB) ImportValue(key string, v *Value, maxVersions int) {
+	if v.Type == TypeString {
+		db.SetValue(key, v, maxVersions)
+		return
+	}
+	v.Version = db.lastVersion(key) + 1
+	if old := db.Data.Get(key); old != nil {
+		db.addHistory(key, old, maxVersions)
+	}
+	db.Data.Put(key, v)
+	db.Notify(&WatchEvent{Op: "import", Key: key})
+}
+
+func (s *Server) DBExportHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "ndjson" && format != "json" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid 'format' query parameter: %q\n", format)
+		return
+	}
+
+	// Big DBs can take longer than the server's WriteTimeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	count, err := db.Export(w, format == "json")
+	if err != nil {
+		// It's too late for an error status, so cut the response short
+		// rather than have it look complete
+		s.Debug(1, "DB %s: Export failed after %d keys: %s\n", db.ID,
+			count, err)
+		panic(http.ErrAbortHandler)
+	}
+	s.Debug(3, "DB %s: Exported %d keys\n", db.ID, count)
+}
+
+// Export writes all of the keys in db, as of now, to w and returns how
+// many there were. The DB isn't locked while it's being written.
+func (db *DB) Export(w io.Writer, asJSON bool) (int, error) {
+	db.mutex.Lock()
+	snap := db.Data.Snapshot()
+	db.mutex.Unlock()
+	defer snap.Close()
+
+	var err error
+	if asJSON {
+		_, err = io.WriteString(w, "[")
+	}
+
+	now, count := time.Now(), 0
+	snap.Range("", "", func(key string, v *Value) bool {
+		if err != nil {
+			return false
+		}
+		if !v.Expires.IsZero() && !now.Before(v.Expires) {
+			return true
+		}
+		// Typed values are changed in place, under the lock
+		if v.Type != TypeString && db.Storage == StorageMemory {
+			db.mutex.Lock()
+			v = v.Copy()
+			db.mutex.Unlock()
+		}
+		var buf []byte
+		if buf, err = json.Marshal(newExportRecord(key, v, now)); err != nil {
+			return false
+		}
+		switch {
+		case !asJSON:
+			_, err = fmt.Fprintf(w, "%s\n", buf)
+		case count == 0:
+			_, err = fmt.Fprintf(w, "\n%s", buf)
+		default:
+			_, err = fmt.Fprintf(w, ",\n%s", buf)
+		}
+		count++
+		return err == nil
+	})
+	if asJSON && err == nil {
+		_, err = io.WriteString(w, "\n]\n")
+	}
+	if err == nil {
+		err = snap.Err()
+	}
+	return count, err
+}
+
+// readImport parses the records of an import, in either format
+func readImport(body io.Reader) ([]*ExportRecord, error) {
+	in := bufio.NewReader(body)
+	dec := json.NewDecoder(in)
+	recs := []*ExportRecord{}
+
+	// Skip any leading whitespace to see which format it is
+	for {
+		b, err := in.Peek(1)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			if b[0] == '[' {
+				dec.Token()
+			}
+			break
+		}
+		in.ReadByte()
+	}
+
+	for dec.More() {
+		rec := &ExportRecord{}
+		if err := dec.Decode(rec); err != nil {
+			return nil, fmt.Errorf("Bad record #%d: %w", len(recs)+1, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func (s *Server) DBImportHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "merge" && mode != "replace" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid 'mode' query parameter: %q\n", mode)
+		return
+	}
+
+	// Big imports can take longer than the server's ReadTimeout
+	http.NewResponseController(w).SetReadDeadline(
+		time.Now().Add(ImportTimeout))
+	max := s.config.MaxImportSize
+	recs, err := readImport(http.MaxBytesReader(w, r.Body, max))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Import is larger than %d bytes\n", max)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error reading import: %s\n", err)
+		return
+	}
+
+	values, err := s.checkImport(recs)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	result, ok := s.importValues(db, recs, values, mode == "replace")
+	if !ok {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		fmt.Fprintf(w, "Out of memory, can't import %d keys into DB %s\n",
+			len(recs), db.ID)
+		return
+	}
+	WriteJSON(w, result)
+}
+
+// checkImport turns recs into Values, or returns an error if any of them
+// are bad
+func (s *Server) checkImport(recs []*ExportRecord) ([]*Value, error) {
+	now := time.Now()
+	values := make([]*Value, len(recs))
+	for i, rec := range recs {
+		var err error
+		if values[i], err = rec.value(s.config.MaxValueSize, now); err != nil {
+			return nil, fmt.Errorf("Bad record #%d: %s", i+1, err)
+		}
+	}
+	return values, nil
+}
+
+// importValues loads the values from checkImport into db. If replace is
+// true, keys that aren't in recs are deleted. Returns false, w/o changing
+// anything, if they won't fit.
+func (s *Server) importValues(db *DB, recs []*ExportRecord, values []*Value, replace bool) (*ImportResult, bool) {
+	result := &ImportResult{}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	old := []string{}
+	if replace {
+		keys := map[string]bool{}
+		for _, rec := range recs {
+			keys[rec.Key] = true
+		}
+		db.Data.Range("", "", func(key string, v *Value) bool {
+			if !keys[key] {
+				old = append(old, key)
+			}
+			return true
+		})
+	}
+
+	// Make room for all of it up front so we don't fail half way through
+	need := int64(0)
+	for i, v := range values {
+		if v != nil {
+			need += db.setNeed(recs[i].Key, v, s.config.MaxVersions)
+		}
+	}
+	for _, key := range old {
+		need -= db.removeNeed(key, s.config.MaxVersions)
+	}
+	if !s.makeRoom(db, "", need) {
+		return result, false
+	}
+
+	if replace {
+		for _, key := range old {
+			db.RemoveValue(key, s.config.MaxVersions)
+		}
+		result.Deleted = len(old)
+	}
+
+	for i, v := range values {
+		if v == nil {
+			// Empty typed value, so it just replaces whatever was there
+			if db.RemoveValue(recs[i].Key, s.config.MaxVersions) {
+				result.Deleted++
+			}
+			continue
+		}
+		// Just in case the estimate was off, e.g. if a key was evicted
+		need := db.setNeed(recs[i].Key, v, s.config.MaxVersions)
+		if !s.makeRoom(db, recs[i].Key, need) {
+			return result, false
+		}
+		db.ImportValue(recs[i].Key, v, s.config.MaxVersions)
+		result.Imported++
+	}
+
+	s.Debug(3, "DB %s: Imported %d keys, deleted %d\n", db.ID,
+		result.Imported, result.Deleted)
+	return result, true
+}
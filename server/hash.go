@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Hash Stuff */
+/**************/
+
+// A hash key holds a set of fields, each with its own value, so records
+// can be updated one field at a time:
+//
+//	GET    /db/{dbID}/{key}/_hash          all fields, as a JSON object
+//	GET    /db/{dbID}/{key}/_hash/{field}  one field's value
+//	PUT    /db/{dbID}/{key}/_hash/{field}  body is the field's value
+//	DELETE /db/{dbID}/{key}/_hash/{field}
+//
+// Values in the JSON object are base64 encoded. Empty hashes are deleted.
+
+func (s *Server) DBHashGetAllHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeHash) {
+		db.mutex.Unlock()
+		return
+	}
+	fields := map[string][]byte{}
+	if v != nil {
+		for k, val := range v.Hash {
+			fields[k] = val
+		}
+	}
+	db.mutex.Unlock()
+
+	w.Header().Set(LengthHeader, strconv.Itoa(len(fields)))
+	WriteJSON(w, fields)
+}
+
+func (s *Server) DBHashGetHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, field := vars["key"], vars["field"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeHash) {
+		db.mutex.Unlock()
+		return
+	}
+	var value []byte
+	ok := false
+	if v != nil {
+		value, ok = v.Hash[field]
+	}
+	db.mutex.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+func (s *Server) DBHashSetHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	value, err := s.ReadValue(w, r)
+	if err != nil {
+		WriteReadError(w, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, field := vars["key"], vars["field"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeHash) {
+		db.mutex.Unlock()
+		return
+	}
+	need := db.addNeed(key, int64(48+len(field)+len(value)))
+	if !s.MakeRoom(w, db, key, need) {
+		db.mutex.Unlock()
+		return
+	}
+	if v == nil {
+		v = db.NewTypedValue(key, TypeHash)
+	}
+	v.Hash[field] = value
+	v.Modified = time.Now().UTC()
+	db.Data.Put(key, v)
+	length := len(v.Hash)
+	db.Notify(&WatchEvent{Op: "hset", Key: key, Field: field,
+		Value: value})
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Set field %q of %q\n", db.ID, field, key)
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+}
+
+func (s *Server) DBHashDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, field := vars["key"], vars["field"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeHash) {
+		db.mutex.Unlock()
+		return
+	}
+	ok := false
+	if v != nil {
+		_, ok = v.Hash[field]
+	}
+	if !ok {
+		db.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(v.Hash, field)
+	v.Modified = time.Now().UTC()
+	length := len(v.Hash)
+	db.Notify(&WatchEvent{Op: "hdel", Key: key, Field: field})
+	if length == 0 {
+		db.Data.Delete(key)
+	} else {
+		db.Data.Put(key, v)
+	}
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Deleted field %q of %q\n", db.ID, field, key)
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+}
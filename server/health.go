@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+/* Health Stuff */
+/****************/
+
+// How long a check can take before we consider that part of the server hung
+var HealthCheckTimeout = 2 * time.Second
+
+type CheckResult struct {
+	Status string `json:"status"` // ok, disabled or failed
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthResult struct {
+	Status string                  `json:"status"` // ok or failed
+	Checks map[string]*CheckResult `json:"checks"`
+}
+
+// runningCheck is a check that's still going, whose result is shared by
+// everyone who asks for that kind of check until it's done
+type runningCheck struct {
+	done chan struct{} // Closed once res is set
+	res  *CheckResult
+}
+
+// runCheck runs check() but gives up after HealthCheckTimeout, e.g. if
+// it's stuck waiting on a lock. Only one check of each kind runs at a time,
+// so a hung server doesn't pile up a goroutine for each probe.
+func (s *Server) runCheck(kind string, check func() *CheckResult) *CheckResult {
+	s.checkMutex.Lock()
+	rc := s.runningChecks[kind]
+	if rc == nil {
+		rc = &runningCheck{done: make(chan struct{})}
+		s.runningChecks[kind] = rc
+		go func() {
+			rc.res = check()
+			s.checkMutex.Lock()
+			delete(s.runningChecks, kind)
+			s.checkMutex.Unlock()
+			close(rc.done)
+		}()
+	}
+	s.checkMutex.Unlock()
+
+	select {
+	case <-rc.done:
+		return rc.res
+	case <-time.After(HealthCheckTimeout):
+		return &CheckResult{Status: "failed", Error: "Timed out"}
+	}
+}
+
+// CheckStore makes sure we can get to the DBs and Instances
+func (s *Server) CheckStore() *CheckResult {
+	return s.runCheck("store", func() *CheckResult {
+		s.newDBIDMutex.Lock()
+		s.newDBIDMutex.Unlock()
+
+		s.instanceMutex.Lock()
+		s.instanceMutex.Unlock()
+
+		for _, db := range s.allDBs() {
+			db.mutex.Lock()
+			db.mutex.Unlock()
+		}
+		return &CheckResult{Status: "ok"}
+	})
+}
+
+// CheckDisk makes sure none of the on-disk stores have had a read or
+// write fail. Those errors stick until the broker is restarted, so this
+// isn't part of /healthz - restarting over and over wouldn't help.
+func (s *Server) CheckDisk() *CheckResult {
+	return s.runCheck("disk", func() *CheckResult {
+		for _, db := range s.allDBs() {
+			db.mutex.Lock()
+			err := db.Data.Err()
+			db.mutex.Unlock()
+			if err != nil {
+				return &CheckResult{Status: "failed",
+					Error: fmt.Sprintf("DB %s: %s", db.ID, err)}
+			}
+		}
+		return &CheckResult{Status: "ok"}
+	})
+}
+
+// allDBs returns the DBs as of now, so they can be looked at without
+// holding dbMapMutex
+func (s *Server) allDBs() []*DB {
+	s.dbMapMutex.Lock()
+	defer s.dbMapMutex.Unlock()
+	dbs := make([]*DB, 0, len(s.DBs))
+	for _, db := range s.DBs {
+		dbs = append(dbs, db)
+	}
+	return dbs
+}
+
+// CheckPersistence makes sure we'll be able to save snapshots
+func (s *Server) CheckPersistence() *CheckResult {
+	if s.config.DataDir == "" {
+		return &CheckResult{Status: "disabled"}
+	}
+
+	return s.runCheck("persistence", func() *CheckResult {
+		if err := os.MkdirAll(s.config.DataDir, 0700); err != nil {
+			return &CheckResult{Status: "failed", Error: err.Error()}
+		}
+		f, err := ioutil.TempFile(s.config.DataDir, ".healthz")
+		if err != nil {
+			return &CheckResult{Status: "failed", Error: err.Error()}
+		}
+		f.Close()
+		os.Remove(f.Name())
+		return &CheckResult{Status: "ok"}
+	})
+}
+
+// CheckListener makes sure we're accepting new requests. When we're
+// embedded (no ListenAndServe) it's up to the caller to manage that.
+func (s *Server) CheckListener() *CheckResult {
+	select {
+	case <-s.done:
+		return &CheckResult{Status: "failed", Error: "Shutting down"}
+	default:
+	}
+
+	s.serverMutex.Lock()
+	httpServer := s.httpServer
+	listening := s.listening
+	s.serverMutex.Unlock()
+
+	if httpServer == nil {
+		return &CheckResult{Status: "disabled"}
+	}
+	if !listening {
+		return &CheckResult{Status: "failed", Error: "Not listening"}
+	}
+	return &CheckResult{Status: "ok"}
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]*CheckResult) {
+	res := HealthResult{
+		Status: "ok",
+		Checks: checks,
+	}
+	for _, c := range checks {
+		if c.Status == "failed" {
+			res.Status = "failed"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	WriteJSON(w, res)
+}
+
+// HealthzHandler is the liveness probe - are we still working at all
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]*CheckResult{
+		"store": s.CheckStore(),
+	})
+}
+
+// ReadyzHandler is the readiness probe - should we be sent traffic
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]*CheckResult{
+		"store":       s.CheckStore(),
+		"disk":        s.CheckDisk(),
+		"persistence": s.CheckPersistence(),
+		"listener":    s.CheckListener(),
+		"replication": s.CheckReplication(),
+	})
+}
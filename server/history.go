@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* History Stuff */
+/*****************/
+
+// DefaultMaxVersions is used when Config.MaxVersions isn't set
+const DefaultMaxVersions = 5
+
+// VersionHeader holds the version of the value on GETs, HEADs and PUTs
+const VersionHeader = "X-Version"
+
+// VersionInfo is one entry in the list returned by _history
+type VersionInfo struct {
+	Version     int       `json:"version"`
+	Size        int       `json:"size"`
+	Null        bool      `json:"null,omitempty"`
+	Current     bool      `json:"current,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Modified    time.Time `json:"modified"`
+}
+
+// lastVersion returns the highest version number used for key so far.
+// Must be called with db.mutex held.
+func (db *DB) lastVersion(key string) int {
+	last := 0
+	if v := db.Data.Get(key); v != nil {
+		last = v.Version
+	}
+	if h := db.History[key]; len(h) > 0 && h[len(h)-1].Version > last {
+		last = h[len(h)-1].Version
+	}
+	return last
+}
+
+// addHistory saves old as the newest previous version of key, keeping at
+// most max of them. Must be called with db.mutex held.
+func (db *DB) addHistory(key string, old *Value, max int) {
+	// Only plain values have history since the others change in place
+	if max <= 0 || old.Type != TypeString {
+		return
+	}
+	if db.History == nil {
+		db.History = map[string][]*Value{}
+	}
+	h := append(db.History[key], old)
+	if len(h) > max {
+		h = append([]*Value{}, h[len(h)-max:]...)
+	}
+	db.setHistory(key, h)
+}
+
+// SetValue makes v the current value of key, with the next version
+// number, and moves the old value into the key's history. Must be called
+// with db.mutex held.
+func (db *DB) SetValue(key string, v *Value, maxVersions int) {
+	v.Version = db.lastVersion(key) + 1
+	if old := db.Data.Get(key); old != nil {
+		db.addHistory(key, old, maxVersions)
+	}
+	db.Data.Put(key, v)
+	db.Notify(&WatchEvent{Op: "set", Key: key, Value: v.Data,
+		Null: v.Data == nil})
+}
+
+// RemoveValue deletes key, but keeps its value in the history so it can
+// be restored. Must be called with db.mutex held.
+func (db *DB) RemoveValue(key string, maxVersions int) bool {
+	old := db.Data.Get(key)
+	if old == nil {
+		return false
+	}
+	db.Data.Delete(key)
+	db.addHistory(key, old, maxVersions)
+	db.Notify(&WatchEvent{Op: "delete", Key: key})
+	return true
+}
+
+// GetVersion returns the given version of key, current or old, or nil.
+// Must be called with db.mutex held.
+func (db *DB) GetVersion(key string, version int) *Value {
+	if v := db.Data.Get(key); v != nil && v.Version == version {
+		return v
+	}
+	for _, v := range db.History[key] {
+		if v.Version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// parseVersion returns the "version" query parameter, or 0 if it's
+// missing. -1 means it was invalid.
+func parseVersion(r *http.Request) int {
+	str := r.URL.Query().Get("version")
+	if str == "" {
+		return 0
+	}
+	if ver, err := strconv.Atoi(str); err == nil && ver > 0 {
+		return ver
+	}
+	return -1
+}
+
+// DBHistoryHandler returns the list of versions of a key, oldest first.
+// If none of them are "current" then the key has been deleted.
+func (s *Server) DBHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	key := vars["key"]
+	list := []*VersionInfo{}
+	db.mutex.Lock()
+	versions := db.History[key]
+	cur := db.Data.Get(key)
+	if cur != nil {
+		versions = append(versions[:len(versions):len(versions)], cur)
+	}
+	for _, v := range versions {
+		list = append(list, &VersionInfo{
+			Version:     v.Version,
+			Size:        len(v.Data),
+			Null:        v.Data == nil,
+			Current:     v == cur,
+			ContentType: v.ContentType,
+			Modified:    v.Modified,
+		})
+	}
+	db.mutex.Unlock()
+
+	if len(list) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, list)
+}
+
+// DBRestoreHandler makes an old version of a key the current one. It's
+// saved as a new version so the restore itself can be undone.
+func (s *Server) DBRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	version := parseVersion(r)
+	if version <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Missing or invalid 'version' query parameter\n")
+		return
+	}
+
+	key := vars["key"]
+	db.mutex.Lock()
+	old := db.GetVersion(key, version)
+	if old == nil {
+		db.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	v := &Value{Type: old.Type, Data: old.Data, ValueMeta: old.ValueMeta}
+	v.Modified = time.Now().UTC()
+	v.Expires = time.Time{}
+	need := db.setNeed(key, v, s.config.MaxVersions)
+	if !s.MakeRoom(w, db, key, need) {
+		db.mutex.Unlock()
+		return
+	}
+	db.SetValue(key, v, s.config.MaxVersions)
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Restored %q to version %d as version %d\n", db.ID,
+		key, version, v.Version)
+	w.Header().Set(VersionHeader, strconv.Itoa(v.Version))
+}
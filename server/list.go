@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* List Stuff */
+/**************/
+
+// MaxPopTimeout is the longest a blocking pop will wait for an item
+var MaxPopTimeout = 5 * time.Minute
+
+// LengthHeader holds the length of the list on list responses
+const LengthHeader = "X-Length"
+
+// pushSignal returns a channel that'll be closed the next time something
+// is pushed onto key. Must be called with db.mutex held.
+func (db *DB) pushSignal(key string) chan struct{} {
+	if db.pushed == nil {
+		db.pushed = map[string]chan struct{}{}
+	}
+	ch := db.pushed[key]
+	if ch == nil {
+		ch = make(chan struct{})
+		db.pushed[key] = ch
+	}
+	return ch
+}
+
+// pushFront adds item to the front of v's list. Like append, it leaves
+// room when it has to grow the list, but at both ends, so pushes onto
+// either end don't copy the whole list each time.
+func (v *Value) pushFront(item []byte) {
+	// The room in front of List, if List is still in listBuf
+	room := cap(v.listBuf) - cap(v.List)
+	if room > 0 && cap(v.List) > 0 && &v.listBuf[cap(v.listBuf)-1] ==
+		&v.List[:cap(v.List)][cap(v.List)-1] {
+
+		v.listBuf[room-1] = item
+		v.List = v.listBuf[room-1 : room+len(v.List)]
+		return
+	}
+
+	n := len(v.List) + 1
+	v.listBuf = make([][]byte, 3*n)
+	v.listBuf[n] = item
+	copy(v.listBuf[n+1:], v.List)
+	v.List = v.listBuf[n : 2*n]
+}
+
+// Push adds item to the front (left) or back of the list in key, creating
+// it if needed, and returns the new length. Must be called with db.mutex
+// held, and the key must be a list or not exist. The whole list is Put
+// back into the Store, which for disk DBs means writing all of it out, so
+// long lists are slow to change there.
+func (db *DB) Push(key string, item []byte, front bool) int {
+	v := db.Data.Get(key)
+	if v == nil {
+		v = db.NewTypedValue(key, TypeList)
+	}
+	op := "rpush"
+	if front {
+		op = "lpush"
+		v.pushFront(item)
+	} else {
+		v.List = append(v.List, item)
+	}
+	v.Modified = time.Now().UTC()
+	db.Data.Put(key, v)
+	db.Notify(&WatchEvent{Op: op, Key: key, Value: item})
+
+	if ch := db.pushed[key]; ch != nil {
+		close(ch)
+		delete(db.pushed, key)
+	}
+	return len(v.List)
+}
+
+// Pop removes an item from the front (left) or back of the list in key.
+// Returns false if there's nothing there. Empty lists are deleted. Must be
+// called with db.mutex held. Like Push, the whole list is Put back.
+func (db *DB) Pop(key string, front bool) ([]byte, bool) {
+	v := db.Data.Get(key)
+	if v == nil || v.Type != TypeList || len(v.List) == 0 {
+		return nil, false
+	}
+	var item []byte
+	op := "rpop"
+	if front {
+		op = "lpop"
+		item, v.List = v.List[0], v.List[1:]
+	} else {
+		item, v.List = v.List[len(v.List)-1], v.List[:len(v.List)-1]
+	}
+	v.Modified = time.Now().UTC()
+	db.Notify(&WatchEvent{Op: op, Key: key, Value: item})
+	if len(v.List) == 0 {
+		db.Data.Delete(key)
+	} else {
+		db.Data.Put(key, v)
+	}
+	return item, true
+}
+
+// listRange converts LRANGE style start/stop (inclusive, negative counts
+// from the end) into slice indexes
+func listRange(length, start, stop int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	return strconv.Atoi(str)
+}
+
+// DBListGetHandler returns a range of items of a list as a JSON array
+// (items are base64 encoded):
+//
+//	GET /db/{dbID}/{key}/_list?start=0&stop=-1
+//
+// start and stop are inclusive and can be negative to count from the end.
+// The length of the whole list is in the X-Length header.
+func (s *Server) DBListGetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	start, err1 := intParam(r, "start", 0)
+	stop, err2 := intParam(r, "stop", -1)
+	if err1 != nil || err2 != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid 'start' or 'stop' query parameter\n")
+		return
+	}
+
+	key := vars["key"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeList) {
+		db.mutex.Unlock()
+		return
+	}
+	items := [][]byte{}
+	if v != nil {
+		from, to := listRange(len(v.List), start, stop)
+		items = append(items, v.List[from:to]...)
+		w.Header().Set(LengthHeader, strconv.Itoa(len(v.List)))
+	} else {
+		w.Header().Set(LengthHeader, "0")
+	}
+	db.mutex.Unlock()
+
+	WriteJSON(w, items)
+}
+
+// DBListOpHandler changes a list:
+//
+//	POST /db/{dbID}/{key}/_list?op=lpush   body is the item to add
+//	POST /db/{dbID}/{key}/_list?op=rpush
+//	POST /db/{dbID}/{key}/_list?op=lpop&timeout=10s
+//	POST /db/{dbID}/{key}/_list?op=rpop
+//
+// Pushes return the new length of the list. Pops return the item, or 204
+// if the list is empty. If a timeout is given a pop will wait that long
+// for an item to show up.
+func (s *Server) DBListOpHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	key := vars["key"]
+	op := r.URL.Query().Get("op")
+	switch op {
+	case "lpush", "rpush":
+		item, err := s.ReadValue(w, r)
+		if err != nil {
+			WriteReadError(w, err)
+			return
+		}
+		db.mutex.Lock()
+		if !CheckType(w, key, db.Data.Get(key), TypeList) {
+			db.mutex.Unlock()
+			return
+		}
+		need := db.addNeed(key, int64(24+len(item)))
+		if !s.MakeRoom(w, db, key, need) {
+			db.mutex.Unlock()
+			return
+		}
+		length := db.Push(key, item, op == "lpush")
+		db.mutex.Unlock()
+		s.Debug(3, "DB %s: %s onto %q, length %d\n", db.ID, op, key,
+			length)
+		w.Header().Set(LengthHeader, strconv.Itoa(length))
+		fmt.Fprintf(w, "%d", length)
+
+	case "lpop", "rpop":
+		timeout := time.Duration(0)
+		if str := r.URL.Query().Get("timeout"); str != "" {
+			var err error
+			if timeout, err = time.ParseDuration(str); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Invalid 'timeout' query parameter: %q\n",
+					str)
+				return
+			}
+			if timeout > MaxPopTimeout {
+				timeout = MaxPopTimeout
+			}
+			// Don't let the server's WriteTimeout cut us off
+			http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+		s.pop(w, r, db, key, op == "lpop", timeout)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown op %q\n", op)
+	}
+}
+
+// pop waits up to timeout for an item to show up in the list
+func (s *Server) pop(w http.ResponseWriter, r *http.Request, db *DB, key string, front bool, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		db.mutex.Lock()
+		if !CheckType(w, key, db.Data.Get(key), TypeList) {
+			db.mutex.Unlock()
+			return
+		}
+		item, ok := db.Pop(key, front)
+		var signal chan struct{}
+		if !ok && timeout > 0 {
+			signal = db.pushSignal(key)
+		}
+		db.mutex.Unlock()
+
+		if ok {
+			s.Debug(3, "DB %s: Popped from %q\n", db.ID, key)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(item)
+			return
+		}
+		if signal == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		select {
+		case <-signal:
+			// Someone else might get it first, so loop around and check
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.Done():
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/* Memory Stuff */
+/****************/
+
+// Each DB's Store is wrapped in a trackedStore that keeps an estimate of
+// how much memory each key uses, and when and how often it's been used.
+// Before anything is added to a DB, MakeRoom checks that it fits in the
+// DB's budget (Config.MaxDBMemory) and the server's (Config.MaxMemory). If
+// it doesn't then, depending on Config.EvictionPolicy, keys are evicted
+// from that DB until it does, or the write fails with a 507. Like
+// Redis, the key to evict is picked from a small random sample rather
+// than by keeping every key sorted.
+//
+// Only the DB being written to is evicted from, so a server wide budget
+// can make writes to a DB fail while other DBs hold most of the data.
+
+// Eviction policies
+const (
+	EvictNone = "noeviction"   // Writes fail once over budget
+	EvictLRU  = "allkeys-lru"  // Least recently used keys go first
+	EvictTTL  = "volatile-ttl" // Keys closest to expiring go first
+	EvictLFU  = "lfu"          // Least frequently used keys go first
+)
+
+var EvictionPolicies = []string{EvictNone, EvictLRU, EvictTTL, EvictLFU}
+
+// How many keys are looked at to pick the one to evict
+var EvictionSamples = 5
+
+// TTLHeader on a PUT sets how long, in seconds, until the key expires.
+// Expired keys are removed the next time they're looked at, or when room
+// is needed. GETs return when the key expires in ExpiresHeader.
+const (
+	TTLHeader     = "X-TTL"
+	ExpiresHeader = "X-Expires"
+)
+
+// keyOverhead is roughly what the Store and trackedStore use per key, on
+// top of the key and value themselves
+const keyOverhead = 128
+
+// lfuHalfLife is how many accesses, of any key, it takes for the hit count
+// of a key that isn't being used to halve. Otherwise keys that were
+// popular once would never be evicted.
+const lfuHalfLife = 1000
+
+// ValueSize returns an estimate of the memory used by v
+func ValueSize(v *Value) int64 {
+	size := int64(96 + len(v.Data) + len(v.ContentType))
+	for k, m := range v.Meta {
+		size += int64(32 + len(k) + len(m))
+	}
+	for _, item := range v.List {
+		size += int64(24 + len(item))
+	}
+	for f, val := range v.Hash {
+		size += int64(48 + len(f) + len(val))
+	}
+	for m := range v.Set {
+		size += int64(24 + len(m))
+	}
+	if v.ZSet != nil {
+		for _, item := range v.ZSet.items {
+			// Once in items and once in scores
+			size += int64(72 + 2*len(item.Member))
+		}
+	}
+	return size
+}
+
+// historySize returns an estimate of the memory used by a key's history
+func historySize(h []*Value) int64 {
+	size := int64(0)
+	for _, v := range h {
+		size += ValueSize(v)
+	}
+	return size
+}
+
+type keyStats struct {
+	size    int64
+	used    uint64 // trackedStore.clock as of the last access
+	hits    uint32 // Only valid as of used, see freq
+	expires time.Time
+}
+
+// freq is the key's hit count, decayed to what it'd be at clock
+func (ks *keyStats) freq(clock uint64) uint32 {
+	shift := (clock - ks.used) / lfuHalfLife
+	if shift >= 32 {
+		return 0
+	}
+	return ks.hits >> shift
+}
+
+func (ks *keyStats) expired(now time.Time) bool {
+	return !ks.expires.IsZero() && !now.Before(ks.expires)
+}
+
+// trackedStore wraps a DB's Store to keep track of the memory used by, and
+// the use of, each key. Expired keys look like they're not there.
+type trackedStore struct {
+	Store
+	keys     map[string]*keyStats
+	volatile map[string]*keyStats // Just the keys that can expire
+	used     int64                // Bytes used by the keys and values
+	clock    uint64               // Bumped on each access, for LRU/LFU
+	values   bool                 // False if values aren't kept in memory
+
+	onChange func(delta int64)
+	onExpire func(key string)
+	onWrite  func(key string, v *Value) // v is nil for a delete
+}
+
+// newTrackedStore builds the stats for all of the keys already in store
+func newTrackedStore(store Store, values bool) *trackedStore {
+	t := &trackedStore{
+		Store:    store,
+		keys:     map[string]*keyStats{},
+		volatile: map[string]*keyStats{},
+		values:   values,
+	}
+	store.Range("", "", func(key string, v *Value) bool {
+		t.track(key, v)
+		return true
+	})
+	return t
+}
+
+// track updates the stats for key after v was put there
+func (t *trackedStore) track(key string, v *Value) {
+	size := int64(len(key) + keyOverhead)
+	if t.values {
+		size += ValueSize(v)
+	}
+
+	ks := t.keys[key]
+	if ks == nil {
+		ks = &keyStats{}
+		t.keys[key] = ks
+	}
+	t.change(size - ks.size)
+	ks.size = size
+	t.touch(ks)
+
+	ks.expires = v.Expires
+	if ks.expires.IsZero() {
+		delete(t.volatile, key)
+	} else {
+		t.volatile[key] = ks
+	}
+}
+
+func (t *trackedStore) untrack(key string) {
+	if ks := t.keys[key]; ks != nil {
+		t.change(-ks.size)
+		delete(t.keys, key)
+		delete(t.volatile, key)
+	}
+}
+
+func (t *trackedStore) change(delta int64) {
+	t.used += delta
+	if t.onChange != nil {
+		t.onChange(delta)
+	}
+}
+
+func (t *trackedStore) touch(ks *keyStats) {
+	t.clock++
+	if hits := ks.freq(t.clock); hits < ^uint32(0) {
+		ks.hits = hits + 1
+	}
+	ks.used = t.clock
+}
+
+// expire removes key, which has expired
+func (t *trackedStore) expire(key string) {
+	t.Store.Delete(key)
+	t.untrack(key)
+	t.wrote(key, nil)
+	if t.onExpire != nil {
+		t.onExpire(key)
+	}
+}
+
+func (t *trackedStore) Get(key string) *Value {
+	v := t.Store.Get(key)
+	if v == nil {
+		return nil
+	}
+	if ks := t.keys[key]; ks != nil {
+		if ks.expired(time.Now()) {
+			t.expire(key)
+			return nil
+		}
+		t.touch(ks)
+	}
+	return v
+}
+
+func (t *trackedStore) Put(key string, v *Value) {
+	t.Store.Put(key, v)
+	t.track(key, v)
+	t.wrote(key, v)
+}
+
+func (t *trackedStore) Delete(key string) bool {
+	t.untrack(key)
+	if !t.Store.Delete(key) {
+		return false
+	}
+	t.wrote(key, nil)
+	return true
+}
+
+func (t *trackedStore) wrote(key string, v *Value) {
+	if t.onWrite != nil {
+		t.onWrite(key, v)
+	}
+}
+
+// Range skips expired keys but doesn't remove them, since that would
+// change the Store while it's being walked. Scans don't count as use.
+func (t *trackedStore) Range(start, end string, fn func(string, *Value) bool) {
+	now := time.Now()
+	t.Store.Range(start, end, func(key string, v *Value) bool {
+		if ks := t.keys[key]; ks != nil && ks.expired(now) {
+			return true
+		}
+		return fn(key, v)
+	})
+}
+
+// expiredKey returns an expired key, other than skip, from a sample of the
+// ones that can expire, or ""
+func (t *trackedStore) expiredKey(skip string) string {
+	now, n := time.Now(), 0
+	for key, ks := range t.volatile {
+		if key == skip {
+			continue
+		}
+		if ks.expired(now) {
+			return key
+		}
+		if n++; n >= EvictionSamples {
+			break
+		}
+	}
+	return ""
+}
+
+// victim picks the key to evict, other than skip, per policy, from a
+// sample of the keys. Map iteration order is random enough for this. ""
+// means there isn't one.
+func (t *trackedStore) victim(policy, skip string) string {
+	keys := t.keys
+	switch policy {
+	case EvictLRU, EvictLFU:
+	case EvictTTL:
+		keys = t.volatile
+	default:
+		return ""
+	}
+
+	best, n := "", 0
+	var bestStats *keyStats
+	for key, ks := range keys {
+		if key == skip {
+			continue
+		}
+		if bestStats == nil || t.worse(policy, ks, bestStats) {
+			best, bestStats = key, ks
+		}
+		if n++; n >= EvictionSamples {
+			break
+		}
+	}
+	return best
+}
+
+// orphanHistory picks a key, other than skip, that has history but no
+// value, if policy allows any key to be evicted. "" means there isn't one.
+// Must be called with db.mutex held.
+func (db *DB) orphanHistory(policy, skip string) string {
+	if policy != EvictLRU && policy != EvictLFU {
+		return ""
+	}
+	t := db.tracked()
+	for key := range db.History {
+		if key != skip && t.keys[key] == nil {
+			return key
+		}
+	}
+	return ""
+}
+
+// worse is true if a should be evicted before b
+func (t *trackedStore) worse(policy string, a, b *keyStats) bool {
+	switch policy {
+	case EvictTTL:
+		return a.expires.Before(b.expires)
+	case EvictLFU:
+		if fa, fb := a.freq(t.clock), b.freq(t.clock); fa != fb {
+			return fa < fb
+		}
+	}
+	return a.used < b.used
+}
+
+// trackDB wraps db's Store so its memory use is tracked, and counted in
+// the server's total
+func (s *Server) trackDB(db *DB) {
+	t := newTrackedStore(db.Data, db.Storage == StorageMemory)
+	db.memChanged = func(delta int64) {
+		atomic.AddInt64(&s.memUsed, delta)
+	}
+	t.onChange = db.memChanged
+	t.onExpire = func(key string) {
+		db.expired++
+		atomic.AddInt64(&s.expiredKeys, 1)
+		db.Notify(&WatchEvent{Op: "expire", Key: key})
+	}
+	t.onWrite = func(key string, v *Value) {
+		s.replicateKey(db, key, v)
+	}
+	db.historyChanged = func(key string, h []*Value) {
+		s.replicateHistory(db, key, h)
+	}
+	db.Data = t
+	db.historyUsed = 0
+	for _, h := range db.History {
+		db.historyUsed += historySize(h)
+	}
+	atomic.AddInt64(&s.memUsed, t.used+db.historyUsed)
+}
+
+// untrackDB takes db out of the server's total, e.g. when it's deleted.
+// Must be called with db.mutex held.
+func (s *Server) untrackDB(db *DB) {
+	atomic.AddInt64(&s.memUsed, -db.MemoryUsed())
+}
+
+func (db *DB) tracked() *trackedStore {
+	t, _ := db.Data.(*trackedStore)
+	return t
+}
+
+// MemoryUsed returns an estimate of the memory used by db's keys, values
+// and history. Must be called with db.mutex held.
+func (db *DB) MemoryUsed() int64 {
+	used := db.historyUsed
+	if t := db.tracked(); t != nil {
+		used += t.used
+	}
+	return used
+}
+
+// setHistory replaces the history of key, keeping track of its size.
+// Must be called with db.mutex held.
+func (db *DB) setHistory(key string, h []*Value) {
+	delta := historySize(h) - historySize(db.History[key])
+	if len(h) == 0 {
+		delete(db.History, key)
+	} else {
+		if db.History == nil {
+			db.History = map[string][]*Value{}
+		}
+		db.History[key] = h
+	}
+	db.historyUsed += delta
+	if db.memChanged != nil {
+		db.memChanged(delta)
+	}
+	if db.historyChanged != nil {
+		db.historyChanged(key, h)
+	}
+}
+
+// overBudget is true if db, or the server, would be using more memory
+// than it should once need more bytes are added. Must be called with
+// db.mutex held.
+func (s *Server) overBudget(db *DB, need int64) bool {
+	if max := s.config.MaxDBMemory; max > 0 && db.MemoryUsed()+need > max {
+		return true
+	}
+	max := s.config.MaxMemory
+	return max > 0 && atomic.LoadInt64(&s.memUsed)+need > max
+}
+
+// tooBig is true if need bytes wouldn't fit even in an empty DB
+func (s *Server) tooBig(need int64) bool {
+	return (s.config.MaxDBMemory > 0 && need > s.config.MaxDBMemory) ||
+		(s.config.MaxMemory > 0 && need > s.config.MaxMemory)
+}
+
+// setNeed estimates how much more memory db will use once key is set to
+// v. The old value is only freed if there's no history for it to move to
+// (typed values don't have history, but they're counted as if they did).
+// Must be called with db.mutex held.
+func (db *DB) setNeed(key string, v *Value, maxVersions int) int64 {
+	t := db.tracked()
+	if t == nil {
+		return 0
+	}
+	need := int64(0)
+	if t.values {
+		need = ValueSize(v)
+	}
+	ks := t.keys[key]
+	if ks == nil {
+		return need + int64(len(key)+keyOverhead)
+	}
+	if maxVersions <= 0 {
+		need -= ks.size - int64(len(key)+keyOverhead)
+	}
+	return need
+}
+
+// removeNeed estimates how much less memory db will use once key is
+// removed. Nothing's freed if its value moves to the key's history. Must
+// be called with db.mutex held.
+func (db *DB) removeNeed(key string, maxVersions int) int64 {
+	t := db.tracked()
+	if t == nil || t.keys[key] == nil || maxVersions > 0 {
+		return 0
+	}
+	return t.keys[key].size
+}
+
+// addNeed estimates how much more memory db will use once something of
+// size bytes (per ValueSize) is added to the list, hash, set or sorted set
+// in key. Must be called with db.mutex held.
+func (db *DB) addNeed(key string, size int64) int64 {
+	t := db.tracked()
+	if t == nil {
+		return 0
+	}
+	need := int64(0)
+	if t.values {
+		need = size
+	}
+	if t.keys[key] == nil {
+		need += db.setNeed(key, &Value{}, 0)
+	}
+	return need
+}
+
+// MakeRoom must be called, with db.mutex held, before anything is added to
+// key in db. need, from setNeed or addNeed, is how much more memory db
+// will use. If that would put db or the server over budget then expired
+// keys are removed, and others are evicted per Config.EvictionPolicy,
+// until it won't. key itself is left alone. If that's not possible a 507
+// is sent back and false is returned.
+func (s *Server) MakeRoom(w http.ResponseWriter, db *DB, key string,
+	need int64) bool {
+
+	if s.makeRoom(db, key, need) {
+		return true
+	}
+	w.WriteHeader(http.StatusInsufficientStorage)
+	fmt.Fprintf(w, "Out of memory, can't add to DB %s\n", db.ID)
+	return false
+}
+
+// makeRoom is MakeRoom w/o the response
+func (s *Server) makeRoom(db *DB, key string, need int64) bool {
+	// Don't evict everything just to find out it won't fit anyway
+	if s.tooBig(need) {
+		return false
+	}
+	t := db.tracked()
+	policy := s.config.EvictionPolicy
+	for t != nil && s.overBudget(db, need) {
+		if key := t.expiredKey(key); key != "" {
+			t.expire(key)
+			continue
+		}
+		if key := t.victim(policy, key); key != "" {
+			db.Data.Delete(key)
+			db.setHistory(key, nil)
+			db.evicted++
+			atomic.AddInt64(&s.evictedKeys, 1)
+			db.Notify(&WatchEvent{Op: "evict", Key: key})
+			s.Debug(3, "DB %s: Evicted %q\n", db.ID, key)
+			continue
+		}
+		// Deleted keys can still have history taking up room
+		if key := db.orphanHistory(policy, key); key != "" {
+			db.setHistory(key, nil)
+			s.Debug(3, "DB %s: Evicted the history of %q\n", db.ID, key)
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// maxTTL keeps TTLs from overflowing a time.Duration
+const maxTTL = 100 * 365 * 24 * time.Hour
+
+// parseTTL returns when a value set with the TTLHeader in header should
+// expire. A zero time means it doesn't.
+func parseTTL(header http.Header) (time.Time, error) {
+	str := header.Get(TTLHeader)
+	if str == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseFloat(str, 64)
+	if err != nil || !(secs > 0) || secs > maxTTL.Seconds() {
+		return time.Time{}, fmt.Errorf("Invalid %s header: %q", TTLHeader,
+			str)
+	}
+	return time.Now().UTC().Add(time.Duration(secs * float64(time.Second))),
+		nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+/* Metrics Stuff */
+/*****************/
+
+// MetricsHandler returns the server's metrics in the Prometheus text
+// format. Like /info it doesn't need any auth.
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help,
+			name, kind, name, value)
+	}
+	metric("osbdb_memory_used_bytes", "gauge",
+		"Estimated memory used by all DBs.", atomic.LoadInt64(&s.memUsed))
+	metric("osbdb_memory_limit_bytes", "gauge",
+		"Memory budget for all DBs, 0 means none.", s.config.MaxMemory)
+	metric("osbdb_evicted_keys_total", "counter",
+		"Keys evicted to stay within a memory budget.",
+		atomic.LoadInt64(&s.evictedKeys))
+	metric("osbdb_expired_keys_total", "counter",
+		"Keys removed since their TTL ran out.",
+		atomic.LoadInt64(&s.expiredKeys))
+	repl := s.ReplicationStatus()
+	metric("osbdb_replication_followers", "gauge",
+		"Followers streaming the change log.", int64(repl.Followers))
+	metric("osbdb_replication_seq", "gauge",
+		"Sequence number of the last change sent, or applied if a follower.",
+		int64(repl.Seq))
+
+	s.dbMapMutex.Lock()
+	dbs := make([]*DB, 0, len(s.DBs))
+	for _, db := range s.DBs {
+		dbs = append(dbs, db)
+	}
+	s.dbMapMutex.Unlock()
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].ID < dbs[j].ID })
+	metric("osbdb_dbs", "gauge", "Number of DBs.", int64(len(dbs)))
+
+	type dbStats struct{ keys, used, evicted, expired int64 }
+	stats := make([]dbStats, len(dbs))
+	for i, db := range dbs {
+		db.mutex.Lock()
+		stats[i] = dbStats{int64(db.Data.Len()), db.MemoryUsed(),
+			db.evicted, db.expired}
+		db.mutex.Unlock()
+	}
+
+	dbMetric := func(name, kind, help string, value func(dbStats) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name,
+			kind)
+		for i, db := range dbs {
+			fmt.Fprintf(w, "%s{db=%q} %d\n", name, db.ID, value(stats[i]))
+		}
+	}
+	dbMetric("osbdb_db_keys", "gauge", "Number of keys in the DB.",
+		func(st dbStats) int64 { return st.keys })
+	dbMetric("osbdb_db_memory_used_bytes", "gauge",
+		"Estimated memory used by the DB.",
+		func(st dbStats) int64 { return st.used })
+	dbMetric("osbdb_db_evicted_keys_total", "counter",
+		"Keys evicted from the DB to stay within a memory budget.",
+		func(st dbStats) int64 { return st.evicted })
+	dbMetric("osbdb_db_expired_keys_total", "counter",
+		"Keys removed from the DB since their TTL ran out.",
+		func(st dbStats) int64 { return st.expired })
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* OSB API Version/Identity Stuff */
+/**********************************/
+
+type APIVersion struct {
+	Major int
+	Minor int
+}
+
+func (v APIVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+func (v APIVersion) AtLeast(o APIVersion) bool {
+	return v.Major > o.Major || (v.Major == o.Major && v.Minor >= o.Minor)
+}
+
+// Range of X-Broker-API-Version values we'll talk to. Anything newer than
+// MaxAPIVersion (but still 2.x) is accepted but treated as MaxAPIVersion.
+var MinAPIVersion = APIVersion{2, 11}
+var MaxAPIVersion = APIVersion{2, 15}
+
+// Features that only exist in newer versions of the OSB API
+var Features = map[string]APIVersion{
+	"fetch":            APIVersion{2, 14},
+	"maintenance_info": APIVersion{2, 15},
+}
+
+func ParseAPIVersion(str string) (APIVersion, error) {
+	v := APIVersion{}
+	parts := strings.Split(strings.TrimSpace(str), ".")
+	if len(parts) != 2 {
+		return v, fmt.Errorf("Malformed version %q", str)
+	}
+	var err error
+	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("Malformed version %q", str)
+	}
+	if v.Minor, err = strconv.Atoi(parts[1]); err != nil {
+		return v, fmt.Errorf("Malformed version %q", str)
+	}
+	return v, nil
+}
+
+// OriginatingIdentity is the decoded X-Broker-API-Originating-Identity
+// header. Value is the platform specific JSON object, e.g. "user_id" for
+// cloudfoundry or "username"/"uid"/"groups" for kubernetes.
+type OriginatingIdentity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value"`
+}
+
+// User returns the most useful identifier of the user for logging
+func (oi *OriginatingIdentity) User() string {
+	for _, k := range []string{"user_id", "username", "uid"} {
+		if v, ok := oi.Value[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return "?"
+}
+
+func (oi *OriginatingIdentity) String() string {
+	return oi.Platform + "/" + oi.User()
+}
+
+func ParseOriginatingIdentity(str string) (*OriginatingIdentity, error) {
+	parts := strings.Fields(str)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Malformed originating identity %q", str)
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Can't decode originating identity: %s", err)
+	}
+
+	oi := &OriginatingIdentity{Platform: parts[0]}
+	if err = json.Unmarshal(buf, &oi.Value); err != nil {
+		return nil, fmt.Errorf("Can't parse originating identity: %s", err)
+	}
+	return oi, nil
+}
+
+type contextKey string
+
+const apiVersionKey = contextKey("apiVersion")
+const identityKey = contextKey("identity")
+
+// GetAPIVersion returns the negotiated OSB API version for the request
+func GetAPIVersion(r *http.Request) APIVersion {
+	if v, ok := r.Context().Value(apiVersionKey).(APIVersion); ok {
+		return v
+	}
+	return MaxAPIVersion
+}
+
+// GetIdentity returns the originating identity for the request, or nil
+func GetIdentity(r *http.Request) *OriginatingIdentity {
+	oi, _ := r.Context().Value(identityKey).(*OriginatingIdentity)
+	return oi
+}
+
+func FeatureEnabled(r *http.Request, feature string) bool {
+	v, ok := Features[feature]
+	return ok && GetAPIVersion(r).AtLeast(v)
+}
+
+// IdentityString is for use in log messages
+func IdentityString(r *http.Request) string {
+	if oi := GetIdentity(r); oi != nil {
+		return " (by " + oi.String() + ")"
+	}
+	return ""
+}
+
+// BrokerAuthMiddleware rejects OSB API requests that fail VerifyBrokerAuth
+// before anything else looks at them, so a client without credentials gets
+// a 401 rather than e.g. a 412 for a bad version.
+func (s *Server) BrokerAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.VerifyBrokerAuth(w, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OSBMiddleware verifies the X-Broker-API-Version header of all OSB API
+// requests and saves the negotiated version and originating identity in
+// the request's context.
+func OSBMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		str := r.Header.Get("X-Broker-API-Version")
+		if str == "" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			WriteOSBError(w, "Missing X-Broker-API-Version header", "")
+			return
+		}
+
+		v, err := ParseAPIVersion(str)
+		if err != nil || v.Major != MaxAPIVersion.Major ||
+			!v.AtLeast(MinAPIVersion) {
+
+			w.WriteHeader(http.StatusPreconditionFailed)
+			WriteOSBError(w, fmt.Sprintf("Unsupported API version %q", str),
+				fmt.Sprintf("Supported versions are %s through %s",
+					MinAPIVersion, MaxAPIVersion))
+			return
+		}
+		if v.AtLeast(MaxAPIVersion) {
+			v = MaxAPIVersion
+		}
+
+		ctx := context.WithValue(r.Context(), apiVersionKey, v)
+
+		if str = r.Header.Get("X-Broker-API-Originating-Identity"); str != "" {
+			oi, err := ParseOriginatingIdentity(str)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				WriteOSBError(w, err.Error(), "")
+				return
+			}
+			ctx = context.WithValue(ctx, identityKey, oi)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Counter Stuff */
+/*****************/
+
+// Counters are just values that hold a decimal integer. These ops are done
+// under the DB lock so concurrent clients don't lose updates.
+
+// numOp applies op to cur. ok is false if the result doesn't fit in an
+// int64.
+func numOp(op string, cur, n int64) (result int64, ok bool) {
+	switch op {
+	case "incr":
+		if (n > 0 && cur > math.MaxInt64-n) ||
+			(n < 0 && cur < math.MinInt64-n) {
+			return 0, false
+		}
+		return cur + n, true
+	case "decr":
+		if n == math.MinInt64 {
+			return 0, false
+		}
+		return numOp("incr", cur, -n)
+	case "min":
+		if n < cur {
+			return n, true
+		}
+		return cur, true
+	case "max":
+		if n > cur {
+			return n, true
+		}
+		return cur, true
+	}
+	return 0, false
+}
+
+// DBOpHandler does an atomic numeric op on a key:
+//
+//	POST /db/{dbID}/{key}?op=incr&by=N   (by defaults to 1)
+//	POST /db/{dbID}/{key}?op=decr&by=N
+//	POST /db/{dbID}/{key}?op=min&value=N (only if N is smaller)
+//	POST /db/{dbID}/{key}?op=max&value=N (only if N is bigger)
+//
+// Missing keys start at 0, or for min/max are just set to N. The new value
+// is returned in the body.
+func (s *Server) DBOpHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	key := vars["key"]
+	query := r.URL.Query()
+	op := query.Get("op")
+	param, def := "by", "1"
+	switch op {
+	case "incr", "decr":
+	case "min", "max":
+		param, def = "value", ""
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown op %q\n", op)
+		return
+	}
+
+	str := query.Get(param)
+	if str == "" {
+		str = def
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid %q query parameter: %q\n", param, str)
+		return
+	}
+
+	db.mutex.Lock()
+	old := db.Data.Get(key)
+	if !CheckType(w, key, old, TypeString) {
+		db.mutex.Unlock()
+		return
+	}
+	cur := int64(0)
+	if old != nil {
+		cur, err = strconv.ParseInt(strings.TrimSpace(string(old.Data)), 10,
+			64)
+		if err != nil {
+			db.mutex.Unlock()
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Value of %q isn't an integer\n", key)
+			return
+		}
+	} else if op == "min" || op == "max" {
+		cur = n
+	}
+
+	result, ok := numOp(op, cur, n)
+	if !ok {
+		db.mutex.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Result of %s is out of range\n", op)
+		return
+	}
+
+	v := old
+	if old == nil || result != cur {
+		v = &Value{
+			Data: []byte(strconv.FormatInt(result, 10)),
+			ValueMeta: ValueMeta{
+				ContentType: "text/plain; charset=utf-8",
+				Modified:    time.Now().UTC(),
+			},
+		}
+		if old != nil {
+			v.ContentType = old.ContentType
+			v.Meta = old.Meta
+			v.Expires = old.Expires
+		}
+		need := db.setNeed(key, v, s.config.MaxVersions)
+		if !s.MakeRoom(w, db, key, need) {
+			db.mutex.Unlock()
+			return
+		}
+		db.SetValue(key, v, s.config.MaxVersions)
+	}
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: %s %q by %d, now %d\n", db.ID, op, key, n, result)
+	w.Header().Set(VersionHeader, strconv.Itoa(v.Version))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d", result)
+}
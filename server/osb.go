@@ -0,0 +1,809 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+/* OSB APIs */
+/************/
+
+type Instance struct {
+	DB       *DB
+	Request  ProvisionRequest
+	Bindings map[string]interface{} // BindingID -> *BindRequest
+}
+
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+type Service struct {
+	Name            string                 `json:"name"`
+	ID              string                 `json:"id"`
+	Description     string                 `json:"description"`
+	Tags            []string               `json:"tags,omitempty"`
+	Requires        []string               `json:"requires,omitempty"`
+	Bindable        bool                   `json:"bindable"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	DashboardClient interface{}            `json:"dashboard_client,omitempty"`
+	PlanUpdateable  bool                   `json:"plan_updateable,omitempty"`
+	Plans           []Plan                 `json:"plans"`
+}
+
+type Plan struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Free        bool                   `json:"free,omitempty"`
+	Bindable    bool                   `json:"bindable,omitempty"`
+	Schemas     interface{}            `json:"schemas,omitempty"`
+
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+
+	// Where the DBs of this plan keep their data, e.g. StorageDisk. Disk
+	// needs Config.DataDir to be set.
+	Storage string `json:"-"`
+}
+
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// DefaultCatalog is used when Config.Catalog isn't set. Its durable plan
+// is left out unless Config.DataDir is set.
+var DefaultCatalog = Catalog{
+	Services: []Service{
+		Service{
+			Name:        "demodb",
+			ID:          "service-1-id",
+			Description: "Key/value DB for demos",
+			Bindable:    true,
+			Plans: []Plan{
+				Plan{
+					ID:          "plan-1-id",
+					Name:        "free",
+					Description: "Totally free usage",
+					MaintenanceInfo: &MaintenanceInfo{
+						Version: "1.0.0",
+					},
+				},
+				Plan{
+					ID:          "plan-2-id",
+					Name:        "paid",
+					Description: "You can't afford me ",
+					Free:        false,
+					MaintenanceInfo: &MaintenanceInfo{
+						Version: "1.0.0",
+					},
+				},
+				Plan{
+					ID:          "plan-3-id",
+					Name:        "durable",
+					Description: "Data is kept on disk",
+					Free:        false,
+					MaintenanceInfo: &MaintenanceInfo{
+						Version: "1.0.0",
+					},
+					Storage: StorageDisk,
+				},
+			},
+		},
+	},
+}
+
+// defaultCatalog returns DefaultCatalog, without its disk plans if there's
+// nowhere to keep them
+func defaultCatalog(disk bool) *Catalog {
+	if disk {
+		return &DefaultCatalog
+	}
+	catalog := &Catalog{}
+	for _, service := range DefaultCatalog.Services {
+		plans := []Plan{}
+		for _, plan := range service.Plans {
+			if plan.Storage != StorageDisk {
+				plans = append(plans, plan)
+			}
+		}
+		service.Plans = plans
+		catalog.Services = append(catalog.Services, service)
+	}
+	return catalog
+}
+
+func WriteOSBError(w http.ResponseWriter, err, description string) {
+	OSBError := struct {
+		Error       string `json:"error"`
+		Description string `json:"description,omitempty"`
+	}{
+		Error:       err,
+		Description: description,
+	}
+	WriteJSON(w, OSBError)
+}
+
+func (s *Server) CatalogHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if FeatureEnabled(r, "maintenance_info") {
+		WriteJSON(w, s.Catalog)
+		return
+	}
+
+	// Older clients don't know about maintenance_info so strip it
+	tmpCatalog := Catalog{}
+	for _, service := range s.Catalog.Services {
+		plans := []Plan{}
+		for _, plan := range service.Plans {
+			plan.MaintenanceInfo = nil
+			plans = append(plans, plan)
+		}
+		service.Plans = plans
+		tmpCatalog.Services = append(tmpCatalog.Services, service)
+	}
+	WriteJSON(w, tmpCatalog)
+}
+
+type Context map[string]interface{}
+
+type ProvisionRequest struct {
+	ServiceID  string            `json:"service_id"`
+	PlanID     string            `json:"plan_id"`
+	Content    Context           `json:"context,omitempty"`
+	OrgID      string            `json:"organization_guid"`
+	SpaceID    string            `json:"space_guid"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+type ProvisonResponse struct {
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+}
+
+func (s *Server) ProvisionHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	instanceID := vars["iID"]
+	if instanceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing InstanceID", "")
+		return
+	}
+
+	pReq := ProvisionRequest{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &pReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, err.Error(), "")
+		return
+	}
+
+	if pReq.ServiceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing service_id", "")
+		return
+	}
+
+	if pReq.PlanID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing plan_id", "")
+		return
+	}
+
+	var foundPlan *Plan
+	for _, service := range s.Catalog.Services {
+		if service.ID == pReq.ServiceID {
+			for i, plan := range service.Plans {
+				if plan.ID == pReq.PlanID {
+					foundPlan = &service.Plans[i]
+					break
+				}
+			}
+			break
+		}
+	}
+	if foundPlan == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, fmt.Sprintf("Can't find service/plan %s/%s",
+			pReq.ServiceID, pReq.PlanID), "")
+		return
+	}
+	if foundPlan.Storage == StorageDisk && s.config.DataDir == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, fmt.Sprintf("Plan %s needs the broker to have a "+
+			"data dir", pReq.PlanID), "")
+		return
+	}
+
+	backup := pReq.Parameters[RestoreFromParam]
+	sourceID := pReq.Parameters[CloneFromParam]
+	if backup != "" && sourceID != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, fmt.Sprintf("Can't use both %s and %s",
+			RestoreFromParam, CloneFromParam), "")
+		return
+	}
+	if backup != "" {
+		if err := s.checkBackups(backup); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, err.Error(), "")
+			return
+		}
+	}
+
+	s.instanceMutex.Lock()
+	if i := s.Instances[instanceID]; i != nil {
+		same := reflect.DeepEqual(i.Request.Parameters, pReq.Parameters)
+		s.instanceMutex.Unlock()
+		if same {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("{}"))
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		WriteOSBError(w, fmt.Sprintf("Instance with that ID(%s) already exists",
+			instanceID), "")
+		return
+	}
+	if s.busy[instanceID] > 0 {
+		s.instanceMutex.Unlock()
+		WriteConcurrencyError(w, instanceID)
+		return
+	}
+
+	// Clones have to stay within the org/space of the instance they copy
+	var source *Instance
+	if sourceID != "" {
+		source = s.Instances[sourceID]
+		if source == nil {
+			s.instanceMutex.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, "Can't find instance with id: "+sourceID, "")
+			return
+		}
+		if source.Request.OrgID != pReq.OrgID ||
+			source.Request.SpaceID != pReq.SpaceID {
+
+			s.instanceMutex.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, fmt.Sprintf("Instance %s isn't in the same "+
+				"organization and space", sourceID), "")
+			return
+		}
+	}
+
+	// Reading a backup or copying a DB can take a while so it's done w/o
+	// the lock. Instead the new instance, and the one being cloned, are
+	// marked busy so they can't be changed or deleted until it's done.
+	s.markBusy(instanceID, sourceID)
+	s.instanceMutex.Unlock()
+	defer s.unmarkBusy(instanceID, sourceID)
+
+	// Read the backup first so a bad one doesn't leave a DB behind
+	var recs []*ExportRecord
+	var values []*Value
+	if backup != "" {
+		var err error
+		if recs, values, err = s.readBackup(backup); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, err.Error(), "")
+			return
+		}
+	}
+
+	var db *DB
+	var err error
+	if source != nil {
+		db, err = s.CloneDB(r, source.DB, foundPlan.Storage)
+	} else {
+		db, err = s.NewDBWithStorage(r, foundPlan.Storage)
+	}
+	if err == errOutOfMemory {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		WriteOSBError(w, fmt.Sprintf("Out of memory cloning instance %s",
+			sourceID), "")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteOSBError(w, err.Error(), "")
+		return
+	}
+
+	if recs != nil {
+		if _, ok := s.importValues(db, recs, values, true); !ok {
+			s.DeleteDB(db)
+			w.WriteHeader(http.StatusInsufficientStorage)
+			WriteOSBError(w, fmt.Sprintf("Out of memory restoring backup %q",
+				backup), "")
+			return
+		}
+		s.Debug(2, "Instance %s: restored backup %q\n", instanceID,
+			backup)
+	}
+
+	if source != nil {
+		s.Debug(2, "Instance %s: cloned from instance %s\n", instanceID,
+			sourceID)
+	}
+
+	s.Debug(2, "Instance %s: created%s\n", instanceID, IdentityString(r))
+	s.instanceMutex.Lock()
+	s.Instances[instanceID] = &Instance{
+		DB:       db,
+		Request:  pReq,
+		Bindings: map[string]interface{}{},
+	}
+	s.instanceChanged(instanceID)
+	s.instanceMutex.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("{}"))
+}
+
+// markBusy notes that a provision or update, that isn't holding
+// s.instanceMutex, is using the instances. Must be called with it held.
+func (s *Server) markBusy(ids ...string) {
+	for _, id := range ids {
+		if id != "" {
+			s.busy[id]++
+		}
+	}
+}
+
+func (s *Server) unmarkBusy(ids ...string) {
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if s.busy[id]--; s.busy[id] <= 0 {
+			delete(s.busy, id)
+		}
+	}
+}
+
+// WriteConcurrencyError tells the platform to try again later since
+// another request is still using the instance
+func WriteConcurrencyError(w http.ResponseWriter, instanceID string) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	WriteOSBError(w, "ConcurrencyError", fmt.Sprintf("Instance %s is "+
+		"busy with another request", instanceID))
+}
+
+func (s *Server) FetchInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+
+	if !FeatureEnabled(r, "fetch") {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Fetching instances requires API version "+
+			Features["fetch"].String(), "")
+		return
+	}
+
+	instanceID := mux.Vars(r)["iID"]
+	instance := s.Instances[instanceID]
+	if instance == nil {
+		w.WriteHeader(http.StatusNotFound)
+		WriteOSBError(w, "Can't find instance with id: "+instanceID, "")
+		return
+	}
+
+	WriteJSON(w, struct {
+		ServiceID  string            `json:"service_id"`
+		PlanID     string            `json:"plan_id"`
+		Parameters map[string]string `json:"parameters,omitempty"`
+	}{
+		ServiceID:  instance.Request.ServiceID,
+		PlanID:     instance.Request.PlanID,
+		Parameters: instance.Request.Parameters,
+	})
+}
+
+func (s *Server) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	instanceID := mux.Vars(r)["iID"]
+	pReq := ProvisionRequest{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &pReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, err.Error(), "")
+			return
+		}
+	}
+
+	backup := pReq.Parameters[RestoreFromParam]
+	if backup != "" {
+		if err := s.checkBackups(backup); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, err.Error(), "")
+			return
+		}
+	}
+
+	s.instanceMutex.Lock()
+	instance := s.Instances[instanceID]
+	if instance == nil {
+		s.instanceMutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		WriteOSBError(w, "Can't find instance with id: "+instanceID, "")
+		return
+	}
+
+	// restore_from resets the instance's DB to a backup. Platforms can send
+	// the same parameters on every update, so it's only done if it names a
+	// different backup than last time.
+	last := instance.Request.Parameters[RestoreFromParam]
+	if backup == "" || backup == last {
+		s.instanceMutex.Unlock()
+		w.Write([]byte("{}"))
+		return
+	}
+	if s.busy[instanceID] > 0 {
+		s.instanceMutex.Unlock()
+		WriteConcurrencyError(w, instanceID)
+		return
+	}
+	s.markBusy(instanceID)
+	s.instanceMutex.Unlock()
+	defer s.unmarkBusy(instanceID)
+
+	err := s.RestoreBackup(instance.DB, backup)
+	if err == errOutOfMemory {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		WriteOSBError(w, fmt.Sprintf("Out of memory restoring backup %q",
+			backup), "")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, err.Error(), "")
+		return
+	}
+	s.Debug(2, "Instance %s: restored backup %q%s\n", instanceID, backup,
+		IdentityString(r))
+
+	// Snapshots can still be using the old map so make a new one
+	s.instanceMutex.Lock()
+	params := map[string]string{}
+	for k, v := range instance.Request.Parameters {
+		params[k] = v
+	}
+	params[RestoreFromParam] = backup
+	instance.Request.Parameters = params
+	s.instanceChanged(instanceID)
+	s.instanceMutex.Unlock()
+
+	w.Write([]byte("{}"))
+}
+
+func (s *Server) DeprovisionHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+
+	vars := mux.Vars(r)
+
+	instanceID := vars["iID"]
+	if instanceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing InstanceID", "")
+		return
+	}
+
+	params := r.URL.Query()
+
+	serviceID := ""
+	if params["service_id"] != nil {
+		serviceID = params["service_id"][0]
+	}
+	if serviceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing ServiceID", "")
+		return
+	}
+
+	planID := ""
+	if params["plan_id"] != nil {
+		planID = params["plan_id"][0]
+	}
+	if planID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing PlanID", "")
+		return
+	}
+
+	instance := s.Instances[instanceID]
+	if instance == nil {
+		w.WriteHeader(http.StatusGone)
+		WriteOSBError(w, "Can't find instance with id: "+instanceID, "")
+		return
+	}
+	if s.busy[instanceID] > 0 {
+		WriteConcurrencyError(w, instanceID)
+		return
+	}
+
+	s.DeleteDB(instance.DB)
+	delete(s.Instances, instanceID)
+	s.instanceChanged(instanceID)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+	s.Debug(2, "Instance %s: deleted%s\n", instanceID, IdentityString(r))
+}
+
+type BindRequest struct {
+	ServiceID  string            `json:"service_id"`
+	PlanID     string            `json:"plan_id"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// same is true if b and other would create the same binding
+func (b *BindRequest) same(other *BindRequest) bool {
+	return b.ServiceID == other.ServiceID && b.PlanID == other.PlanID &&
+		reflect.DeepEqual(b.Parameters, other.Parameters)
+}
+
+type BindResponse struct {
+	Credentials struct {
+		User     string `json:"user,omitempty"`
+		Password string `json:"password,omitempty"`
+		URL      string `json:"url,omitempty"`
+	} `json:"credentials"`
+}
+
+// bindingCredentials returns what's sent back for each binding of instance
+func bindingCredentials(instance *Instance) *BindResponse {
+	res := &BindResponse{}
+	res.Credentials.User = instance.DB.User
+	res.Credentials.Password = instance.DB.Password
+	res.Credentials.URL = instance.DB.URL
+	return res
+}
+
+func (s *Server) BindHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+
+	vars := mux.Vars(r)
+
+	instanceID := vars["iID"]
+	if instanceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing InstanceID", "")
+		return
+	}
+
+	bindingID := vars["bID"]
+	if bindingID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing BindingID", "")
+		return
+	}
+
+	instance := s.Instances[instanceID]
+	if instance == nil {
+		w.WriteHeader(http.StatusGone)
+		WriteOSBError(w, "Can't find instance with id: "+instanceID, "")
+		return
+	}
+
+	bReq := &BindRequest{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, bReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteOSBError(w, err.Error(), "")
+			return
+		}
+	}
+
+	// The same bind again just gets the same binding back
+	if binding := instance.Bindings[bindingID]; binding != nil {
+		if old, ok := binding.(*BindRequest); ok && old.same(bReq) {
+			w.WriteHeader(http.StatusOK)
+			WriteJSON(w, bindingCredentials(instance))
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		WriteOSBError(w, fmt.Sprintf("Binding with id %q already exists",
+			bindingID), "")
+		return
+	}
+
+	instance.Bindings[bindingID] = bReq
+	s.instanceChanged(instanceID)
+
+	creds := bindingCredentials(instance)
+	s.Debug(3, "creds: %#q\n", creds)
+
+	w.WriteHeader(http.StatusCreated)
+	WriteJSON(w, creds)
+	s.Debug(2, "Instance %s: Binding %q created%s\n", instanceID, bindingID,
+		IdentityString(r))
+}
+
+func (s *Server) FetchBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+
+	if !FeatureEnabled(r, "fetch") {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Fetching bindings requires API version "+
+			Features["fetch"].String(), "")
+		return
+	}
+
+	vars := mux.Vars(r)
+	instanceID := vars["iID"]
+	bindingID := vars["bID"]
+
+	instance := s.Instances[instanceID]
+	if instance == nil || instance.Bindings[bindingID] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		WriteOSBError(w, "Can't find binding with id: "+bindingID, "")
+		return
+	}
+
+	WriteJSON(w, bindingCredentials(instance))
+}
+
+func (s *Server) UnbindHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+
+	vars := mux.Vars(r)
+
+	instanceID := vars["iID"]
+	if instanceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing InstanceID", "")
+		return
+	}
+
+	bindingID := vars["bID"]
+	if bindingID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing BindingID", "")
+		return
+	}
+
+	params := r.URL.Query()
+
+	serviceID := ""
+	if params["service_id"] != nil {
+		serviceID = params["service_id"][0]
+	}
+	if serviceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing ServiceID", "")
+		return
+	}
+
+	planID := ""
+	if params["plan_id"] != nil {
+		planID = params["plan_id"][0]
+	}
+	if planID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteOSBError(w, "Missing PlanID", "")
+		return
+	}
+
+	instance := s.Instances[instanceID]
+	if instance == nil {
+		w.WriteHeader(http.StatusGone)
+		WriteOSBError(w, "Can't find instance with id: "+instanceID, "")
+		return
+	}
+
+	binding := instance.Bindings[bindingID]
+	if binding == nil {
+		w.WriteHeader(http.StatusGone)
+		WriteOSBError(w, "Can't find binding with id: "+bindingID, "")
+		return
+	}
+
+	delete(instance.Bindings, bindingID)
+	s.instanceChanged(instanceID)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+	s.Debug(2, "Instance %s: Binding %q deleted%s\n", instanceID, bindingID,
+		IdentityString(r))
+}
+
+/* Admin APIs */
+/**************/
+
+type InstanceInfo struct {
+	ID        string            `json:"id"`
+	ServiceID string            `json:"service_id"`
+	PlanID    string            `json:"plan_id"`
+	OrgID     string            `json:"organization_guid,omitempty"`
+	SpaceID   string            `json:"space_guid,omitempty"`
+	Params    map[string]string `json:"parameters,omitempty"`
+	DBURL     string            `json:"db_url"`
+	Bindings  []string          `json:"bindings"`
+}
+
+func (s *Server) InstancesHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+
+	infos := []*InstanceInfo{}
+	for id, instance := range s.Instances {
+		info := &InstanceInfo{
+			ID:        id,
+			ServiceID: instance.Request.ServiceID,
+			PlanID:    instance.Request.PlanID,
+			OrgID:     instance.Request.OrgID,
+			SpaceID:   instance.Request.SpaceID,
+			Params:    instance.Request.Parameters,
+			DBURL:     instance.DB.URL,
+			Bindings:  []string{},
+		}
+		for bID := range instance.Bindings {
+			info.Bindings = append(info.Bindings, bID)
+		}
+		sort.Strings(info.Bindings)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	WriteJSON(w, infos)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Pub/Sub Stuff */
+/*****************/
+
+// Channels are just names, they don't exist until someone subscribes to
+// them. Messages aren't stored, so only current subscribers see them.
+
+// Message is sent to the subscribers of a channel. Data is base64 encoded
+// in the JSON.
+type Message struct {
+	Channel string `json:"channel"`
+	Data    []byte `json:"data"`
+}
+
+// How often an idle subscription gets a comment line so proxies don't
+// close it
+var SubPingInterval = 30 * time.Second
+
+type Subscriber struct {
+	Channel  string
+	Messages chan *Message // Closed when the subscription is over
+}
+
+// Subscribe registers interest in channel. Caller must call Unsubscribe
+// when done.
+func (db *DB) Subscribe(channel string) *Subscriber {
+	sub := &Subscriber{
+		Channel:  channel,
+		Messages: make(chan *Message, WatchQueueSize),
+	}
+
+	db.mutex.Lock()
+	if db.subscribers == nil {
+		db.subscribers = map[string]map[*Subscriber]bool{}
+	}
+	if db.subscribers[channel] == nil {
+		db.subscribers[channel] = map[*Subscriber]bool{}
+	}
+	db.subscribers[channel][sub] = true
+	db.mutex.Unlock()
+	return sub
+}
+
+func (db *DB) Unsubscribe(sub *Subscriber) {
+	db.mutex.Lock()
+	db.dropSubscriber(sub)
+	db.mutex.Unlock()
+}
+
+// dropSubscriber must be called with db.mutex held
+func (db *DB) dropSubscriber(sub *Subscriber) {
+	subs := db.subscribers[sub.Channel]
+	if !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(db.subscribers, sub.Channel)
+	}
+	close(sub.Messages)
+}
+
+// Publish sends data to everyone subscribed to channel and returns how
+// many of them got it. Subscribers that can't keep up are dropped.
+func (db *DB) Publish(channel string, data []byte) int {
+	msg := &Message{Channel: channel, Data: data}
+	count := 0
+
+	db.mutex.Lock()
+	for sub := range db.subscribers[channel] {
+		select {
+		case sub.Messages <- msg:
+			count++
+		default:
+			db.dropSubscriber(sub)
+		}
+	}
+	db.mutex.Unlock()
+	return count
+}
+
+// CloseSubscribers ends all subscriptions, e.g. when the DB is deleted
+func (db *DB) CloseSubscribers() {
+	db.mutex.Lock()
+	for _, subs := range db.subscribers {
+		for sub := range subs {
+			db.dropSubscriber(sub)
+		}
+	}
+	db.mutex.Unlock()
+}
+
+// DBPublishHandler sends the body of the request to the subscribers of a
+// channel and returns the number of them that got it:
+//
+//	POST /db/{dbID}/_pub/{channel}
+func (s *Server) DBPublishHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	data, err := s.ReadValue(w, r)
+	if err != nil {
+		WriteReadError(w, err)
+		return
+	}
+
+	channel := vars["channel"]
+	count := db.Publish(channel, data)
+	s.Debug(3, "DB %s: Published %d bytes to %q, %d subscribers\n", db.ID,
+		len(data), channel, count)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d", count)
+}
+
+// DBSubscribeHandler streams the messages sent to a channel as Server-Sent
+// Events, one "message" event per Message, with the Message as JSON in
+// the data line:
+//
+//	GET /db/{dbID}/_sub/{channel}
+//
+// The stream ends when the client goes away, the DB is deleted, or the
+// server is shutting down.
+func (s *Server) DBSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Streams can last a lot longer than the server's WriteTimeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	sub := db.Subscribe(vars["channel"])
+	defer db.Unsubscribe(sub)
+	s.Debug(3, "DB %s: Subscribed to %q\n", db.ID, sub.Channel)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": subscribed to %s\n\n", strconv.Quote(sub.Channel))
+	rc.Flush()
+
+	ticker := time.NewTicker(SubPingInterval)
+	defer ticker.Stop()
+
+	for id := 1; ; {
+		select {
+		case msg, ok := <-sub.Messages:
+			if !ok {
+				return
+			}
+			buf, _ := json.Marshal(msg)
+			_, err := fmt.Fprintf(w, "event: message\nid: %d\ndata: %s\n\n",
+				id, buf)
+			if err != nil {
+				return
+			}
+			rc.Flush()
+			id++
+		case <-ticker.C:
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,838 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Replication Stuff */
+/*********************/
+
+// Every server keeps a change log: each write to a DB's Store, each change
+// to a key's history, DBs being created and deleted, and Instances (with
+// their Bindings) being changed. A follower, started via Follow, streams
+// the log of its leader from:
+//
+//	GET /admin/replication/stream
+//
+// as NDJSON ReplEvents. Each stream starts with a "reset", then the
+// current state of the leader as "db", "put", "history" and "instance"
+// events, then a "synced", then changes as they happen. Changes made while
+// the state is being sent are sent again after it, which is fine since
+// applying an event twice is the same as applying it once. Once synced,
+// the follower removes anything the leader doesn't have.
+//
+// A follower rejects writes with a 421 and a LeaderHeader, but serves
+// reads, watches and its own change log (so followers can be chained). If
+// it loses the leader it keeps retrying, and does a full sync each time it
+// gets back. POST /admin/replication/promote makes it stop following and
+// take writes, e.g. once the leader is gone. Nothing stops the old leader
+// from taking writes too, so it's up to whoever promotes a follower to
+// make sure the old leader is really gone. Pub/sub messages aren't
+// replicated.
+
+// LeaderHeader holds the URL of the leader in a follower's 421 responses
+const LeaderHeader = "X-Leader"
+
+// How often the leader sends a "ping" when there's nothing else to send.
+// Followers give up on a leader after 3 missed pings.
+var ReplHeartbeat = 5 * time.Second
+
+// How long a follower waits before reconnecting to its leader
+var ReplRetryDelay = time.Second
+
+// Max number of events we'll queue up for a follower before dropping it.
+// It'll reconnect and start over.
+var ReplQueueSize = 10000
+
+// ReplEvent is one entry in the change log
+type ReplEvent struct {
+	Seq uint64 `json:"seq,omitempty"`
+	Op  string `json:"op"` // See the Repl* consts
+
+	DB       string          `json:"db,omitempty"`
+	Key      string          `json:"key,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`   // *Value of a put
+	History  json.RawMessage `json:"history,omitempty"` // null clears it
+	User     string          `json:"user,omitempty"`    // Of a new DB
+	Password string          `json:"password,omitempty"`
+	URL      string          `json:"url,omitempty"`
+	Storage  string          `json:"storage,omitempty"`
+
+	Instance string            `json:"instance,omitempty"`
+	Info     *InstanceSnapshot `json:"info,omitempty"`
+}
+
+// Change log ops
+const (
+	ReplReset        = "reset"  // A full sync is starting
+	ReplSynced       = "synced" // The full sync is done
+	ReplPing         = "ping"
+	ReplDB           = "db"     // A DB was created
+	ReplDropDB       = "dropdb" // A DB was deleted
+	ReplPut          = "put"
+	ReplDelete       = "delete"
+	ReplHistory      = "history"
+	ReplInstance     = "instance" // An Instance, or its Bindings, changed
+	ReplDropInstance = "dropinstance"
+)
+
+// Roles in a ReplicationStatus
+const (
+	ReplRoleLeader   = "leader"
+	ReplRoleFollower = "follower"
+)
+
+// ReplicationStatus is returned by GET /admin/replication
+type ReplicationStatus struct {
+	Role      string `json:"role"` // leader or follower
+	Leader    string `json:"leader,omitempty"`
+	Connected bool   `json:"connected"` // Follower is streaming the log
+	Synced    bool   `json:"synced"`    // Follower is caught up w/leader
+	Seq       uint64 `json:"seq"`       // Of the last event sent or applied
+	Followers int    `json:"followers"` // Streaming this server's log
+}
+
+// replLog is the leader side of replication
+type replLog struct {
+	mutex sync.Mutex
+	seq   uint64
+	subs  map[*replSub]bool
+	count int32 // len(subs), atomically, so writes can skip all of this
+}
+
+type replSub struct {
+	ch      chan []byte // Lines of NDJSON
+	dropped chan struct{}
+}
+
+// follower is the follower side of replication
+type follower struct {
+	leader    string
+	cancel    context.CancelFunc
+	done      chan struct{} // Closed when it's stopped following
+	connected bool
+	synced    bool
+	seq       uint64
+}
+
+// replicating is true if anyone is streaming our change log
+func (s *Server) replicating() bool {
+	return atomic.LoadInt32(&s.repl.count) > 0
+}
+
+func (s *Server) subscribeRepl() *replSub {
+	sub := &replSub{
+		ch:      make(chan []byte, ReplQueueSize),
+		dropped: make(chan struct{}),
+	}
+	s.repl.mutex.Lock()
+	if s.repl.subs == nil {
+		s.repl.subs = map[*replSub]bool{}
+	}
+	s.repl.subs[sub] = true
+	atomic.StoreInt32(&s.repl.count, int32(len(s.repl.subs)))
+	s.repl.mutex.Unlock()
+	return sub
+}
+
+// unsubscribeRepl must be called with s.repl.mutex held
+func (s *Server) unsubscribeRepl(sub *replSub) {
+	if s.repl.subs[sub] {
+		delete(s.repl.subs, sub)
+		close(sub.dropped)
+		atomic.StoreInt32(&s.repl.count, int32(len(s.repl.subs)))
+	}
+}
+
+// publish adds ev to the change log. Events of a DB must be published with
+// its lock held so they're in the same order as the changes.
+func (s *Server) publish(ev *ReplEvent) {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	if len(s.repl.subs) == 0 {
+		return
+	}
+
+	s.repl.seq++
+	ev.Seq = s.repl.seq
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		s.Debug(1, "Can't serialize %q event: %s\n", ev.Op, err)
+		return
+	}
+	buf = append(buf, '\n')
+	for sub := range s.repl.subs {
+		select {
+		case sub.ch <- buf:
+		default:
+			s.unsubscribeRepl(sub)
+		}
+	}
+}
+
+// The replicate* funcs publish changes, if anyone's listening. The ones
+// for keys must be called with db.mutex held.
+
+func (s *Server) replicateKey(db *DB, key string, v *Value) {
+	if !s.replicating() {
+		return
+	}
+	ev := &ReplEvent{Op: ReplDelete, DB: db.ID, Key: key}
+	if v != nil {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			s.Debug(1, "DB %s: Can't serialize %q: %s\n", db.ID, key, err)
+			return
+		}
+		ev.Op, ev.Value = ReplPut, buf
+	}
+	s.publish(ev)
+}
+
+func (s *Server) replicateHistory(db *DB, key string, h []*Value) {
+	if !s.replicating() {
+		return
+	}
+	s.publish(s.historyEvent(db, key, h))
+}
+
+func (s *Server) historyEvent(db *DB, key string, h []*Value) *ReplEvent {
+	ev := &ReplEvent{Op: ReplHistory, DB: db.ID, Key: key}
+	if len(h) > 0 {
+		ev.History, _ = json.Marshal(h)
+	}
+	return ev
+}
+
+// replicateKeys sends all of db's keys, for when they were added w/o going
+// through db.Data.Put
+func (s *Server) replicateKeys(db *DB) {
+	if !s.replicating() {
+		return
+	}
+	db.mutex.Lock()
+	db.Data.Range("", "", func(key string, v *Value) bool {
+		s.replicateKey(db, key, v)
+		return true
+	})
+	db.mutex.Unlock()
+}
+
+func dbEvent(db *DB) *ReplEvent {
+	return &ReplEvent{Op: ReplDB, DB: db.ID, User: db.User,
+		Password: db.Password, URL: db.URL, Storage: db.Storage}
+}
+
+func (s *Server) replicateDB(db *DB) {
+	if s.replicating() {
+		s.publish(dbEvent(db))
+	}
+}
+
+func (s *Server) replicateDropDB(db *DB) {
+	if s.replicating() {
+		s.publish(&ReplEvent{Op: ReplDropDB, DB: db.ID})
+	}
+}
+
+// instanceChanged is called, with s.instanceMutex held, whenever Instance
+// id, or its Bindings, are added, changed or removed
+func (s *Server) instanceChanged(id string) {
+	s.stateChanged()
+	s.replicateInstance(id)
+}
+
+// replicateInstance sends the current state of Instance id. Must be called
+// with s.instanceMutex held.
+func (s *Server) replicateInstance(id string) {
+	if !s.replicating() {
+		return
+	}
+	ev := &ReplEvent{Op: ReplDropInstance, Instance: id}
+	if instance := s.Instances[id]; instance != nil {
+		ev.Op, ev.Info = ReplInstance, newInstanceSnapshot(instance)
+	}
+	s.publish(ev)
+}
+
+// ReadOnly is true if we're following a leader
+func (s *Server) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+// readOnlyOK is true if r can be sent to a follower
+func readOnlyOK(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" ||
+		r.Method == "OPTIONS" ||
+		(r.Method == "POST" && r.URL.Path == "/admin/replication/promote")
+}
+
+// WriteReadOnly sends back the error for a write sent to a follower
+func (s *Server) WriteReadOnly(w http.ResponseWriter) {
+	leader := s.ReplicationStatus().Leader
+	w.Header().Set(LeaderHeader, leader)
+	w.WriteHeader(http.StatusMisdirectedRequest)
+	fmt.Fprintf(w, "This server is a read-only follower of %s\n", leader)
+}
+
+func (s *Server) ReplicationStatus() *ReplicationStatus {
+	s.repl.mutex.Lock()
+	status := &ReplicationStatus{
+		Role:      ReplRoleLeader,
+		Seq:       s.repl.seq,
+		Followers: len(s.repl.subs),
+	}
+	s.repl.mutex.Unlock()
+
+	s.followMutex.Lock()
+	if f := s.following; f != nil {
+		status.Role, status.Leader = ReplRoleFollower, f.leader
+		status.Connected, status.Synced, status.Seq = f.connected,
+			f.synced, f.seq
+	}
+	s.followMutex.Unlock()
+	return status
+}
+
+/* Leader Side */
+
+func (s *Server) ReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	WriteJSON(w, s.ReplicationStatus())
+}
+
+func (s *Server) ReplicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The stream lasts as long as the follower is around
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	// Subscribe first so nothing that happens during the sync is missed
+	sub := s.subscribeRepl()
+	defer func() {
+		s.repl.mutex.Lock()
+		s.unsubscribeRepl(sub)
+		s.repl.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	write := func(ev *ReplEvent) error {
+		buf, err := json.Marshal(ev)
+		if err == nil {
+			_, err = w.Write(append(buf, '\n'))
+		}
+		return err
+	}
+
+	s.Debug(2, "Follower %s: syncing\n", r.RemoteAddr)
+	if err := s.syncFollower(write); err != nil {
+		s.Debug(1, "Follower %s: Error syncing: %s\n", r.RemoteAddr, err)
+		return
+	}
+	rc.Flush()
+
+	ticker := time.NewTicker(ReplHeartbeat)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case buf := <-sub.ch:
+			if _, err = w.Write(buf); err == nil && len(sub.ch) == 0 {
+				err = rc.Flush()
+			}
+		case <-ticker.C:
+			if err = write(&ReplEvent{Op: ReplPing}); err == nil {
+				err = rc.Flush()
+			}
+		case <-sub.dropped:
+			s.Debug(1, "Follower %s: Fell too far behind\n", r.RemoteAddr)
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			s.Debug(2, "Follower %s: %s\n", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+// syncFollower sends the current state of all DBs and Instances
+func (s *Server) syncFollower(write func(*ReplEvent) error) error {
+	s.repl.mutex.Lock()
+	seq := s.repl.seq
+	s.repl.mutex.Unlock()
+	if err := write(&ReplEvent{Seq: seq, Op: ReplReset}); err != nil {
+		return err
+	}
+
+	s.dbMapMutex.Lock()
+	dbs := make([]*DB, 0, len(s.DBs))
+	for _, db := range s.DBs {
+		dbs = append(dbs, db)
+	}
+	s.dbMapMutex.Unlock()
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].ID < dbs[j].ID })
+
+	for _, db := range dbs {
+		if err := s.syncDB(db, write); err != nil {
+			return err
+		}
+	}
+
+	s.instanceMutex.Lock()
+	evs := []*ReplEvent{}
+	for id, instance := range s.Instances {
+		evs = append(evs, &ReplEvent{Op: ReplInstance, Instance: id,
+			Info: newInstanceSnapshot(instance)})
+	}
+	s.instanceMutex.Unlock()
+	sort.Slice(evs, func(i, j int) bool {
+		return evs[i].Instance < evs[j].Instance
+	})
+	for _, ev := range evs {
+		if err := write(ev); err != nil {
+			return err
+		}
+	}
+
+	return write(&ReplEvent{Op: ReplSynced})
+}
+
+// syncDB sends db and all of its keys. Like an export, the DB isn't locked
+// while they're sent.
+func (s *Server) syncDB(db *DB, write func(*ReplEvent) error) error {
+	db.mutex.Lock()
+	ev := dbEvent(db)
+	snap := db.Data.Snapshot()
+	history := make(map[string][]*Value, len(db.History))
+	for key, h := range db.History {
+		history[key] = h
+	}
+	db.mutex.Unlock()
+	defer snap.Close()
+
+	err := write(ev)
+	snap.Range("", "", func(key string, v *Value) bool {
+		if err != nil {
+			return false
+		}
+		// Typed values are changed in place, under the lock
+		if v.Type != TypeString && db.Storage == StorageMemory {
+			db.mutex.Lock()
+			v = v.Copy()
+			db.mutex.Unlock()
+		}
+		ev := &ReplEvent{Op: ReplPut, DB: db.ID, Key: key}
+		if ev.Value, err = json.Marshal(v); err == nil {
+			err = write(ev)
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = snap.Err()
+	}
+
+	keys := make([]string, 0, len(history))
+	for key := range history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err != nil {
+			break
+		}
+		err = write(s.historyEvent(db, key, history[key]))
+	}
+	return err
+}
+
+/* Follower Side */
+
+// Follow makes this server a read-only copy of the one at leader (e.g.
+// http://host:port), using Config.BrokerUser/BrokerPassword to get its
+// change log. It runs until Promote or Shutdown is called.
+func (s *Server) Follow(leader string) error {
+	leader = strings.TrimRight(leader, "/")
+
+	s.followMutex.Lock()
+	defer s.followMutex.Unlock()
+	if s.following != nil {
+		return fmt.Errorf("Already following %s", s.following.leader)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{leader: leader, cancel: cancel, done: make(chan struct{})}
+	s.following = f
+	atomic.StoreInt32(&s.readOnly, 1)
+
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go s.follow(ctx, f)
+
+	s.Debug(1, "Following %s\n", leader)
+	return nil
+}
+
+// Promote stops following the leader, if we are, and starts taking
+// writes. Whatever we got from the leader is kept.
+func (s *Server) Promote() {
+	s.followMutex.Lock()
+	f := s.following
+	s.followMutex.Unlock()
+	if f == nil {
+		return
+	}
+
+	f.cancel()
+	<-f.done
+
+	s.followMutex.Lock()
+	s.following = nil
+	atomic.StoreInt32(&s.readOnly, 0)
+	s.followMutex.Unlock()
+	s.Debug(1, "Stopped following %s, now the leader\n", f.leader)
+}
+
+func (s *Server) PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.VerifyBrokerAuth(w, r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.Promote()
+	WriteJSON(w, s.ReplicationStatus())
+}
+
+// follow streams the leader's change log until ctx is done
+func (s *Server) follow(ctx context.Context, f *follower) {
+	defer close(f.done)
+	for {
+		err := s.followOnce(ctx, f)
+
+		// Until the next full sync we might be missing changes
+		s.followMutex.Lock()
+		f.connected, f.synced = false, false
+		s.followMutex.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		s.Debug(1, "Lost leader %s: %s\n", f.leader, err)
+
+		select {
+		case <-time.After(ReplRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replSync keeps track of what the leader has during a full sync, so that
+// anything else can be removed at the end of it
+type replSync struct {
+	dbs       map[string]*replSyncDB
+	instances map[string]bool
+}
+
+type replSyncDB struct {
+	keys    map[string]bool
+	history map[string]bool
+}
+
+// followOnce streams the leader's change log until there's an error
+func (s *Server) followOnce(ctx context.Context, f *follower) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		f.leader+"/admin/replication/stream", nil)
+	if err != nil {
+		return err
+	}
+	if s.config.BrokerUser != "" {
+		req.SetBasicAuth(s.config.BrokerUser, s.config.BrokerPassword)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	s.followMutex.Lock()
+	f.connected = true
+	s.followMutex.Unlock()
+	s.Debug(1, "Connected to leader %s\n", f.leader)
+
+	// If the pings stop then the leader's gone
+	timedOut := int32(0)
+	timer := time.AfterFunc(3*ReplHeartbeat, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	defer timer.Stop()
+
+	dec := json.NewDecoder(res.Body)
+	var sync *replSync
+	for {
+		ev := &ReplEvent{}
+		if err := dec.Decode(ev); err != nil {
+			if atomic.LoadInt32(&timedOut) != 0 {
+				return fmt.Errorf("Nothing from the leader for %s",
+					3*ReplHeartbeat)
+			}
+			return err
+		}
+		timer.Reset(3 * ReplHeartbeat)
+
+		switch ev.Op {
+		case ReplReset:
+			sync = &replSync{dbs: map[string]*replSyncDB{},
+				instances: map[string]bool{}}
+			s.followMutex.Lock()
+			f.synced = false
+			s.followMutex.Unlock()
+		case ReplSynced:
+			if sync != nil {
+				s.finishSync(sync)
+				sync = nil
+			}
+			s.saveChanges()
+			s.followMutex.Lock()
+			f.synced = true
+			s.followMutex.Unlock()
+			s.Debug(1, "Synced with leader %s\n", f.leader)
+		default:
+			if err := s.applyEvent(ev, sync); err != nil {
+				return err
+			}
+			// During a full sync this waits for the "synced"
+			if sync == nil {
+				s.saveChanges()
+			}
+		}
+
+		if ev.Seq != 0 {
+			s.followMutex.Lock()
+			f.seq = ev.Seq
+			s.followMutex.Unlock()
+		}
+	}
+}
+
+// applyEvent makes the change in ev. sync is nil unless a full sync is in
+// progress.
+func (s *Server) applyEvent(ev *ReplEvent, sync *replSync) error {
+	switch ev.Op {
+	case ReplDB:
+		if s.getDB(ev.DB) == nil {
+			s.newReplicaDB(ev)
+		}
+		if sync != nil {
+			sync.dbs[ev.DB] = &replSyncDB{keys: map[string]bool{},
+				history: map[string]bool{}}
+		}
+
+	case ReplDropDB:
+		if db := s.getDB(ev.DB); db != nil {
+			s.DeleteDB(db)
+		}
+
+	case ReplPut, ReplDelete, ReplHistory:
+		db := s.getDB(ev.DB)
+		if db == nil {
+			s.Debug(2, "DB %s: Missing, ignoring %q of %q\n", ev.DB, ev.Op,
+				ev.Key)
+			return nil
+		}
+		if err := s.applyKeyEvent(db, ev); err != nil {
+			return fmt.Errorf("DB %s: Bad %q of %q: %s", ev.DB, ev.Op, ev.Key,
+				err)
+		}
+		if sd := sync.db(ev.DB); sd != nil && ev.Op == ReplPut {
+			sd.keys[ev.Key] = true
+		} else if sd != nil && ev.Op == ReplHistory {
+			sd.history[ev.Key] = true
+		}
+
+	case ReplInstance:
+		if ev.Info == nil {
+			return fmt.Errorf("Instance %s: Missing 'info'", ev.Instance)
+		}
+		db := s.getDB(ev.Info.DBID)
+		if db == nil {
+			s.Debug(2, "Instance %s: Missing DB %s\n", ev.Instance,
+				ev.Info.DBID)
+			return nil
+		}
+		s.instanceMutex.Lock()
+		s.Instances[ev.Instance] = ev.Info.instance(db)
+		s.instanceChanged(ev.Instance)
+		s.instanceMutex.Unlock()
+		if sync != nil {
+			sync.instances[ev.Instance] = true
+		}
+
+	case ReplDropInstance:
+		s.instanceMutex.Lock()
+		delete(s.Instances, ev.Instance)
+		s.instanceChanged(ev.Instance)
+		s.instanceMutex.Unlock()
+	}
+	return nil
+}
+
+func (sync *replSync) db(id string) *replSyncDB {
+	if sync == nil {
+		return nil
+	}
+	return sync.dbs[id]
+}
+
+// newReplicaDB creates the DB in ev. If we can't use the same kind of
+// storage as the leader, e.g. we don't have a data dir, it's kept in
+// memory.
+func (s *Server) newReplicaDB(ev *ReplEvent) {
+	storage := ev.Storage
+	store, err := s.newStore(ev.DB, storage)
+	if err != nil {
+		s.Debug(1, "DB %s: Keeping it in memory: %s\n", ev.DB, err)
+		storage, store = StorageMemory, NewMemStore()
+	}
+
+	url := ev.URL
+	if s.config.HostString != "" {
+		url = fmt.Sprintf("http://%s/db/%s", s.config.HostString, ev.DB)
+	}
+	s.registerDB(&DB{
+		ID:       ev.DB,
+		User:     ev.User,
+		Password: ev.Password,
+		Data:     store,
+		URL:      url,
+		Storage:  storage,
+	})
+}
+
+func (s *Server) applyKeyEvent(db *DB, ev *ReplEvent) error {
+	var v *Value
+	var h []*Value
+	switch ev.Op {
+	case ReplPut:
+		v = &Value{}
+		if err := json.Unmarshal(ev.Value, v); err != nil {
+			return err
+		}
+	case ReplHistory:
+		if len(ev.History) > 0 {
+			if err := json.Unmarshal(ev.History, &h); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	switch ev.Op {
+	case ReplPut:
+		db.Data.Put(ev.Key, v)
+		db.Notify(&WatchEvent{Op: "set", Key: ev.Key, Value: v.Data,
+			Null: v.Type == TypeString && v.Data == nil})
+	case ReplDelete:
+		if db.Data.Delete(ev.Key) {
+			db.Notify(&WatchEvent{Op: "delete", Key: ev.Key})
+		}
+	case ReplHistory:
+		db.setHistory(ev.Key, h)
+	}
+	return nil
+}
+
+// finishSync removes whatever the leader didn't send during a full sync
+func (s *Server) finishSync(sync *replSync) {
+	s.instanceMutex.Lock()
+	for id := range s.Instances {
+		if !sync.instances[id] {
+			delete(s.Instances, id)
+			s.instanceChanged(id)
+		}
+	}
+	s.instanceMutex.Unlock()
+
+	s.dbMapMutex.Lock()
+	dbs := make([]*DB, 0, len(s.DBs))
+	for _, db := range s.DBs {
+		dbs = append(dbs, db)
+	}
+	s.dbMapMutex.Unlock()
+
+	for _, db := range dbs {
+		sd := sync.dbs[db.ID]
+		if sd == nil {
+			s.DeleteDB(db)
+			continue
+		}
+
+		db.mutex.Lock()
+		old := []string{}
+		db.Data.Range("", "", func(key string, v *Value) bool {
+			if !sd.keys[key] {
+				old = append(old, key)
+			}
+			return true
+		})
+		for _, key := range old {
+			db.Data.Delete(key)
+			db.Notify(&WatchEvent{Op: "delete", Key: key})
+		}
+		for key := range db.History {
+			if !sd.history[key] {
+				db.setHistory(key, nil)
+			}
+		}
+		db.mutex.Unlock()
+	}
+}
+
+// CheckReplication makes sure a follower has all of the leader's data,
+// and is still getting its changes
+func (s *Server) CheckReplication() *CheckResult {
+	status := s.ReplicationStatus()
+	switch {
+	case status.Role != ReplRoleFollower:
+		return &CheckResult{Status: "disabled"}
+	case !status.Connected:
+		return &CheckResult{Status: "failed",
+			Error: "Not connected to " + status.Leader}
+	case !status.Synced:
+		return &CheckResult{Status: "failed",
+			Error: "Waiting for a full sync with " + status.Leader}
+	}
+	return &CheckResult{Status: "ok"}
+}
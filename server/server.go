@@ -0,0 +1,406 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Misc Stuff */
+/**************/
+
+// Config holds all of the settings of a Server. IP, Port and Catalog will
+// be defaulted if not set. An empty BrokerUser turns off admin auth.
+type Config struct {
+	Verbose        int
+	IP             string // IP/interface to listen on
+	Port           int    // Listen port
+	HostString     string // Host:port string to use in DB URLs
+	BrokerUser     string // Username for broker/DB admin
+	BrokerPassword string // Password for broker/DB admin
+	DisableAuth    bool   // Turn off all auth checking
+	DataDir        string // Where to save snapshots, "" means don't
+	MaxValueSize   int64  // Max size of one value, defaults to 64MB
+	MaxImportSize  int64  // Max size of an _import body, defaults to 1GB
+	MaxVersions    int    // Old values kept per key, -1 means none
+	MaxMemory      int64  // Memory budget for all DBs, 0 means none
+	MaxDBMemory    int64  // Memory budget for each DB, 0 means none
+	EvictionPolicy string // What to do when over budget, see EvictNone
+
+	// Extra ways to authenticate broker/DB admin requests, on top of
+	// BrokerUser/BrokerPassword
+	Authenticators []Authenticator
+
+	Catalog *Catalog // Defaults to DefaultCatalog
+}
+
+// Validate returns an error if any of the settings can't be used
+func (c *Config) Validate() error {
+	if c.EvictionPolicy == "" {
+		return nil
+	}
+	for _, p := range EvictionPolicies {
+		if p == c.EvictionPolicy {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown eviction policy %q", c.EvictionPolicy)
+}
+
+// Server is an OSB API broker along with the DBs it manages. It can be
+// embedded into other programs as an http.Handler, or run stand-alone
+// via ListenAndServe.
+type Server struct {
+	config  Config
+	router  *mux.Router
+	Catalog Catalog
+
+	DBs          map[string]*DB // DBid -> DB
+	lastID       int
+	newDBIDMutex sync.Mutex
+	dbMapMutex   sync.Mutex
+
+	Instances     map[string]*Instance // InstanceID -> Instance
+	instanceMutex sync.Mutex           // Guards Instances and their Bindings
+	busy          map[string]int       // InstanceID -> requests using it
+
+	httpServer  *http.Server
+	listening   bool
+	serverMutex sync.Mutex
+
+	done     chan struct{} // Closed when we're shutting down
+	doneOnce sync.Once
+
+	runningChecks map[string]*runningCheck // See health.go
+	checkMutex    sync.Mutex
+
+	// See SaveChanges
+	stateDirty    int32 // Atomically, 1 if DBs or Instances changed
+	snapshotMutex sync.Mutex
+
+	// Updated atomically, see memory.go
+	memUsed     int64
+	evictedKeys int64
+	expiredKeys int64
+
+	// See replication.go
+	repl        replLog
+	following   *follower // nil unless we're a follower
+	followMutex sync.Mutex
+	readOnly    int32 // Atomically, 1 while following
+}
+
+// NewServer returns an error if config isn't valid, see Config.Validate
+func NewServer(config Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.IP == "" {
+		config.IP = "0.0.0.0"
+	}
+	if config.Port == 0 {
+		config.Port = 80
+	}
+	if config.Catalog == nil {
+		config.Catalog = defaultCatalog(config.DataDir != "")
+	}
+	if config.MaxValueSize == 0 {
+		config.MaxValueSize = DefaultMaxValueSize
+	}
+	if config.MaxImportSize == 0 {
+		config.MaxImportSize = DefaultMaxImportSize
+	}
+	if config.MaxVersions == 0 {
+		config.MaxVersions = DefaultMaxVersions
+	}
+	if config.EvictionPolicy == "" {
+		config.EvictionPolicy = EvictNone
+	}
+
+	s := &Server{
+		config:    config,
+		Catalog:   *config.Catalog,
+		DBs:       map[string]*DB{},
+		Instances: map[string]*Instance{},
+		busy:      map[string]int{},
+		done:      make(chan struct{}),
+
+		runningChecks: map[string]*runningCheck{},
+	}
+	s.router = s.NewRouter()
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.ReadOnly() && !readOnlyOK(r) {
+		s.WriteReadOnly(w)
+		return
+	}
+	s.router.ServeHTTP(w, r)
+
+	// Small responses are still buffered at this point, so the client
+	// doesn't hear back until any new DB or Instance is saved
+	s.saveChanges()
+}
+
+// ListenAndServe blocks until the server fails or Shutdown is called, in
+// which case http.ErrServerClosed is returned.
+func (s *Server) ListenAndServe() error {
+	s.serverMutex.Lock()
+	s.httpServer = &http.Server{
+		Handler:      s,
+		Addr:         fmt.Sprintf("%s:%d", s.config.IP, s.config.Port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	httpServer := s.httpServer
+	s.serverMutex.Unlock()
+
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.serverMutex.Lock()
+	s.listening = true
+	s.serverMutex.Unlock()
+
+	s.Debug(1, "Server listening on %s:%d\n", s.config.IP, s.config.Port)
+	err = httpServer.Serve(listener)
+
+	s.serverMutex.Lock()
+	s.listening = false
+	s.serverMutex.Unlock()
+	return err
+}
+
+// Shutdown stops the listener started by ListenAndServe, if there is one,
+// and waits for in-flight requests to finish or for ctx to be done. Then,
+// if Config.DataDir is set, a snapshot of all DBs and Instances is saved.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Tell any long-lived streams to wrap up so they don't hold up draining
+	s.doneOnce.Do(func() { close(s.done) })
+
+	s.serverMutex.Lock()
+	httpServer := s.httpServer
+	s.serverMutex.Unlock()
+
+	var err error
+	if httpServer != nil {
+		s.Debug(1, "Server shutting down\n")
+		err = httpServer.Shutdown(ctx)
+	}
+
+	if snapErr := s.SaveSnapshot(); snapErr != nil && err == nil {
+		err = snapErr
+	}
+
+	// Make sure anything on disk is flushed
+	s.dbMapMutex.Lock()
+	for _, db := range s.DBs {
+		db.mutex.Lock()
+		if closeErr := db.Data.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("Can't close DB %s: %s", db.ID, closeErr)
+		}
+		db.mutex.Unlock()
+	}
+	s.dbMapMutex.Unlock()
+	return err
+}
+
+// Done returns a channel that's closed once Shutdown is called. Handlers
+// that stream responses should return when it is.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Server) Debug(level int, format string, args ...interface{}) {
+	if s.config.Verbose < level {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+func WriteJSON(w http.ResponseWriter, obj interface{}) {
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		b = []byte(err.Error())
+	}
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+func GeneratePassword() string {
+	len := 6 + rand.Int()%6
+	var password [12]byte
+
+	for i := 0; i < len; i++ {
+		r := rand.Int() % 62
+		if r < 26 {
+			password[i] = byte('a' + r)
+		} else if r < 52 {
+			password[i] = byte('A' + (r - 26))
+		} else {
+			password[i] = byte('0' + (r - 52))
+		}
+	}
+	return string(password[:len])
+}
+
+func (s *Server) InfoHandler(w http.ResponseWriter, r *http.Request) {
+	str := fmt.Sprintf(
+		"OSB API Sample DB Broker\n"+
+			"------------------------\n"+
+			"User: %s\n"+
+			"DBs: %d\n"+
+			"Services: %d\n"+
+			"Instances: %d\n"+
+			"Memory used: %d\n"+
+			"Memory limit: %d\n"+
+			"DB memory limit: %d\n"+
+			"Eviction policy: %s\n"+
+			"Evicted keys: %d\n"+
+			"Expired keys: %d\n",
+		s.config.BrokerUser, s.dbCount(), len(s.Catalog.Services),
+		s.instanceCount(), atomic.LoadInt64(&s.memUsed), s.config.MaxMemory,
+		s.config.MaxDBMemory, s.config.EvictionPolicy,
+		atomic.LoadInt64(&s.evictedKeys), atomic.LoadInt64(&s.expiredKeys))
+	w.Write([]byte(str))
+}
+
+func (s *Server) dbCount() int {
+	s.dbMapMutex.Lock()
+	defer s.dbMapMutex.Unlock()
+	return len(s.DBs)
+}
+
+func (s *Server) instanceCount() int {
+	s.instanceMutex.Lock()
+	defer s.instanceMutex.Unlock()
+	return len(s.Instances)
+}
+
+func (s *Server) VerifyBasicAuth(w http.ResponseWriter, r *http.Request,
+	user, password string) bool {
+
+	if s.config.DisableAuth || user == "" {
+		return true
+	}
+
+	u, p, ok := r.BasicAuth()
+	if ok && user == u && password == p {
+		return true
+	}
+	return false
+}
+
+// NewRouter returns the handler for all of the broker and DB APIs
+func (s *Server) NewRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/info", s.InfoHandler)
+	r.HandleFunc("/", s.InfoHandler)
+	r.HandleFunc("/healthz", s.HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.ReadyzHandler).Methods("GET")
+	r.HandleFunc("/metrics", s.MetricsHandler).Methods("GET")
+
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.Use(s.BrokerAuthMiddleware, OSBMiddleware)
+	v2.HandleFunc("/catalog", s.CatalogHandler).Methods("GET")
+	v2.HandleFunc("/service_instances/{iID}", s.ProvisionHandler).
+		Methods("PUT")
+	v2.HandleFunc("/service_instances/{iID}", s.FetchInstanceHandler).
+		Methods("GET")
+	v2.HandleFunc("/service_instances/{iID}", s.UpdateHandler).
+		Methods("PATCH")
+	v2.HandleFunc("/service_instances/{iID}/service_bindings/{bID}",
+		s.BindHandler).Methods("PUT")
+	v2.HandleFunc("/service_instances/{iID}/service_bindings/{bID}",
+		s.FetchBindingHandler).Methods("GET")
+	v2.HandleFunc("/service_instances/{iID}/service_bindings/{bID}",
+		s.UnbindHandler).Methods("DELETE")
+	v2.HandleFunc("/service_instances/{iID}", s.DeprovisionHandler).
+		Methods("DELETE")
+
+	r.HandleFunc("/admin/instances", s.InstancesHandler).Methods("GET")
+	r.HandleFunc("/admin/instances/{iID}/backups", s.BackupCreateHandler).
+		Methods("POST")
+	r.HandleFunc("/admin/instances/{iID}/backups", s.BackupListHandler).
+		Methods("GET")
+	r.HandleFunc("/admin/backups", s.BackupListHandler).Methods("GET")
+	r.HandleFunc("/admin/backups/{name}", s.BackupDeleteHandler).
+		Methods("DELETE")
+	r.HandleFunc("/admin/replication", s.ReplicationHandler).Methods("GET")
+	r.HandleFunc("/admin/replication/stream", s.ReplicationStreamHandler).
+		Methods("GET")
+	r.HandleFunc("/admin/replication/promote", s.PromoteHandler).
+		Methods("POST")
+
+	r.HandleFunc("/db", s.DBAllHandler).Methods("GET")
+	r.HandleFunc("/db/", s.DBAllHandler).Methods("GET")
+	r.HandleFunc("/db", s.DBCreateHandler).Methods("POST")
+	r.HandleFunc("/db/", s.DBCreateHandler).Methods("POST")
+
+	r.HandleFunc("/db/{dbID}", s.DBCreateHandler).Methods("PUT")
+	r.HandleFunc("/db/{dbID}/", s.DBCreateHandler).Methods("PUT")
+	r.HandleFunc("/db/{dbID}", s.DBHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/", s.DBHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}", s.DBDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/db/{dbID}/", s.DBDeleteHandler).Methods("DELETE")
+
+	r.HandleFunc("/db/{dbID}/_keys", s.DBKeysHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/_watch", s.DBWatchHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/_ws", s.DBWebSocketHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/_export", s.DBExportHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/_import", s.DBImportHandler).Methods("POST")
+	r.HandleFunc("/db/{dbID}/_pub/{channel:.+}", s.DBPublishHandler).
+		Methods("POST")
+	r.HandleFunc("/db/{dbID}/_sub/{channel:.+}", s.DBSubscribeHandler).
+		Methods("GET")
+
+	r.HandleFunc("/db/{dbID}/{key:.*}/_history", s.DBHistoryHandler).
+		Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_restore", s.DBRestoreHandler).
+		Methods("POST")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_list", s.DBListGetHandler).
+		Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_list", s.DBListOpHandler).
+		Methods("POST")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_hash", s.DBHashGetAllHandler).
+		Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_hash/{field:.+}", s.DBHashGetHandler).
+		Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_hash/{field:.+}", s.DBHashSetHandler).
+		Methods("PUT")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_hash/{field:.+}",
+		s.DBHashDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_set", s.DBSetMembersHandler).
+		Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_set/{member:.+}",
+		s.DBSetIsMemberHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_set/{member:.+}", s.DBSetAddHandler).
+		Methods("PUT")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_set/{member:.+}",
+		s.DBSetRemoveHandler).Methods("DELETE")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_zset", s.DBZSetRangeHandler).
+		Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_zset/{member:.+}",
+		s.DBZSetGetHandler).Methods("GET")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_zset/{member:.+}",
+		s.DBZSetAddHandler).Methods("PUT", "POST")
+	r.HandleFunc("/db/{dbID}/{key:.*}/_zset/{member:.+}",
+		s.DBZSetRemoveHandler).Methods("DELETE")
+	r.HandleFunc("/db/{dbID}/{key:.*}", s.DBGetHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/db/{dbID}/{key:.*}", s.DBSetHandler).Methods("PUT")
+	r.HandleFunc("/db/{dbID}/{key:.*}", s.DBOpHandler).Methods("POST")
+	r.HandleFunc("/db/{dbID}/{key:.*}", s.DBRemoveHandler).Methods("DELETE")
+
+	return r
+}
@@ -0,0 +1,2614 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duglin/osbdb/dbclient"
+	"github.com/gorilla/websocket"
+)
+
+var testHost = "localhost:80"
+var testUser = ""
+var testPassword = ""
+var testServer *Server
+
+func TestMain(m *testing.M) {
+	rc := 0
+
+	testUser = "user"
+	testPassword = "passw0rd"
+	var err error
+	testServer, err = NewServer(Config{
+		Verbose:        0,
+		BrokerUser:     testUser,
+		BrokerPassword: testPassword,
+	})
+	if err != nil {
+		fmt.Printf("Error creating server: %s\n", err)
+		os.Exit(1)
+	}
+
+	httpServer := httptest.NewServer(testServer)
+	testHost = httpServer.Listener.Addr().String()
+
+	// Run first w/o any auth
+	fmt.Printf("Running w/o any auth\n")
+	testServer.config.DisableAuth = true
+	rc += m.Run()
+
+	// Now run all tests again with auth
+	fmt.Printf("\nRunning with auth\n")
+	testServer.config.DisableAuth = false
+	rc += m.Run()
+
+	httpServer.Close()
+	os.Exit(rc)
+}
+
+func Assert(t *testing.T, b bool, errStr string, args ...interface{}) {
+	if !b {
+		str := ""
+
+		fpcs := make([]uintptr, 1)
+		n := runtime.Callers(2, fpcs)
+		if n != 0 {
+			fun := runtime.FuncForPC(fpcs[0] - 1)
+			f, l := fun.FileLine(fpcs[0] - 1)
+			if i := strings.LastIndex(f, "/"); i > 0 {
+				f = f[i+1:]
+			}
+			str = fmt.Sprintf("%s:%d", f, l)
+		}
+		fmt.Printf(str+":"+errStr+"\n", args...)
+		t.FailNow()
+	}
+}
+
+// mustServer is NewServer for configs that should be fine
+func mustServer(t *testing.T, config Config) *Server {
+	srv, err := NewServer(config)
+	Assert(t, err == nil, "Error creating server: %s", err)
+	return srv
+}
+
+// Note: this implicity tests GetDBs on each test
+func CleanDBs(t *testing.T, url string, user, password string) {
+	dbs, err := dbclient.GetDBs(url, user, password)
+	Assert(t, err == nil, "Can't get the DBs: %s", err)
+
+	for _, db := range dbs {
+		db.DeleteDB()
+	}
+
+	// Verify we're clean
+	dbs, err = dbclient.GetDBs(url, user, password)
+	Assert(t, err == nil, "Error getting DBs: %s", err)
+	Assert(t, len(dbs) == 0, "Len of DBs should be zero, its %d", len(dbs))
+}
+
+func TestCreates1(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	Assert(t, db.URL != "", "Bad db.URL from create")
+	Assert(t, db.User != "", "Bad db.User from create")
+	Assert(t, db.Password != "", "Bad db.Password from create")
+
+	db1, err := dbclient.GetDB(testURL, db.GetID(), db.User, db.Password)
+	Assert(t, err == nil, "Error getting DB: %s", err)
+	Assert(t, db1.URL == db.URL, "URLs should match(%q,%q)", db1.URL, db.URL)
+	Assert(t, db1.User == db.User, "Users should match(%q,%q)", db1.User, db.User)
+	Assert(t, db1.Password == db.Password, "Passwords should match(%q,%q)", db1.Password, db.Password)
+
+	db2, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	Assert(t, db.URL != db2.URL, "DB URLs should not match")
+	Assert(t, db.Password != db2.Password, "DB passwords should not match")
+	Assert(t, db2.URL != "", "Bad db.URL from create")
+	Assert(t, db2.User != "", "Bad db.User from create")
+	Assert(t, db2.Password != "", "Bad db.Password from create")
+
+}
+
+func TestCreates2(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDBByID(testURL, "100", testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	Assert(t, db.URL != "", "Bad db.URL from create")
+	Assert(t, db.User != "", "Bad db.User from create")
+	Assert(t, db.Password != "", "Bad db.Password from create")
+
+	db2, err := dbclient.NewDBByID(testURL, "100", testUser, testPassword)
+	Assert(t, err != nil, "Creating DB should have failed")
+	Assert(t, db2 == nil, "Failed DB should be nil")
+
+	db2, err = dbclient.NewDBByID(testURL, "101", testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	Assert(t, db.URL != "", "Bad db.URL from create")
+	Assert(t, db.User != "", "Bad db.User from create")
+	Assert(t, db.Password != "", "Bad db.Password from create")
+}
+
+func TestGetDB(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	Assert(t, db.URL != "", "Bad db.URL from create")
+	Assert(t, db.User != "", "Bad db.User from create")
+	Assert(t, db.Password != "", "Bad db.Password from create")
+
+	db2, err := dbclient.GetDB(testURL, db.GetID(), testUser, testPassword)
+	Assert(t, err == nil, "Error getting DB: %s", err)
+	Assert(t, db.URL == db2.URL, "URLs should match %q,%q", db.URL, db2.URL)
+	Assert(t, db.User == db2.User, "Users should match %q,%q", db.User, db2.User)
+	Assert(t, db.Password == db2.Password, "Passwords should match %q,%q", db.Password, db.Password)
+}
+
+func TestGetSetString(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	val, err := db.Get("prop1")
+	Assert(t, err != nil, "Should fail to get prop")
+	Assert(t, val == "", "Val should not be set: %v", val)
+
+	err = db.Set("prop2", "hello")
+	Assert(t, err == nil, "Failed to set prop2: %s", err)
+
+	val, err = db.Get("prop2")
+	Assert(t, err == nil, "Failed getting value: %s", err)
+	Assert(t, val == "hello", "Val has wrong value: %q", val)
+
+	// Make sure prop1 is still missing
+	_, err = db.Get("prop1")
+	Assert(t, err != nil, "Should fail to get prop")
+
+	err = db.Set("prop2", "goodbye")
+	Assert(t, err == nil, "Failed to set prop2: %s", err)
+
+	val, err = db.Get("prop2")
+	Assert(t, err == nil, "Failed getting value: %s", err)
+	Assert(t, val == "goodbye", "Val has wrong value: %q", val)
+
+	err = db.Set("prop2", "")
+	Assert(t, err == nil, "Failed to set prop2: %s", err)
+
+	val, err = db.Get("prop2")
+	Assert(t, err == nil, "Failed getting value: %s", err)
+	Assert(t, val == "", "Val has wrong value: %q", val)
+
+	err = db.DeleteKey("prop2")
+	Assert(t, err == nil, "Failed to delete prop2: %s", err)
+
+	val, err = db.Get("prop2")
+	Assert(t, err != nil, "Should fail to get prop")
+	Assert(t, val == "", "Val should not be set: %v", val)
+}
+
+func TestAuth(t *testing.T) {
+	if testServer.config.DisableAuth == true {
+		t.SkipNow()
+	}
+
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	_, err := dbclient.NewDB(testURL, "badUser", testPassword)
+	Assert(t, err != nil, "Create should have failed")
+
+	_, err = dbclient.NewDB(testURL, testUser, "badPassword")
+	Assert(t, err != nil, "Create should have failed")
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Create should have worked")
+
+	saveUser := db.User
+	savePassword := db.Password
+
+	db.User = "badUser"
+	err = db.DeleteDB()
+	Assert(t, err != nil, "Delete should have failed")
+
+	db.User = saveUser
+	db.Password = "badPassword"
+	err = db.DeleteDB()
+	Assert(t, err != nil, "Delete should have failed")
+
+	db.Password = savePassword
+}
+
+func doBearer(t *testing.T, url, token string) int {
+	req, err := http.NewRequest("GET", url, nil)
+	Assert(t, err == nil, "Can't create request: %s", err)
+	req.Header.Set("X-Broker-API-Version", "2.13")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	Assert(t, err == nil, "Request failed: %s", err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func makeJWT(key *rsa.PrivateKey, kid string, claims interface{}) string {
+	enc := base64.RawURLEncoding
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	c, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestBearerAuth(t *testing.T) {
+	if testServer.config.DisableAuth == true {
+		t.SkipNow()
+	}
+
+	testURL := fmt.Sprintf("http://%s/v2/catalog", testHost)
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+
+	saveAuths := testServer.config.Authenticators
+	defer func() { testServer.config.Authenticators = saveAuths }()
+
+	// Static tokens
+	tokens := dir + "/tokens"
+	ioutil.WriteFile(tokens, []byte("# comment\n\ntoken1\ntoken2\n"), 0600)
+	ta, err := NewTokenAuthenticator(tokens)
+	Assert(t, err == nil, "Can't load tokens: %s", err)
+	testServer.AddAuthenticator(ta)
+
+	Assert(t, doBearer(t, testURL, "") == http.StatusUnauthorized,
+		"Missing token should fail")
+	Assert(t, doBearer(t, testURL, "token2") == http.StatusOK,
+		"Valid token should work")
+	Assert(t, doBearer(t, testURL, "# comment") == http.StatusUnauthorized,
+		"Comment should not be a token")
+	Assert(t, doBearer(t, testURL, "bad") == http.StatusUnauthorized,
+		"Bad token should fail")
+
+	// JWTs
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Assert(t, err == nil, "Can't generate key: %s", err)
+	jwks := JWKS{Keys: []JWK{{
+		Kid: "key1",
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(
+			big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	// Same key but only for PS256, so RS256 tokens should fail
+	jwks.Keys = append(jwks.Keys, jwks.Keys[0])
+	jwks.Keys[1].Kid, jwks.Keys[1].Alg = "key3", "PS256"
+	buf, _ := json.Marshal(jwks)
+	ioutil.WriteFile(dir+"/jwks", buf, 0600)
+
+	ja, err := NewJWTAuthenticator(dir+"/jwks", "me", "osbdb")
+	Assert(t, err == nil, "Can't load JWKS: %s", err)
+	testServer.AddAuthenticator(ja)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := makeJWT(key, "key1", map[string]interface{}{
+		"iss": "me", "aud": []string{"x", "osbdb"}, "exp": exp})
+	Assert(t, doBearer(t, testURL, token) == http.StatusOK,
+		"Valid JWT should work")
+
+	token = makeJWT(key, "key1", map[string]interface{}{
+		"iss": "me", "aud": "osbdb", "exp": time.Now().Unix() - 10})
+	Assert(t, doBearer(t, testURL, token) == http.StatusUnauthorized,
+		"Expired JWT should fail")
+
+	token = makeJWT(key, "key1", map[string]interface{}{
+		"iss": "you", "aud": "osbdb", "exp": exp})
+	Assert(t, doBearer(t, testURL, token) == http.StatusUnauthorized,
+		"JWT with wrong issuer should fail")
+
+	token = makeJWT(key, "key2", map[string]interface{}{
+		"iss": "me", "aud": "osbdb", "exp": exp})
+	Assert(t, doBearer(t, testURL, token) == http.StatusUnauthorized,
+		"JWT with unknown key should fail")
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token = makeJWT(other, "key1", map[string]interface{}{
+		"iss": "me", "aud": "osbdb", "exp": exp})
+	Assert(t, doBearer(t, testURL, token) == http.StatusUnauthorized,
+		"JWT with bad signature should fail")
+
+	token = makeJWT(key, "key1", map[string]interface{}{
+		"iss": "me", "aud": "osbdb"})
+	Assert(t, doBearer(t, testURL, token) == http.StatusUnauthorized,
+		"JWT w/o exp should fail")
+
+	token = makeJWT(key, "key3", map[string]interface{}{
+		"iss": "me", "aud": "osbdb", "exp": exp})
+	Assert(t, doBearer(t, testURL, token) == http.StatusUnauthorized,
+		"JWT with the wrong alg for its key should fail")
+}
+
+func doVersion(t *testing.T, method, url, version string,
+	hdrs map[string]string) (int, string) {
+
+	req, err := http.NewRequest(method, url, nil)
+	Assert(t, err == nil, "Can't create request: %s", err)
+	req.SetBasicAuth(testUser, testPassword)
+	if version != "" {
+		req.Header.Set("X-Broker-API-Version", version)
+	}
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	Assert(t, err == nil, "Request failed: %s", err)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestAPIVersion(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/v2/catalog", testHost)
+
+	for _, v := range []string{"", "1.0", "2.10", "3.0", "two"} {
+		code, _ := doVersion(t, "GET", testURL, v, nil)
+		Assert(t, code == http.StatusPreconditionFailed,
+			"Version %q should fail, got %d", v, code)
+	}
+
+	code, body := doVersion(t, "GET", testURL, "2.13", nil)
+	Assert(t, code == http.StatusOK, "2.13 should work, got %d", code)
+	Assert(t, !strings.Contains(body, "maintenance_info"),
+		"2.13 catalog shouldn't have maintenance_info")
+
+	code, body = doVersion(t, "GET", testURL, "2.15", nil)
+	Assert(t, code == http.StatusOK, "2.15 should work, got %d", code)
+	Assert(t, strings.Contains(body, "maintenance_info"),
+		"2.15 catalog should have maintenance_info")
+
+	code, _ = doVersion(t, "GET", testURL, "2.99", nil)
+	Assert(t, code == http.StatusOK, "2.99 should work, got %d", code)
+
+	// Fetching an instance is only in 2.14+
+	iURL := fmt.Sprintf("http://%s/v2/service_instances/missing", testHost)
+	code, _ = doVersion(t, "GET", iURL, "2.13", nil)
+	Assert(t, code == http.StatusBadRequest, "Fetch on 2.13 should fail")
+	code, _ = doVersion(t, "GET", iURL, "2.14", nil)
+	Assert(t, code == http.StatusNotFound, "Fetch on 2.14 should 404")
+
+	code, _ = doVersion(t, "GET", testURL, "2.13", map[string]string{
+		"X-Broker-API-Originating-Identity": "cloudfoundry bad!"})
+	Assert(t, code == http.StatusBadRequest, "Bad identity should fail")
+
+	oi := base64.StdEncoding.EncodeToString([]byte(`{"user_id":"me"}`))
+	code, _ = doVersion(t, "GET", testURL, "2.13", map[string]string{
+		"X-Broker-API-Originating-Identity": "cloudfoundry " + oi})
+	Assert(t, code == http.StatusOK, "Good identity should work")
+
+	identity, err := ParseOriginatingIdentity("kubernetes " + oi)
+	Assert(t, err == nil, "Can't parse identity: %s", err)
+	Assert(t, identity.String() == "kubernetes/me",
+		"Wrong identity: %s", identity)
+}
+
+// One step of the OSB conformance suite. Steps are run in order since
+// later ones depend on the instances/bindings created by earlier ones.
+type osbTest struct {
+	name    string
+	method  string
+	path    string // relative to /v2
+	query   string
+	body    string
+	version string // defaults to "2.14"
+	noAuth  bool   // don't send any credentials
+	status  int
+	isError bool // response must be an OSB error ({"error":...})
+	check   func(t *testing.T, body map[string]interface{})
+}
+
+func (ot *osbTest) run(t *testing.T) {
+	url := fmt.Sprintf("http://%s/v2%s", testHost, ot.path)
+	if ot.query != "" {
+		url += "?" + ot.query
+	}
+
+	req, err := http.NewRequest(ot.method, url, strings.NewReader(ot.body))
+	Assert(t, err == nil, "%s: can't create request: %s", ot.name, err)
+	if !ot.noAuth {
+		req.SetBasicAuth(testUser, testPassword)
+	}
+	version := ot.version
+	if version == "" {
+		version = "2.14"
+	}
+	req.Header.Set("X-Broker-API-Version", version)
+
+	res, err := http.DefaultClient.Do(req)
+	Assert(t, err == nil, "%s: request failed: %s", ot.name, err)
+	defer res.Body.Close()
+	buf, _ := ioutil.ReadAll(res.Body)
+
+	Assert(t, res.StatusCode == ot.status, "%s: expected %d, got %d: %s",
+		ot.name, ot.status, res.StatusCode, buf)
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return
+	}
+
+	body := map[string]interface{}{}
+	err = json.Unmarshal(buf, &body)
+	Assert(t, err == nil, "%s: response isn't a JSON object: %s(%q)",
+		ot.name, err, buf)
+
+	errStr, _ := body["error"].(string)
+	if ot.isError {
+		Assert(t, errStr != "", "%s: missing 'error' in: %s", ot.name, buf)
+	} else {
+		Assert(t, errStr == "", "%s: unexpected error: %s", ot.name, buf)
+	}
+
+	if ot.check != nil {
+		ot.check(t, body)
+	}
+}
+
+func TestOSBConformance(t *testing.T) {
+	iPath := "/service_instances/osb-test-instance"
+	bPath := iPath + "/service_bindings/osb-test-binding"
+	ids := "service_id=service-1-id&plan_id=plan-1-id"
+	pBody := `{"service_id":"service-1-id","plan_id":"plan-1-id",` +
+		`"organization_guid":"org","space_guid":"space"}`
+
+	hasFields := func(obj string, fields ...string) func(*testing.T,
+		map[string]interface{}) {
+
+		return func(t *testing.T, body map[string]interface{}) {
+			m := body
+			if obj != "" {
+				m, _ = body[obj].(map[string]interface{})
+				Assert(t, m != nil, "Missing %q in: %v", obj, body)
+			}
+			for _, f := range fields {
+				Assert(t, m[f] != nil && m[f] != "", "Missing %q in: %v",
+					f, body)
+			}
+		}
+	}
+
+	tests := []osbTest{
+		// Catalog
+		{name: "catalog", method: "GET", path: "/catalog",
+			status: http.StatusOK,
+			check: func(t *testing.T, body map[string]interface{}) {
+				services, _ := body["services"].([]interface{})
+				Assert(t, len(services) > 0, "No services in catalog")
+				for _, s := range services {
+					svc := s.(map[string]interface{})
+					for _, f := range []string{"id", "name", "plans"} {
+						Assert(t, svc[f] != nil, "Missing %q in service", f)
+					}
+					plans, _ := svc["plans"].([]interface{})
+					Assert(t, len(plans) > 0, "No plans in service")
+				}
+			}},
+		{name: "catalog no auth", method: "GET", path: "/catalog",
+			noAuth: true, status: http.StatusUnauthorized},
+		{name: "catalog bad version", method: "GET", path: "/catalog",
+			version: "1.0", status: http.StatusPreconditionFailed,
+			isError: true},
+		{name: "catalog bad version no auth", method: "GET",
+			path: "/catalog", version: "1.0", noAuth: true,
+			status: http.StatusUnauthorized},
+
+		// Provision
+		{name: "provision bad json", method: "PUT", path: iPath,
+			body: "{", status: http.StatusBadRequest, isError: true},
+		{name: "provision no service_id", method: "PUT", path: iPath,
+			body:   `{"plan_id":"plan-1-id"}`,
+			status: http.StatusBadRequest, isError: true},
+		{name: "provision no plan_id", method: "PUT", path: iPath,
+			body:   `{"service_id":"service-1-id"}`,
+			status: http.StatusBadRequest, isError: true},
+		{name: "provision bad plan", method: "PUT", path: iPath,
+			body:   `{"service_id":"service-1-id","plan_id":"x"}`,
+			status: http.StatusBadRequest, isError: true},
+		{name: "provision no auth", method: "PUT", path: iPath,
+			body: pBody, noAuth: true, status: http.StatusUnauthorized},
+		{name: "provision", method: "PUT", path: iPath, body: pBody,
+			status: http.StatusCreated},
+		{name: "provision again", method: "PUT", path: iPath, body: pBody,
+			status: http.StatusOK},
+		{name: "provision conflict", method: "PUT", path: iPath,
+			body: `{"service_id":"service-1-id","plan_id":"plan-1-id",` +
+				`"parameters":{"a":"b"}}`,
+			status: http.StatusConflict, isError: true},
+		{name: "fetch instance", method: "GET", path: iPath,
+			status: http.StatusOK,
+			check:  hasFields("", "service_id", "plan_id")},
+		{name: "fetch instance old version", method: "GET", path: iPath,
+			version: "2.13", status: http.StatusBadRequest, isError: true},
+
+		// Update
+		{name: "update", method: "PATCH", path: iPath,
+			body: `{"service_id":"service-1-id"}`, status: http.StatusOK},
+
+		// Bind
+		{name: "bind missing instance", method: "PUT",
+			path: "/service_instances/missing/service_bindings/b1",
+			body: pBody, status: http.StatusGone, isError: true},
+		{name: "bind no auth", method: "PUT", path: bPath, body: pBody,
+			noAuth: true, status: http.StatusUnauthorized},
+		{name: "bind", method: "PUT", path: bPath, body: pBody,
+			status: http.StatusCreated,
+			check:  hasFields("credentials", "url", "user", "password")},
+		{name: "bind again", method: "PUT", path: bPath, body: pBody,
+			status: http.StatusOK,
+			check:  hasFields("credentials", "url", "user", "password")},
+		{name: "bind conflict", method: "PUT", path: bPath,
+			body: `{"service_id":"service-1-id","plan_id":"plan-1-id",` +
+				`"parameters":{"a":"b"}}`,
+			status: http.StatusConflict, isError: true},
+		{name: "bind bad json", method: "PUT", path: iPath +
+			"/service_bindings/b2", body: "{",
+			status: http.StatusBadRequest, isError: true},
+		{name: "fetch binding", method: "GET", path: bPath,
+			status: http.StatusOK,
+			check:  hasFields("credentials", "url", "user", "password")},
+		{name: "fetch missing binding", method: "GET",
+			path:   iPath + "/service_bindings/missing",
+			status: http.StatusNotFound, isError: true},
+
+		// Unbind
+		{name: "unbind no service_id", method: "DELETE", path: bPath,
+			query: "plan_id=plan-1-id", status: http.StatusBadRequest,
+			isError: true},
+		{name: "unbind no plan_id", method: "DELETE", path: bPath,
+			query: "service_id=service-1-id", status: http.StatusBadRequest,
+			isError: true},
+		{name: "unbind missing instance", method: "DELETE",
+			path:  "/service_instances/missing/service_bindings/b1",
+			query: ids, status: http.StatusGone, isError: true},
+		{name: "unbind missing binding", method: "DELETE",
+			path:  iPath + "/service_bindings/missing",
+			query: ids, status: http.StatusGone, isError: true},
+		{name: "unbind no auth", method: "DELETE", path: bPath, query: ids,
+			noAuth: true, status: http.StatusUnauthorized},
+		{name: "unbind", method: "DELETE", path: bPath, query: ids,
+			status: http.StatusOK},
+		{name: "unbind again", method: "DELETE", path: bPath, query: ids,
+			status: http.StatusGone, isError: true},
+
+		// Deprovision
+		{name: "deprovision no service_id", method: "DELETE", path: iPath,
+			query: "plan_id=plan-1-id", status: http.StatusBadRequest,
+			isError: true},
+		{name: "deprovision no plan_id", method: "DELETE", path: iPath,
+			query: "service_id=service-1-id", status: http.StatusBadRequest,
+			isError: true},
+		{name: "deprovision no auth", method: "DELETE", path: iPath,
+			query: ids, noAuth: true, status: http.StatusUnauthorized},
+		{name: "deprovision", method: "DELETE", path: iPath, query: ids,
+			status: http.StatusOK},
+		{name: "deprovision again", method: "DELETE", path: iPath,
+			query: ids, status: http.StatusGone, isError: true},
+		{name: "fetch deleted instance", method: "GET", path: iPath,
+			status: http.StatusNotFound, isError: true},
+	}
+
+	for _, test := range tests {
+		if testServer.config.DisableAuth && test.status == http.StatusUnauthorized {
+			continue
+		}
+		test.run(t)
+	}
+}
+
+func TestShutdownSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		BrokerUser:     testUser,
+		BrokerPassword: testPassword,
+		DataDir:        dir,
+	}
+	srv := mustServer(t, config)
+	ts := httptest.NewServer(srv)
+
+	db, err := dbclient.NewDB(ts.URL+"/db", testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	err = db.Set("key1", "value1")
+	Assert(t, err == nil, "Error setting key: %s", err)
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/v2/service_instances/i1",
+		strings.NewReader(`{"service_id":"service-1-id",`+
+			`"plan_id":"plan-1-id"}`))
+	req.SetBasicAuth(testUser, testPassword)
+	req.Header.Set("X-Broker-API-Version", "2.14")
+	res, err := http.DefaultClient.Do(req)
+	Assert(t, err == nil && res.StatusCode == http.StatusCreated,
+		"Error provisioning: %v %v", err, res)
+	res.Body.Close()
+	bind := func(url string) int {
+		req, _ := http.NewRequest("PUT", url+
+			"/v2/service_instances/i1/service_bindings/b1",
+			strings.NewReader(`{"service_id":"service-1-id",`+
+				`"plan_id":"plan-1-id","parameters":{"a":"b"}}`))
+		req.SetBasicAuth(testUser, testPassword)
+		req.Header.Set("X-Broker-API-Version", "2.14")
+		res, err := http.DefaultClient.Do(req)
+		Assert(t, err == nil, "Error binding: %s", err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	code := bind(ts.URL)
+	Assert(t, code == http.StatusCreated, "Error binding: %d", code)
+	ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	Assert(t, err == nil, "Error shutting down: %s", err)
+
+	select {
+	case <-srv.Done():
+	default:
+		Assert(t, false, "Done() should be closed after Shutdown")
+	}
+
+	_, err = os.Stat(dir + "/" + SnapshotFile)
+	Assert(t, err == nil, "Snapshot wasn't saved: %s", err)
+
+	// Now bring up a new server from the snapshot
+	srv2 := mustServer(t, config)
+	err = srv2.LoadSnapshot()
+	Assert(t, err == nil, "Error loading snapshot: %s", err)
+	Assert(t, len(srv2.DBs) == 2, "Should have 2 DBs, got %d", len(srv2.DBs))
+	Assert(t, srv2.Instances["i1"] != nil, "Missing instance i1")
+
+	ts2 := httptest.NewServer(srv2)
+	defer ts2.Close()
+
+	// The binding's parameters should be remembered too
+	code = bind(ts2.URL)
+	Assert(t, code == http.StatusOK, "Same bind should be ok: %d", code)
+
+	db.URL = ts2.URL + "/db/" + db.GetID()
+	val, err := db.Get("key1")
+	Assert(t, err == nil, "Error getting key: %s", err)
+	Assert(t, val == "value1", "Wrong value: %q", val)
+
+	// New DBs shouldn't reuse old IDs
+	db2, err := dbclient.NewDB(ts2.URL+"/db", testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	Assert(t, db2.GetID() == "3", "Wrong ID for new DB: %s", db2.GetID())
+}
+
+func getHealth(t *testing.T, url string) (int, *HealthResult) {
+	res, err := http.Get(url)
+	Assert(t, err == nil, "Error getting %s: %s", url, err)
+	defer res.Body.Close()
+
+	hr := &HealthResult{}
+	err = json.NewDecoder(res.Body).Decode(hr)
+	Assert(t, err == nil, "Bad JSON from %s: %s", url, err)
+	return res.StatusCode, hr
+}
+
+func TestHealth(t *testing.T) {
+	code, hr := getHealth(t, fmt.Sprintf("http://%s/healthz", testHost))
+	Assert(t, code == http.StatusOK, "healthz failed: %d", code)
+	Assert(t, hr.Status == "ok", "healthz status: %s", hr.Status)
+	Assert(t, hr.Checks["store"].Status == "ok", "store check failed")
+
+	code, hr = getHealth(t, fmt.Sprintf("http://%s/readyz", testHost))
+	Assert(t, code == http.StatusOK, "readyz failed: %d", code)
+	Assert(t, hr.Checks["persistence"].Status == "disabled",
+		"persistence should be disabled")
+	Assert(t, hr.Checks["listener"].Status == "disabled",
+		"listener should be disabled")
+	Assert(t, hr.Checks["disk"].Status == "ok", "disk check failed")
+
+	// Password should never show up in /info
+	res, err := http.Get(fmt.Sprintf("http://%s/info", testHost))
+	Assert(t, err == nil, "Error getting /info: %s", err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	Assert(t, !strings.Contains(string(body), testPassword),
+		"/info shows the password: %s", body)
+
+	// Not ready once we're shutting down
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+
+	srv := mustServer(t, Config{DataDir: dir})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	code, hr = getHealth(t, ts.URL+"/readyz")
+	Assert(t, code == http.StatusOK, "readyz failed: %d", code)
+	Assert(t, hr.Checks["persistence"].Status == "ok",
+		"persistence check failed: %s", hr.Checks["persistence"].Error)
+
+	srv.Shutdown(context.Background())
+	code, hr = getHealth(t, ts.URL+"/readyz")
+	Assert(t, code == http.StatusServiceUnavailable,
+		"readyz should fail while shutting down: %d", code)
+	Assert(t, hr.Checks["listener"].Status == "failed",
+		"listener check should fail")
+
+	code, _ = getHealth(t, ts.URL+"/healthz")
+	Assert(t, code == http.StatusOK, "healthz failed: %d", code)
+}
+
+func TestHealthHung(t *testing.T) {
+	defer func(d time.Duration) { HealthCheckTimeout = d }(HealthCheckTimeout)
+	HealthCheckTimeout = 10 * time.Millisecond
+
+	srv := mustServer(t, Config{})
+	_, err := srv.NewDBWithStorage(httptest.NewRequest("PUT", "/db", nil),
+		StorageMemory)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	// While the DBs are stuck, checks time out but don't pile up
+	srv.dbMapMutex.Lock()
+	for i := 0; i < 5; i++ {
+		res := srv.CheckStore()
+		Assert(t, res.Status == "failed", "Should time out: %#v", res)
+	}
+	srv.checkMutex.Lock()
+	n := len(srv.runningChecks)
+	srv.checkMutex.Unlock()
+	Assert(t, n == 1, "Should be 1 running check, not %d", n)
+	srv.dbMapMutex.Unlock()
+
+	HealthCheckTimeout = time.Second
+	res := srv.CheckStore()
+	Assert(t, res.Status == "ok", "Should work again: %#v", res)
+	res = srv.CheckDisk()
+	Assert(t, res.Status == "ok", "Disk check failed: %#v", res)
+}
+
+func TestKeysAndWatch(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	keys, err := db.Keys("")
+	Assert(t, err == nil, "Error getting keys: %s", err)
+	Assert(t, len(keys) == 0, "Should have no keys: %v", keys)
+
+	events := make(chan *dbclient.WatchEvent, 10)
+	go func() {
+		db.Watch("a", func(ev *dbclient.WatchEvent) bool {
+			events <- ev
+			return true
+		})
+		close(events)
+	}()
+
+	// Wait for the watch to be registered
+	for i := 0; i < 100; i++ {
+		dbs := testServer.DBs[db.GetID()]
+		dbs.mutex.Lock()
+		n := len(dbs.watchers)
+		dbs.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	db.Set("b1", "x")
+	db.Set("a2", "y")
+	db.Set("a1", "z")
+	db.SetAsBytes("a3", nil)
+	db.DeleteKey("a2")
+
+	keys, err = db.Keys("")
+	Assert(t, err == nil, "Error getting keys: %s", err)
+	Assert(t, strings.Join(keys, ",") == "a1,a3,b1", "Wrong keys: %v", keys)
+
+	keys, err = db.Keys("a")
+	Assert(t, err == nil, "Error getting keys: %s", err)
+	Assert(t, strings.Join(keys, ",") == "a1,a3", "Wrong keys: %v", keys)
+
+	// Deleting the DB should end the watch
+	err = db.DeleteDB()
+	Assert(t, err == nil, "Error deleting DB: %s", err)
+
+	got := []string{}
+	for ev := range events {
+		got = append(got, fmt.Sprintf("%s:%s:%s:%v", ev.Op, ev.Key,
+			ev.Value, ev.Null))
+	}
+	Assert(t, strings.Join(got, ",") ==
+		"set:a2:y:false,set:a1:z:false,set:a3::true,delete:a2::false",
+		"Wrong events: %v", got)
+}
+
+func TestListInstances(t *testing.T) {
+	url := fmt.Sprintf("http://%s/admin/instances", testHost)
+
+	instances, err := dbclient.GetInstances(url, testUser, testPassword)
+	Assert(t, err == nil, "Error getting instances: %s", err)
+	Assert(t, len(instances) == 0, "Should have no instances")
+
+	osbTests := []osbTest{
+		{name: "provision", method: "PUT", path: "/service_instances/list1",
+			body:   `{"service_id":"service-1-id","plan_id":"plan-1-id"}`,
+			status: http.StatusCreated},
+		{name: "bind", method: "PUT",
+			path:   "/service_instances/list1/service_bindings/b1",
+			body:   `{"service_id":"service-1-id","plan_id":"plan-1-id"}`,
+			status: http.StatusCreated},
+	}
+	for _, test := range osbTests {
+		test.run(t)
+	}
+
+	instances, err = dbclient.GetInstances(url, testUser, testPassword)
+	Assert(t, err == nil, "Error getting instances: %s", err)
+	Assert(t, len(instances) == 1, "Should have 1 instance")
+	Assert(t, instances[0].ID == "list1", "Wrong ID: %s", instances[0].ID)
+	Assert(t, instances[0].PlanID == "plan-1-id", "Wrong plan")
+	Assert(t, len(instances[0].Bindings) == 1, "Should have 1 binding")
+
+	if !testServer.config.DisableAuth {
+		_, err = dbclient.GetInstances(url, testUser, "bad")
+		Assert(t, err != nil, "Bad password should fail")
+	}
+
+	deprovision := osbTest{name: "deprovision", method: "DELETE",
+		path:   "/service_instances/list1",
+		query:  "service_id=service-1-id&plan_id=plan-1-id",
+		status: http.StatusOK}
+	deprovision.run(t)
+}
+
+func TestLargeValues(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	// 5MB, sent chunked
+	value := make([]byte, 5*1024*1024)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+	err = db.SetReader(ctx, "big", bytes.NewReader(value), -1)
+	Assert(t, err == nil, "Error setting big value: %s", err)
+
+	rc, err := db.GetReader(ctx, "big")
+	Assert(t, err == nil, "Error getting big value: %s", err)
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	Assert(t, bytes.Equal(got, value), "Big value is wrong, len: %d",
+		len(got))
+
+	rc, err = db.GetRangeReader(ctx, "big", 1000, 10)
+	Assert(t, err == nil, "Error getting range: %s", err)
+	got, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	Assert(t, bytes.Equal(got, value[1000:1010]), "Range is wrong: %v", got)
+
+	rc, err = db.GetRangeReader(ctx, "big", int64(len(value)-5), -1)
+	Assert(t, err == nil, "Error getting range: %s", err)
+	got, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	Assert(t, bytes.Equal(got, value[len(value)-5:]), "Range is wrong: %v",
+		got)
+
+	// Check the raw response headers too
+	req, _ := http.NewRequest("GET", db.URL+"/big", nil)
+	req.SetBasicAuth(db.User, db.Password)
+	req.Header.Set("Range", "bytes=0-99")
+	res, err := http.DefaultClient.Do(req)
+	Assert(t, err == nil, "Error getting range: %s", err)
+	res.Body.Close()
+	Assert(t, res.StatusCode == http.StatusPartialContent, "Bad code: %d",
+		res.StatusCode)
+	Assert(t, res.ContentLength == 100, "Bad length: %d", res.ContentLength)
+	Assert(t, res.Header.Get("Content-Range") ==
+		fmt.Sprintf("bytes 0-99/%d", len(value)), "Bad Content-Range: %s",
+		res.Header.Get("Content-Range"))
+
+	// Empty values aren't nil
+	err = db.SetReader(ctx, "empty", bytes.NewReader(nil), 0)
+	Assert(t, err == nil, "Error setting empty value: %s", err)
+	v, err := db.GetAsBytes("empty")
+	Assert(t, err == nil && v != nil && len(v) == 0, "Bad empty: %v %s",
+		v, err)
+
+	// Too big, with and w/o a Content-Length
+	saveMax := testServer.config.MaxValueSize
+	testServer.config.MaxValueSize = 1024
+	defer func() { testServer.config.MaxValueSize = saveMax }()
+
+	err = db.SetAsBytes("toobig", value[:2048])
+	Assert(t, dbclient.StatusCode(err) == http.StatusRequestEntityTooLarge,
+		"Should be too large: %v", err)
+	err = db.SetReader(ctx, "toobig", bytes.NewReader(value[:2048]), -1)
+	Assert(t, dbclient.StatusCode(err) == http.StatusRequestEntityTooLarge,
+		"Should be too large: %v", err)
+	_, err = db.Get("toobig")
+	Assert(t, err != nil, "toobig shouldn't be there")
+}
+
+func TestMetadata(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	err = db.SetWithMetadata(ctx, "doc", []byte(`{"a":1}`),
+		&dbclient.Metadata{
+			ContentType: "application/json",
+			Meta:        map[string]string{"Owner": "bob", "Tag": "x"},
+		})
+	Assert(t, err == nil, "Error setting doc: %s", err)
+
+	v, md, err := db.GetWithMetadata(ctx, "doc")
+	Assert(t, err == nil, "Error getting doc: %s", err)
+	Assert(t, string(v) == `{"a":1}`, "Bad value: %s", v)
+	Assert(t, md.ContentType == "application/json", "Bad type: %s",
+		md.ContentType)
+	Assert(t, len(md.Meta) == 2 && md.Meta["Owner"] == "bob" &&
+		md.Meta["Tag"] == "x", "Bad meta: %v", md.Meta)
+	Assert(t, !md.Modified.IsZero(), "Missing Last-Modified")
+
+	md, err = db.Head(ctx, "doc")
+	Assert(t, err == nil, "Error on HEAD: %s", err)
+	Assert(t, md.Size == 7 && md.ContentType == "application/json" &&
+		md.Meta["Owner"] == "bob", "Bad HEAD: %#v", md)
+
+	_, err = db.Head(ctx, "missing")
+	Assert(t, dbclient.StatusCode(err) == http.StatusNotFound,
+		"HEAD of missing key should 404: %v", err)
+
+	// W/o a Content-Type it should be sniffed, like before
+	err = db.Set("text", "hello")
+	Assert(t, err == nil, "Error setting text: %s", err)
+	_, md, err = db.GetWithMetadata(ctx, "text")
+	Assert(t, err == nil, "Error getting text: %s", err)
+	Assert(t, strings.HasPrefix(md.ContentType, "text/plain"),
+		"Bad sniffed type: %s", md.ContentType)
+	Assert(t, len(md.Meta) == 0, "Should have no meta: %v", md.Meta)
+
+	// Overwriting replaces the metadata too
+	err = db.SetWithMetadata(ctx, "doc", []byte("<p>"),
+		&dbclient.Metadata{ContentType: "text/html"})
+	Assert(t, err == nil, "Error setting doc: %s", err)
+	md, err = db.Head(ctx, "doc")
+	Assert(t, err == nil, "Error on HEAD: %s", err)
+	Assert(t, md.ContentType == "text/html" && len(md.Meta) == 0,
+		"Bad HEAD: %#v", md)
+
+	// Metadata should survive a snapshot
+	snap := testServer.TakeSnapshot()
+	dbID := db.GetID()
+	for _, ds := range snap.DBs {
+		if ds.ID == dbID {
+			Assert(t, ds.Meta["doc"].ContentType == "text/html",
+				"Bad snapshot meta: %#v", ds.Meta["doc"])
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	for i := 1; i <= DefaultMaxVersions+2; i++ {
+		err = db.Set("k", fmt.Sprintf("v%d", i))
+		Assert(t, err == nil, "Error setting k: %s", err)
+	}
+
+	// Only the newest DefaultMaxVersions old ones are kept
+	list, err := db.History(ctx, "k")
+	Assert(t, err == nil, "Error getting history: %s", err)
+	Assert(t, len(list) == DefaultMaxVersions+1, "Wrong # of versions: %d",
+		len(list))
+	Assert(t, list[0].Version == 2, "Oldest should be 2: %d",
+		list[0].Version)
+	last := list[len(list)-1]
+	Assert(t, last.Current && last.Version == DefaultMaxVersions+2,
+		"Bad current version: %#v", last)
+
+	v, md, err := db.GetVersion(ctx, "k", 3)
+	Assert(t, err == nil, "Error getting version: %s", err)
+	Assert(t, string(v) == "v3" && md.Version == 3, "Bad version 3: %s %d",
+		v, md.Version)
+
+	_, _, err = db.GetVersion(ctx, "k", 1)
+	Assert(t, errors.Is(err, dbclient.ErrNotFound),
+		"Version 1 should be gone: %v", err)
+
+	// Restoring makes a new version
+	ver, err := db.Restore(ctx, "k", 3)
+	Assert(t, err == nil, "Error restoring: %s", err)
+	Assert(t, ver == DefaultMaxVersions+3, "Bad new version: %d", ver)
+	v, md, err = db.GetWithMetadata(ctx, "k")
+	Assert(t, err == nil && string(v) == "v3" && md.Version == ver,
+		"Bad restore: %s %v %s", v, md, err)
+
+	// Deleted keys can be brought back
+	err = db.DeleteKey("k")
+	Assert(t, err == nil, "Error deleting: %s", err)
+	_, err = db.Get("k")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "k should be gone")
+
+	list, err = db.History(ctx, "k")
+	Assert(t, err == nil, "Error getting history: %s", err)
+	for _, vi := range list {
+		Assert(t, !vi.Current, "Nothing should be current: %#v", vi)
+	}
+
+	_, err = db.Restore(ctx, "k", ver)
+	Assert(t, err == nil, "Error restoring: %s", err)
+	val, err := db.Get("k")
+	Assert(t, err == nil && val == "v3", "Bad undelete: %s %s", val, err)
+
+	_, err = db.History(ctx, "never")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "Should be not found")
+	_, err = db.Restore(ctx, "k", 999)
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "Should be not found")
+}
+
+func TestCounters(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	n, err := db.Incr(ctx, "c", 1)
+	Assert(t, err == nil && n == 1, "Bad incr: %d %s", n, err)
+	n, err = db.Decr(ctx, "c", 5)
+	Assert(t, err == nil && n == -4, "Bad decr: %d %s", n, err)
+	v, err := db.Get("c")
+	Assert(t, err == nil && v == "-4", "Bad value: %q %s", v, err)
+
+	// Lots of concurrent incrs shouldn't lose any updates
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		go func() {
+			_, err := db.Incr(ctx, "c", 2)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		Assert(t, <-errs == nil, "Error in incr")
+	}
+	v, _ = db.Get("c")
+	Assert(t, v == "96", "Lost some updates: %s", v)
+
+	n, err = db.SetMax(ctx, "c", 50)
+	Assert(t, err == nil && n == 96, "max shouldn't change it: %d %s", n,
+		err)
+	n, err = db.SetMin(ctx, "c", 50)
+	Assert(t, err == nil && n == 50, "Bad min: %d %s", n, err)
+	n, err = db.SetMax(ctx, "hi", 7)
+	Assert(t, err == nil && n == 7, "Bad max of missing key: %d %s", n, err)
+
+	db.Set("str", "hello")
+	_, err = db.Incr(ctx, "str", 1)
+	Assert(t, errors.Is(err, dbclient.ErrConflict),
+		"Incr of a string should fail: %v", err)
+
+	db.Set("big", "9223372036854775807")
+	_, err = db.Incr(ctx, "big", 1)
+	Assert(t, errors.Is(err, dbclient.ErrConflict),
+		"Overflow should fail: %v", err)
+}
+
+func TestLists(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	n, err := db.RPush(ctx, "q", []byte("b"))
+	Assert(t, err == nil && n == 1, "Bad rpush: %d %s", n, err)
+	db.RPush(ctx, "q", []byte("c"))
+	n, err = db.LPush(ctx, "q", []byte("a"))
+	Assert(t, err == nil && n == 3, "Bad lpush: %d %s", n, err)
+
+	items, err := db.LRange(ctx, "q", 0, -1)
+	Assert(t, err == nil && len(items) == 3, "Bad range: %v %s", items, err)
+	Assert(t, string(items[0]) == "a" && string(items[2]) == "c",
+		"Wrong order: %q", items)
+	items, _ = db.LRange(ctx, "q", -2, -2)
+	Assert(t, len(items) == 1 && string(items[0]) == "b", "Bad range: %q",
+		items)
+	n, err = db.LLen(ctx, "q")
+	Assert(t, err == nil && n == 3, "Bad len: %d %s", n, err)
+
+	// Lists aren't plain values
+	_, err = db.Get("q")
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Get should fail: %v",
+		err)
+	db.Set("str", "x")
+	_, err = db.RPush(ctx, "str", []byte("x"))
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Push should fail: %v",
+		err)
+
+	item, err := db.LPop(ctx, "q")
+	Assert(t, err == nil && string(item) == "a", "Bad lpop: %s %s", item,
+		err)
+	item, err = db.RPop(ctx, "q")
+	Assert(t, err == nil && string(item) == "c", "Bad rpop: %s %s", item,
+		err)
+	db.LPop(ctx, "q")
+
+	// Empty lists go away
+	_, err = db.LPop(ctx, "q")
+	Assert(t, err == dbclient.ErrEmpty, "Should be empty: %v", err)
+	keys, _ := db.Keys("q")
+	Assert(t, len(keys) == 0, "Empty list should be gone: %v", keys)
+
+	// Blocking pop should wait for a push
+	got := make(chan string)
+	go func() {
+		item, err := db.BLPop(ctx, "q", 5*time.Second)
+		got <- fmt.Sprintf("%s %v", item, err)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	db.RPush(ctx, "q", []byte("job1"))
+	select {
+	case res := <-got:
+		Assert(t, res == "job1 <nil>", "Bad blocking pop: %s", res)
+	case <-time.After(5 * time.Second):
+		Assert(t, false, "Blocking pop didn't return")
+	}
+
+	start := time.Now()
+	_, err = db.BRPop(ctx, "q", 100*time.Millisecond)
+	Assert(t, err == dbclient.ErrEmpty, "Should have timed out: %v", err)
+	Assert(t, time.Since(start) >= 100*time.Millisecond,
+		"Didn't wait long enough")
+
+	// Pushing onto either end shouldn't copy the whole list each time
+	v := &Value{Type: TypeList}
+	want, grows := []string{}, 0
+	for i := 0; i < 1000; i++ {
+		item := fmt.Sprintf("%d", i)
+		if i%3 == 0 {
+			v.List = append(v.List, []byte(item))
+			want = append(want, item)
+			continue
+		}
+		buf := v.listBuf
+		v.pushFront([]byte(item))
+		want = append([]string{item}, want...)
+		if len(buf) != len(v.listBuf) {
+			grows++
+		}
+	}
+	Assert(t, grows < 20, "List grew too often: %d", grows)
+	for i, item := range v.List {
+		Assert(t, string(item) == want[i], "Bad item %d: %q", i, item)
+	}
+	Assert(t, len(v.List) == len(want), "Bad length: %d", len(v.List))
+
+	// Lists should survive a snapshot
+	db.RPush(ctx, "saved", []byte("x"))
+	snap := testServer.TakeSnapshot()
+	for _, ds := range snap.DBs {
+		if ds.ID == db.GetID() {
+			v := ds.Typed["saved"]
+			Assert(t, v != nil && v.Type == TypeList && len(v.List) == 1,
+				"List missing from snapshot: %#v", v)
+		}
+	}
+}
+
+func TestHashesAndSets(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	n, err := db.HSet(ctx, "user:1", "name", []byte("bob"))
+	Assert(t, err == nil && n == 1, "Bad hset: %d %s", n, err)
+	n, err = db.HSet(ctx, "user:1", "email/work", []byte("b@x.com"))
+	Assert(t, err == nil && n == 2, "Bad hset: %d %s", n, err)
+
+	v, err := db.HGet(ctx, "user:1", "email/work")
+	Assert(t, err == nil && string(v) == "b@x.com", "Bad hget: %s %s", v,
+		err)
+	_, err = db.HGet(ctx, "user:1", "missing")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "Should be missing: %v",
+		err)
+
+	all, err := db.HGetAll(ctx, "user:1")
+	Assert(t, err == nil && len(all) == 2 && string(all["name"]) == "bob",
+		"Bad hgetall: %v %s", all, err)
+
+	err = db.HDel(ctx, "user:1", "name")
+	Assert(t, err == nil, "Bad hdel: %s", err)
+	err = db.HDel(ctx, "user:1", "email/work")
+	Assert(t, err == nil, "Bad hdel: %s", err)
+	keys, _ := db.Keys("user")
+	Assert(t, len(keys) == 0, "Empty hash should be gone: %v", keys)
+
+	n, err = db.SAdd(ctx, "s1", "a")
+	Assert(t, err == nil && n == 1, "Bad sadd: %d %s", n, err)
+	db.SAdd(ctx, "s1", "b")
+	n, _ = db.SAdd(ctx, "s1", "b")
+	Assert(t, n == 2, "Dup member shouldn't count: %d", n)
+	db.SAdd(ctx, "s2", "b")
+	db.SAdd(ctx, "s2", "c")
+
+	members, err := db.SMembers(ctx, "s1")
+	Assert(t, err == nil && strings.Join(members, ",") == "a,b",
+		"Bad members: %v %s", members, err)
+	members, err = db.SUnion(ctx, "s1", "s2", "nope")
+	Assert(t, err == nil && strings.Join(members, ",") == "a,b,c",
+		"Bad union: %v %s", members, err)
+	members, err = db.SInter(ctx, "s1", "s2")
+	Assert(t, err == nil && strings.Join(members, ",") == "b",
+		"Bad inter: %v %s", members, err)
+
+	ok, err := db.SIsMember(ctx, "s1", "a")
+	Assert(t, err == nil && ok, "a should be a member: %s", err)
+	ok, err = db.SIsMember(ctx, "s1", "c")
+	Assert(t, err == nil && !ok, "c shouldn't be a member: %s", err)
+
+	err = db.SRem(ctx, "s1", "a")
+	Assert(t, err == nil, "Bad srem: %s", err)
+	err = db.SRem(ctx, "s1", "a")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "Should be missing: %v",
+		err)
+
+	// Types can't be mixed
+	_, err = db.SAdd(ctx, "s1", "x")
+	Assert(t, err == nil, "Bad sadd: %s", err)
+	_, err = db.HSet(ctx, "s1", "x", nil)
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Should conflict: %v",
+		err)
+	_, err = db.SUnion(ctx, "s1", "s2")
+	Assert(t, err == nil, "Bad union: %s", err)
+	db.RPush(ctx, "l", []byte("x"))
+	_, err = db.SUnion(ctx, "s1", "l")
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Should conflict: %v",
+		err)
+
+	// Deleting the key works for any type
+	err = db.DeleteKey("s2")
+	Assert(t, err == nil, "Error deleting set: %s", err)
+	members, _ = db.SMembers(ctx, "s2")
+	Assert(t, len(members) == 0, "Set should be gone: %v", members)
+}
+
+func TestSortedSets(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	scores := map[string]float64{"amy": 30, "bob": 10, "cat": 20, "dan": 20}
+	for member, score := range scores {
+		_, err = db.ZAdd(ctx, "board", member, score)
+		Assert(t, err == nil, "Bad zadd: %s", err)
+	}
+	n, err := db.ZAdd(ctx, "board", "bob", 5)
+	Assert(t, err == nil && n == 4, "Re-add shouldn't count: %d %s", n, err)
+
+	names := func(items []dbclient.ZItem) string {
+		list := []string{}
+		for _, item := range items {
+			list = append(list, item.Member)
+		}
+		return strings.Join(list, ",")
+	}
+
+	items, err := db.ZRange(ctx, "board", 0, -1, false)
+	Assert(t, err == nil && names(items) == "bob,cat,dan,amy",
+		"Bad zrange: %v %s", items, err)
+	items, _ = db.ZRange(ctx, "board", 0, 1, true)
+	Assert(t, names(items) == "amy,dan", "Bad rev zrange: %v", items)
+
+	items, _ = db.ZRangeByScore(ctx, "board", 20, 30, false, 0)
+	Assert(t, names(items) == "cat,dan,amy", "Bad by score: %v", items)
+	items, _ = db.ZRangeByScore(ctx, "board", math.Inf(-1), 20, true, 2)
+	Assert(t, names(items) == "dan,cat", "Bad rev by score: %v", items)
+	items, _ = db.ZRangeByScore(ctx, "board", 100, math.Inf(1), false, 0)
+	Assert(t, len(items) == 0, "Should be empty: %v", items)
+
+	score, err := db.ZIncr(ctx, "board", "bob", 100)
+	Assert(t, err == nil && score == 105, "Bad zincr: %v %s", score, err)
+	info, err := db.ZRank(ctx, "board", "bob", false)
+	Assert(t, err == nil && info.Rank == 3 && info.Score == 105,
+		"Bad zrank: %#v %s", info, err)
+	info, _ = db.ZRank(ctx, "board", "bob", true)
+	Assert(t, info.Rank == 0, "Bad rev zrank: %#v", info)
+	_, err = db.ZRank(ctx, "board", "nope", false)
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "Should be missing: %v",
+		err)
+
+	_, err = db.ZAdd(ctx, "board", "x", math.Inf(1))
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Should conflict: %v",
+		err)
+	_, err = db.HSet(ctx, "board", "x", nil)
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Should conflict: %v",
+		err)
+
+	// Sorted sets should survive a snapshot
+	snap := testServer.TakeSnapshot()
+	buf, err := json.Marshal(snap)
+	Assert(t, err == nil, "Error saving snapshot: %s", err)
+	snap = &Snapshot{}
+	err = json.Unmarshal(buf, snap)
+	Assert(t, err == nil, "Error loading snapshot: %s", err)
+	for _, ds := range snap.DBs {
+		if ds.ID == db.GetID() {
+			v := ds.Typed["board"]
+			Assert(t, v != nil && v.Type == TypeZSet,
+				"Sorted set missing from snapshot: %#v", v)
+			rank, _ := v.ZSet.Rank("cat", false)
+			Assert(t, v.ZSet.Len() == 4 && rank == 0,
+				"Bad sorted set in snapshot: %d %d", v.ZSet.Len(), rank)
+		}
+	}
+
+	for member := range scores {
+		err = db.ZRem(ctx, "board", member)
+		Assert(t, err == nil, "Bad zrem: %s", err)
+	}
+	err = db.ZRem(ctx, "board", "bob")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "Should be missing: %v",
+		err)
+	keys, _ := db.Keys("board")
+	Assert(t, len(keys) == 0, "Empty sorted set should be gone: %v", keys)
+}
+
+func TestPubSub(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	n, err := db.Publish(ctx, "chat", []byte("anyone?"))
+	Assert(t, err == nil && n == 0, "Shouldn't be subscribers: %d %s", n,
+		err)
+
+	msgs := make(chan *dbclient.Message, 1000)
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- db.Subscribe(ctx, "chat/room 1",
+				func(msg *dbclient.Message) bool {
+					msgs <- msg
+					return true
+				})
+		}()
+	}
+
+	// Wait for both subscriptions to be set up
+	for start := time.Now(); n != 2; time.Sleep(10 * time.Millisecond) {
+		Assert(t, time.Since(start) < 5*time.Second, "Subscribe failed")
+		n, err = db.Publish(ctx, "chat/room 1", []byte("ping"))
+		Assert(t, err == nil, "Error publishing: %s", err)
+	}
+
+	n, err = db.Publish(ctx, "chat/room 1", []byte("hi\nthere"))
+	Assert(t, err == nil && n == 2, "Bad publish: %d %s", n, err)
+	for i := 0; i < 2; {
+		select {
+		case msg := <-msgs:
+			if string(msg.Data) == "ping" {
+				continue
+			}
+			Assert(t, msg.Channel == "chat/room 1" &&
+				string(msg.Data) == "hi\nthere", "Bad message: %#v", msg)
+			i++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message never showed up")
+		}
+	}
+
+	n, _ = db.Publish(ctx, "chat/room 2", []byte("x"))
+	Assert(t, n == 0, "Wrong channel got it: %d", n)
+
+	// Deleting the DB should end the subscriptions
+	err = db.DeleteDB()
+	Assert(t, err == nil, "Error deleting DB: %s", err)
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-done:
+			Assert(t, err == nil, "Subscribe failed: %s", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Subscription didn't end")
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	wsURL := "ws" + strings.TrimPrefix(db.URL, "http") + "/_ws"
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+		[]byte(db.User+":"+db.Password)))
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	Assert(t, err == nil, "Error connecting: %s", err)
+	defer conn.Close()
+
+	call := func(req *WSRequest) *WSResponse {
+		err := conn.WriteJSON(req)
+		Assert(t, err == nil, "Error sending: %s", err)
+		res := &WSResponse{}
+		err = conn.ReadJSON(res)
+		Assert(t, err == nil, "Error reading: %s", err)
+		return res
+	}
+
+	res := call(&WSRequest{ID: 1, Op: "watch", Prefix: "k"})
+	Assert(t, res.ID == 1 && res.Status == 200, "Bad watch: %#v", res)
+
+	res = call(&WSRequest{ID: 2, Op: "set", Key: "k1", Value: []byte("v1")})
+	if res.ID == 1 { // The event can show up first
+		res = &WSResponse{}
+		conn.ReadJSON(res)
+	}
+	Assert(t, res.ID == 2 && res.Status == 200 && res.Version == 1,
+		"Bad set: %#v", res)
+	v, _ := db.Get("k1")
+	Assert(t, v == "v1", "Set didn't work: %q", v)
+
+	res = call(&WSRequest{ID: 3, Op: "get", Key: "k1"})
+	if res.ID == 1 {
+		Assert(t, res.Event != nil && res.Event.Op == "set" &&
+			res.Event.Key == "k1" && string(res.Event.Value) == "v1",
+			"Bad event: %#v", res.Event)
+		res = &WSResponse{}
+		conn.ReadJSON(res)
+	}
+	Assert(t, res.ID == 3 && string(res.Value) == "v1", "Bad get: %#v", res)
+
+	res = call(&WSRequest{ID: 4, Op: "unwatch", Watch: 1})
+	Assert(t, res.ID == 4 && res.Status == 200, "Bad unwatch: %#v", res)
+
+	res = call(&WSRequest{ID: 5, Op: "list", Prefix: "k"})
+	Assert(t, res.ID == 5 && len(res.Keys) == 1 && res.Keys[0] == "k1",
+		"Bad list: %#v", res)
+	res = call(&WSRequest{ID: 6, Op: "delete", Key: "k1"})
+	Assert(t, res.ID == 6 && res.Status == 200, "Bad delete: %#v", res)
+	res = call(&WSRequest{ID: 7, Op: "get", Key: "k1"})
+	Assert(t, res.ID == 7 && res.Status == 404, "Should be gone: %#v", res)
+	res = call(&WSRequest{ID: 8, Op: "bogus"})
+	Assert(t, res.ID == 8 && res.Status == 400, "Bad op worked: %#v", res)
+
+	// A page on another site has to send an auth message first, even if
+	// the browser sends along the right header
+	header.Set("Origin", "http://example.com")
+	conn2, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	Assert(t, err == nil, "Error connecting: %s", err)
+	defer conn2.Close()
+	conn2.WriteJSON(&WSRequest{ID: 1, Op: "list"})
+	res = &WSResponse{}
+	conn2.ReadJSON(res)
+	if testServer.config.DisableAuth {
+		Assert(t, res.Status == 200, "Should work w/o auth: %#v", res)
+	} else {
+		Assert(t, res.Status == 401, "Should need auth: %#v", res)
+
+		conn2, _, err = websocket.DefaultDialer.Dial(wsURL, header)
+		Assert(t, err == nil, "Error connecting: %s", err)
+		defer conn2.Close()
+		conn2.WriteJSON(&WSRequest{ID: 1, Op: "auth", User: db.User,
+			Password: db.Password})
+		conn2.WriteJSON(&WSRequest{ID: 2, Op: "list"})
+		for id := int64(1); id <= 2; id++ {
+			res = &WSResponse{}
+			conn2.ReadJSON(res)
+			Assert(t, res.ID == id && res.Status == 200, "Bad auth: %#v",
+				res)
+		}
+
+		header.Set("Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte("bad:creds")))
+		_, hres, err := websocket.DefaultDialer.Dial(wsURL, header)
+		Assert(t, err != nil && hres != nil && hres.StatusCode == 401,
+			"Bad creds should fail: %v", err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore()
+	ref := map[string]*Value{}
+
+	check := func(s Store, ref map[string]*Value) {
+		keys := []string{}
+		for k := range ref {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		got := []string{}
+		s.Range("", "", func(k string, v *Value) bool {
+			Assert(t, v == ref[k], "Wrong value for %q", k)
+			got = append(got, k)
+			return true
+		})
+		Assert(t, s.Len() == len(ref) && strings.Join(got, ",") ==
+			strings.Join(keys, ","), "Bad store: %d %v", s.Len(), got)
+	}
+
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("k%03d", (i*7919)%500)
+		if i%3 == 2 {
+			_, ok := ref[k]
+			Assert(t, store.Delete(k) == ok, "Bad delete of %q", k)
+			delete(ref, k)
+		} else {
+			v := &Value{Data: []byte(k)}
+			store.Put(k, v)
+			ref[k] = v
+		}
+	}
+	check(store, ref)
+
+	// Snapshots shouldn't see later changes, and vice versa
+	snap := store.Snapshot()
+	snapRef := map[string]*Value{}
+	for k, v := range ref {
+		snapRef[k] = v
+	}
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		if i%2 == 0 {
+			store.Delete(k)
+			delete(ref, k)
+		} else {
+			v := &Value{}
+			store.Put(k, v)
+			ref[k] = v
+		}
+	}
+	check(store, ref)
+	check(snap, snapRef)
+
+	got := []string{}
+	store.Range("k100", "k106", func(k string, v *Value) bool {
+		got = append(got, k)
+		return true
+	})
+	Assert(t, strings.Join(got, ",") == "k101,k103,k105", "Bad range: %v",
+		got)
+	got = got[:0]
+	store.Range("k4", "", func(k string, v *Value) bool {
+		got = append(got, k)
+		return len(got) < 2
+	})
+	Assert(t, strings.Join(got, ",") == "k401,k403", "Bad range: %v", got)
+
+	Assert(t, PrefixEnd("ab") == "ac", "Bad PrefixEnd")
+	Assert(t, PrefixEnd("a\xff") == "b", "Bad PrefixEnd")
+	Assert(t, PrefixEnd("\xff") == "" && PrefixEnd("") == "",
+		"Bad PrefixEnd")
+}
+
+func TestKeyRange(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	for i := 0; i < 25; i++ {
+		db.Set(fmt.Sprintf("key%02d", i), "x")
+	}
+	db.Set("other", "x")
+
+	all := []string{}
+	next := "key"
+	for pages := 0; next != ""; pages++ {
+		Assert(t, pages < 3, "Too many pages")
+		var keys []string
+		keys, next, err = db.KeyRange(ctx, next, "kez", 10)
+		Assert(t, err == nil, "Error getting keys: %s", err)
+		all = append(all, keys...)
+	}
+	Assert(t, len(all) == 25 && all[0] == "key00" && all[24] == "key24",
+		"Bad pages: %v", all)
+
+	keys, next, _ := db.KeyRange(ctx, "key10", "key13", 0)
+	Assert(t, strings.Join(keys, ",") == "key10,key11,key12" && next == "",
+		"Bad range: %v %q", keys, next)
+	keys, _ = db.Keys("key2")
+	Assert(t, len(keys) == 5, "Bad prefix: %v", keys)
+
+	// Keys that the other APIs' URLs would hide can't be set
+	for _, key := range []string{"_keys", "_pub", "_sub/c", "a/_history",
+		"a/_list", "a/_hash", "a/_zset"} {
+		Assert(t, db.Set(key, "x") != nil, "Set of %q should fail", key)
+	}
+	Assert(t, db.Set("a/_hashes", "x") == nil, "Error setting a/_hashes")
+}
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+	path := dir + "/dbs/1.log"
+
+	store, err := OpenDiskStore(path)
+	Assert(t, err == nil, "Error opening store: %s", err)
+	store.Put("null", &Value{})
+	store.Put("empty", &Value{Data: []byte{}})
+	store.Put("list", &Value{Type: TypeList, List: [][]byte{[]byte("a")}})
+	for i := 0; i < 10; i++ {
+		store.Put(fmt.Sprintf("k%d", i), &Value{Data: []byte("v")})
+	}
+	Assert(t, store.Delete("k0") && !store.Delete("k0"), "Bad delete")
+	Assert(t, store.Len() == 12, "Bad len: %d", store.Len())
+	Assert(t, store.Close() == nil, "Error closing: %s", store.Err())
+
+	// Everything should be there when it's opened again, even if the last
+	// write didn't finish
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	store, err = OpenDiskStore(path)
+	Assert(t, err == nil, "Error opening store: %s", err)
+	defer store.Close()
+	Assert(t, store.Len() == 12, "Bad len: %d", store.Len())
+	v := store.Get("null")
+	Assert(t, v != nil && v.Data == nil, "Bad null value: %#v", v)
+	v = store.Get("empty")
+	Assert(t, v != nil && v.Data != nil && len(v.Data) == 0,
+		"Bad empty value: %#v", v)
+	v = store.Get("list")
+	Assert(t, v != nil && v.Type == TypeList && len(v.List) == 1,
+		"Bad list: %#v", v)
+	Assert(t, store.Get("k0") == nil, "k0 should be gone")
+
+	keys := []string{}
+	store.Range("k", "l", func(k string, v *Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	Assert(t, len(keys) == 9 && keys[0] == "k1", "Bad range: %v", keys)
+
+	// Overwriting keys should eventually compact the file, w/o messing up
+	// snapshots taken before that
+	defer func(size int64) { DiskCompactMinSize = size }(DiskCompactMinSize)
+	DiskCompactMinSize = 4096
+	snap := store.Snapshot()
+	info, _ := os.Stat(path)
+	for i := 0; i < 1000; i++ {
+		store.Put("k1", &Value{Data: []byte(fmt.Sprintf("%d", i))})
+	}
+	Assert(t, store.Err() == nil, "Store failed: %s", store.Err())
+	info2, _ := os.Stat(path)
+	Assert(t, info2.Size() < info.Size()+4096,
+		"File wasn't compacted: %d", info2.Size())
+	v = store.Get("k1")
+	Assert(t, v != nil && string(v.Data) == "999", "Bad value: %#v", v)
+	v = snap.Get("k1")
+	Assert(t, v != nil && string(v.Data) == "v", "Bad snapshot: %#v", v)
+	Assert(t, snap.Len() == 12, "Bad snapshot len: %d", snap.Len())
+
+	// The old file is closed once the last snapshot using it is
+	old := snap.(*DiskStore).file
+	Assert(t, old != store.file, "Should be using a new file")
+	Assert(t, snap.Close() == nil, "Error closing snapshot")
+	_, err = old.Stat()
+	Assert(t, errors.Is(err, os.ErrClosed), "Old file is still open: %v", err)
+	Assert(t, store.Get("k1") != nil, "Lost k1")
+
+	Assert(t, store.Drop() == nil, "Error dropping store")
+	_, err = os.Stat(path)
+	Assert(t, os.IsNotExist(err), "File should be gone: %v", err)
+
+	// A bad record that isn't the last one means the file is corrupt, so
+	// it shouldn't be opened, or truncated
+	store, err = OpenDiskStore(path)
+	Assert(t, err == nil, "Error opening store: %s", err)
+	store.Put("k1", &Value{Data: []byte("v1")})
+	store.Put("k2", &Value{Data: []byte("v2")})
+	Assert(t, store.Close() == nil, "Error closing: %s", store.Err())
+	buf, _ := ioutil.ReadFile(path)
+	buf[diskHeaderSize+2]++
+	ioutil.WriteFile(path, buf, 0600)
+
+	_, err = OpenDiskStore(path)
+	Assert(t, err != nil && strings.Contains(err.Error(), "Corrupt"),
+		"Should have failed: %v", err)
+	info, _ = os.Stat(path)
+	Assert(t, info.Size() == int64(len(buf)), "File was truncated")
+}
+
+func TestDurablePlan(t *testing.T) {
+	provision := func(url, iID string) int {
+		req, _ := http.NewRequest("PUT", url+"/v2/service_instances/"+iID,
+			strings.NewReader(`{"service_id":"service-1-id",`+
+				`"plan_id":"plan-3-id"}`))
+		req.SetBasicAuth(testUser, testPassword)
+		req.Header.Set("X-Broker-API-Version", "2.14")
+		res, err := http.DefaultClient.Do(req)
+		Assert(t, err == nil, "Error provisioning: %s", err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// The durable plan needs somewhere to save things
+	code := provision(fmt.Sprintf("http://%s", testHost), "d1")
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+	hasPlan := func(catalog Catalog, id string) bool {
+		for _, plan := range catalog.Services[0].Plans {
+			if plan.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	memSrv := mustServer(t, Config{})
+	Assert(t, !hasPlan(memSrv.Catalog, "plan-3-id"),
+		"Durable plan shouldn't be in the catalog")
+	Assert(t, hasPlan(memSrv.Catalog, "plan-1-id"), "Missing free plan")
+
+	// Even if a custom catalog has one
+	memSrv = mustServer(t, Config{Catalog: &DefaultCatalog})
+	ts := httptest.NewServer(memSrv)
+	code = provision(ts.URL, "d1")
+	ts.Close()
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		BrokerUser:     testUser,
+		BrokerPassword: testPassword,
+		DataDir:        dir,
+	}
+	srv := mustServer(t, config)
+	Assert(t, hasPlan(srv.Catalog, "plan-3-id"), "Missing durable plan")
+	ts = httptest.NewServer(srv)
+
+	code = provision(ts.URL, "d1")
+	Assert(t, code == http.StatusCreated, "Error provisioning: %d", code)
+	sdb := srv.Instances["d1"].DB
+	Assert(t, sdb.Storage == StorageDisk, "Wrong storage: %q", sdb.Storage)
+	db := &dbclient.DBConnection{URL: ts.URL + "/db/" + sdb.ID,
+		User: sdb.User, Password: sdb.Password}
+
+	err = db.Set("key1", "value1")
+	Assert(t, err == nil, "Error setting key: %s", err)
+	_, err = db.RPush(context.Background(), "list", []byte("x"))
+	Assert(t, err == nil, "Error pushing: %s", err)
+
+	// Even w/o a clean shutdown the instance, and its data, should be there
+	crashed := mustServer(t, config)
+	err = crashed.LoadSnapshot()
+	Assert(t, err == nil, "Error loading snapshot: %s", err)
+	Assert(t, crashed.Instances["d1"] != nil, "Instance wasn't saved")
+	cdb := crashed.getDB(sdb.ID)
+	Assert(t, cdb != nil && cdb.Password == sdb.Password, "DB wasn't saved")
+	v := cdb.Data.Get("key1")
+	Assert(t, v != nil && string(v.Data) == "value1", "Bad value: %#v", v)
+	cdb.Data.Close()
+
+	ts.Close()
+	err = srv.Shutdown(context.Background())
+	Assert(t, err == nil, "Error shutting down: %s", err)
+
+	// The data shouldn't be in the snapshot, just the log file
+	buf, _ := ioutil.ReadFile(dir + "/" + SnapshotFile)
+	Assert(t, !strings.Contains(string(buf), "dmFsdWUx"),
+		"Data is in the snapshot: %s", buf)
+	_, err = os.Stat(dir + "/dbs/" + sdb.ID + ".log")
+	Assert(t, err == nil, "Missing log file: %s", err)
+
+	srv2 := mustServer(t, config)
+	err = srv2.LoadSnapshot()
+	Assert(t, err == nil, "Error loading snapshot: %s", err)
+	ts2 := httptest.NewServer(srv2)
+	defer ts2.Close()
+
+	db.URL = ts2.URL + "/db/" + sdb.ID
+	val, err := db.Get("key1")
+	Assert(t, err == nil && val == "value1", "Bad value: %q %s", val, err)
+	n, err := db.LLen(context.Background(), "list")
+	Assert(t, err == nil && n == 1, "Bad list: %d %s", n, err)
+
+	// Deleting the DB should remove its file
+	err = db.DeleteDB()
+	Assert(t, err == nil, "Error deleting DB: %s", err)
+	_, err = os.Stat(dir + "/dbs/" + sdb.ID + ".log")
+	Assert(t, os.IsNotExist(err), "Log file should be gone: %v", err)
+}
+
+func TestMemoryLimit(t *testing.T) {
+	ctx := context.Background()
+	value := strings.Repeat("x", 1000)
+
+	newServer := func(policy string) (*Server, *httptest.Server, *dbclient.DBConnection) {
+		srv := mustServer(t, Config{
+			BrokerUser:     testUser,
+			BrokerPassword: testPassword,
+			MaxDBMemory:    20 * 1024,
+			EvictionPolicy: policy,
+			MaxVersions:    -1,
+		})
+		ts := httptest.NewServer(srv)
+		db, err := dbclient.NewDB(ts.URL+"/db", testUser, testPassword)
+		Assert(t, err == nil, "Error creating DB: %s", err)
+		return srv, ts, db
+	}
+
+	// Once full, writes should fail but deletes and reads still work
+	srv, ts, db := newServer(EvictNone)
+	var err error
+	for i := 0; err == nil; i++ {
+		Assert(t, i < 100, "Never ran out of memory")
+		err = db.Set(fmt.Sprintf("key%d", i), value)
+	}
+	Assert(t, errors.Is(err, dbclient.ErrOutOfMemory),
+		"Wrong error: %s", err)
+	_, err = db.RPush(ctx, "list", []byte(value))
+	Assert(t, errors.Is(err, dbclient.ErrOutOfMemory),
+		"Wrong error: %s", err)
+	val, err := db.Get("key0")
+	Assert(t, err == nil && val == value, "Bad value: %s", err)
+	Assert(t, db.DeleteKey("key0") == nil, "Error deleting key")
+	Assert(t, db.Set("key0", value) == nil, "Should have room again")
+
+	// A value bigger than what's left shouldn't fit, even if there's some
+	// room left
+	used := srv.memUsed
+	Assert(t, used < 20*1024, "Should have some room: %d", used)
+	err = db.Set("big", strings.Repeat("x", 20*1024-int(used)))
+	Assert(t, errors.Is(err, dbclient.ErrOutOfMemory),
+		"Wrong error: %s", err)
+	Assert(t, srv.memUsed == used, "Memory changed: %d", srv.memUsed)
+
+	// An import that won't fit shouldn't change anything, even in replace
+	// mode, but one that fits once the old keys are gone should work
+	keys, _ := db.Keys("")
+	recs := []*dbclient.ExportRecord{}
+	for i := 0; i < 25; i++ {
+		recs = append(recs, &dbclient.ExportRecord{
+			Key: fmt.Sprintf("new%d", i), Value: []byte(value)})
+	}
+	_, err = db.ImportRecords(ctx, recs, true)
+	Assert(t, errors.Is(err, dbclient.ErrOutOfMemory),
+		"Wrong error: %s", err)
+	keys2, _ := db.Keys("")
+	Assert(t, len(keys2) == len(keys), "Keys changed: %v", keys2)
+	Assert(t, srv.memUsed == used, "Memory changed: %d", srv.memUsed)
+	result, err := db.ImportRecords(ctx, recs[:len(keys)], true)
+	Assert(t, err == nil && result.Deleted == len(keys),
+		"Bad import: %#v %s", result, err)
+
+	// Removing everything should get us back to where we started
+	keys, _ = db.Keys("")
+	for _, key := range keys {
+		db.DeleteKey(key)
+	}
+	Assert(t, srv.memUsed == 0, "Memory is still in use: %d", srv.memUsed)
+	ts.Close()
+
+	// LRU should evict keys that haven't been used lately
+	srv, ts, db = newServer(EvictLRU)
+	defer ts.Close()
+	defer func(n int) { EvictionSamples = n }(EvictionSamples)
+	EvictionSamples = 1000 // So it's not random
+	db.Set("keep", value)
+	for i := 0; i < 50; i++ {
+		db.Get("keep")
+		err = db.Set(fmt.Sprintf("key%d", i), value)
+		Assert(t, err == nil, "Error setting key: %s", err)
+	}
+	_, err = db.Get("keep")
+	Assert(t, err == nil, "Used key was evicted: %s", err)
+	_, err = db.Get("key0")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "key0 wasn't evicted")
+	evicted := srv.evictedKeys
+	Assert(t, evicted > 0 && srv.memUsed <= 20*1024,
+		"Bad stats: %d %d", evicted, srv.memUsed)
+
+	// A big value should evict as much as it needs, but a value that
+	// would never fit shouldn't evict anything
+	err = db.Set("big", strings.Repeat("x", 10*1024))
+	Assert(t, err == nil, "Error setting big: %s", err)
+	Assert(t, srv.memUsed <= 20*1024, "Over budget: %d", srv.memUsed)
+	evicted = srv.evictedKeys
+	err = db.Set("huge", strings.Repeat("x", 20*1024))
+	Assert(t, errors.Is(err, dbclient.ErrOutOfMemory),
+		"Wrong error: %s", err)
+	Assert(t, srv.evictedKeys == evicted, "Shouldn't have evicted anything")
+	_, err = db.Get("big")
+	Assert(t, err == nil, "big was evicted: %s", err)
+
+	// Nor should a push onto a key that isn't a list
+	_, err = db.RPush(ctx, "big", []byte(strings.Repeat("x", 15*1024)))
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Wrong error: %s", err)
+	big := strings.Repeat("x", 15*1024)
+	_, err = db.HSet(ctx, "big", "f", []byte(big))
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Wrong error: %s", err)
+	_, err = db.SAdd(ctx, "big", big)
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Wrong error: %s", err)
+	_, err = db.ZAdd(ctx, "big", big, 1)
+	Assert(t, errors.Is(err, dbclient.ErrConflict), "Wrong error: %s", err)
+	Assert(t, srv.evictedKeys == evicted, "Shouldn't have evicted anything")
+
+	res, err := http.Get(ts.URL + "/metrics")
+	Assert(t, err == nil, "Error getting metrics: %s", err)
+	buf, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	Assert(t, strings.Contains(string(buf),
+		fmt.Sprintf("\nosbdb_evicted_keys_total %d\n", evicted)),
+		"Bad metrics: %s", buf)
+	Assert(t, strings.Contains(string(buf),
+		fmt.Sprintf("osbdb_db_evicted_keys_total{db=%q} %d\n", db.GetID(),
+			evicted)), "Bad metrics: %s", buf)
+
+	res, err = http.Get(ts.URL + "/info")
+	Assert(t, err == nil, "Error getting info: %s", err)
+	buf, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	Assert(t, strings.Contains(string(buf),
+		fmt.Sprintf("Evicted keys: %d\n", evicted)), "Bad info: %s", buf)
+
+	// Deleted keys' history should be evicted too, once there's nothing
+	// else left
+	srv = mustServer(t, Config{
+		BrokerUser:     testUser,
+		BrokerPassword: testPassword,
+		MaxDBMemory:    20 * 1024,
+		EvictionPolicy: EvictLRU,
+		MaxVersions:    5,
+	})
+	ts2 := httptest.NewServer(srv)
+	defer ts2.Close()
+	db, err = dbclient.NewDB(ts2.URL+"/db", testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		Assert(t, db.Set(key, value) == nil, "Error setting %s", key)
+		Assert(t, db.DeleteKey(key) == nil, "Error deleting %s", key)
+	}
+	used = srv.memUsed
+	Assert(t, used > 10*1000, "History should be using memory: %d", used)
+	err = db.Set("big", strings.Repeat("x", 10*1024))
+	Assert(t, err == nil, "Error setting big: %s", err)
+	Assert(t, srv.memUsed <= 20*1024, "Over budget: %d", srv.memUsed)
+
+	// A typo in the policy shouldn't mean nothing's ever evicted
+	config := Config{EvictionPolicy: "allkeys-lfu"}
+	Assert(t, config.Validate() != nil, "Bad policy should be invalid")
+	_, err = NewServer(config)
+	Assert(t, err != nil, "NewServer should have failed")
+}
+
+func TestTTL(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	err = db.SetWithMetadata(ctx, "temp", []byte("x"),
+		&dbclient.Metadata{TTL: 200 * time.Millisecond})
+	Assert(t, err == nil, "Error setting key: %s", err)
+	db.Set("forever", "x")
+
+	_, md, err := db.GetWithMetadata(ctx, "temp")
+	Assert(t, err == nil && !md.Expires.IsZero(), "Bad expires: %v %s",
+		md, err)
+	_, md, _ = db.GetWithMetadata(ctx, "forever")
+	Assert(t, md.Expires.IsZero(), "Shouldn't expire: %v", md.Expires)
+
+	time.Sleep(300 * time.Millisecond)
+	keys, _ := db.Keys("")
+	Assert(t, len(keys) == 1 && keys[0] == "forever", "Bad keys: %v", keys)
+	_, err = db.Get("temp")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "temp didn't expire")
+
+	req, _ := http.NewRequest("PUT", db.URL+"/bad", strings.NewReader("x"))
+	req.SetBasicAuth(db.User, db.Password)
+	req.Header.Set(TTLHeader, "soon")
+	res, err := http.DefaultClient.Do(req)
+	Assert(t, err == nil && res.StatusCode == http.StatusBadRequest,
+		"Bad TTL should fail: %v %s", res, err)
+	res.Body.Close()
+
+	// volatile-ttl evicts the keys closest to expiring, and only those
+	srv := mustServer(t, Config{
+		MaxDBMemory:    10 * 1024,
+		EvictionPolicy: EvictTTL,
+		DisableAuth:    true,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	db, _ = dbclient.NewDB(ts.URL+"/db", "", "")
+	value := []byte(strings.Repeat("x", 1000))
+	db.SetWithMetadata(ctx, "short", value,
+		&dbclient.Metadata{TTL: time.Hour})
+	db.SetWithMetadata(ctx, "long", value,
+		&dbclient.Metadata{TTL: 2 * time.Hour})
+	for i := 0; err == nil; i++ {
+		Assert(t, i < 100, "Never ran out of memory")
+		err = db.SetAsBytes(fmt.Sprintf("key%d", i), value)
+	}
+	Assert(t, errors.Is(err, dbclient.ErrOutOfMemory),
+		"Wrong error: %s", err)
+	keys, _ = db.Keys("")
+	all := strings.Join(keys, ",")
+	Assert(t, strings.HasPrefix(all, "key0,") &&
+		!strings.Contains(all, "short") && !strings.Contains(all, "long"),
+		"Bad keys: %v", keys)
+	Assert(t, srv.evictedKeys == 2, "Bad evicted count: %d", srv.evictedKeys)
+}
+
+func TestExportImport(t *testing.T) {
+	testURL := fmt.Sprintf("http://%s/db", testHost)
+	ctx := context.Background()
+
+	CleanDBs(t, testURL, testUser, testPassword)
+	defer CleanDBs(t, testURL, testUser, testPassword)
+
+	db, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+
+	db.SetWithMetadata(ctx, "doc", []byte(`{"a":1}`), &dbclient.Metadata{
+		ContentType: "application/json",
+		Meta:        map[string]string{"Owner": "me"},
+		TTL:         time.Hour,
+	})
+	db.SetWithMetadata(ctx, "null", nil, nil)
+	db.Set("empty", "")
+	db.RPush(ctx, "list", []byte("a"))
+	db.RPush(ctx, "list", []byte("b"))
+	db.HSet(ctx, "hash", "f", []byte("v"))
+	db.SAdd(ctx, "set", "m")
+	db.ZAdd(ctx, "zset", "m", 1.5)
+
+	buf := &bytes.Buffer{}
+	err = db.Export(ctx, buf, false)
+	Assert(t, err == nil, "Error exporting: %s", err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	Assert(t, len(lines) == 7 && strings.HasPrefix(lines[0], `{"key":"doc"`),
+		"Bad export: %s", buf)
+	export := buf.String()
+
+	// Import into a new DB, in JSON format this time
+	db2, err := dbclient.NewDB(testURL, testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	db2.Set("other", "x")
+	buf.Reset()
+	db.Export(ctx, buf, true)
+	Assert(t, strings.HasPrefix(buf.String(), "[\n{"), "Bad JSON: %s", buf)
+	result, err := db2.Import(ctx, buf, false)
+	Assert(t, err == nil && result.Imported == 7 && result.Deleted == 0,
+		"Bad import: %#v %s", result, err)
+
+	val, md, err := db2.GetWithMetadata(ctx, "doc")
+	Assert(t, err == nil && string(val) == `{"a":1}` &&
+		md.ContentType == "application/json" && md.Meta["Owner"] == "me" &&
+		time.Until(md.Expires) > 59*time.Minute, "Bad doc: %q %#v %s", val,
+		md, err)
+	val, _, err = db2.GetWithMetadata(ctx, "null")
+	Assert(t, err == nil && val == nil, "Bad null: %q %s", val, err)
+	val, _, err = db2.GetWithMetadata(ctx, "empty")
+	Assert(t, err == nil && val != nil && len(val) == 0, "Bad empty: %q", val)
+	items, _ := db2.LRange(ctx, "list", 0, -1)
+	Assert(t, len(items) == 2 && string(items[1]) == "b", "Bad list: %q",
+		items)
+	v, _ := db2.HGet(ctx, "hash", "f")
+	Assert(t, string(v) == "v", "Bad hash: %q", v)
+	ok, _ := db2.SIsMember(ctx, "set", "m")
+	Assert(t, ok, "Bad set")
+	info, _ := db2.ZRank(ctx, "zset", "m", false)
+	Assert(t, info != nil && info.Score == 1.5, "Bad zset: %v", info)
+	_, err = db2.Get("other")
+	Assert(t, err == nil, "Merge shouldn't delete keys: %s", err)
+
+	// The same export as before, other than "other" and the TTL
+	buf.Reset()
+	db2.Export(ctx, buf, false)
+	export2 := strings.Replace(buf.String(),
+		`{"key":"other","value":"eA=="}`+"\n", "", 1)
+	noTTL := regexp.MustCompile(`,"ttl":[0-9.]+`)
+	Assert(t, noTTL.ReplaceAllString(export2, "") ==
+		noTTL.ReplaceAllString(export, ""), "Exports differ:\n%s\n%s",
+		export, export2)
+
+	// Replace should get rid of keys that aren't in the import
+	result, err = db2.ImportRecords(ctx, []*dbclient.ExportRecord{
+		{Key: "list", Type: "list", List: [][]byte{[]byte("c")}},
+		{Key: "new", Value: []byte("x")},
+	}, true)
+	Assert(t, err == nil && result.Imported == 2 && result.Deleted == 7,
+		"Bad replace: %#v %s", result, err)
+	keys, _ := db2.Keys("")
+	Assert(t, strings.Join(keys, ",") == "list,new", "Bad keys: %v", keys)
+	items, _ = db2.LRange(ctx, "list", 0, -1)
+	Assert(t, len(items) == 1 && string(items[0]) == "c", "Bad list: %q",
+		items)
+
+	// Bad records shouldn't change anything
+	_, err = db2.Import(ctx, strings.NewReader(
+		`{"key":"a","value":"eA=="}`+"\n"+`{"key":"b","type":"bogus"}`),
+		true)
+	Assert(t, dbclient.StatusCode(err) == http.StatusBadRequest,
+		"Bad import should fail: %s", err)
+	keys, _ = db2.Keys("")
+	Assert(t, len(keys) == 2, "Bad import changed keys: %v", keys)
+
+	recs := []string{}
+	db.ExportRecords(ctx, func(rec *dbclient.ExportRecord) bool {
+		recs = append(recs, rec.Key)
+		return len(recs) < 3
+	})
+	Assert(t, strings.Join(recs, ",") == "doc,empty,hash", "Bad records: %v",
+		recs)
+
+	// Imports can't be bigger than MaxImportSize
+	srv := mustServer(t, Config{BrokerUser: testUser,
+		BrokerPassword: testPassword, MaxImportSize: 100})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	db3, err := dbclient.NewDB(ts.URL+"/db", testUser, testPassword)
+	Assert(t, err == nil, "Error creating DB: %s", err)
+	_, err = db3.Import(ctx, strings.NewReader(export), false)
+	Assert(t, dbclient.StatusCode(err) == http.StatusRequestEntityTooLarge,
+		"Big import should fail: %s", err)
+	keys, _ = db3.Keys("")
+	Assert(t, len(keys) == 0, "Big import changed keys: %v", keys)
+}
+
+func TestBackups(t *testing.T) {
+	osb := func(url, method, iID, params string) int {
+		req, _ := http.NewRequest(method, url+"/v2/service_instances/"+iID,
+			strings.NewReader(`{"service_id":"service-1-id",`+
+				`"plan_id":"plan-1-id","parameters":{`+params+`}}`))
+		req.SetBasicAuth(testUser, testPassword)
+		req.Header.Set("X-Broker-API-Version", "2.14")
+		res, err := http.DefaultClient.Do(req)
+		Assert(t, err == nil, "Error calling broker: %s", err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Backups need somewhere to go
+	_, err := dbclient.GetBackups(fmt.Sprintf("http://%s", testHost), "",
+		testUser, testPassword)
+	Assert(t, err == nil, "Error getting backups: %s", err)
+	code := osb(fmt.Sprintf("http://%s", testHost), "PUT", "b1",
+		`"restore_from":"x"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+
+	srv := mustServer(t, Config{
+		BrokerUser:     testUser,
+		BrokerPassword: testPassword,
+		DataDir:        dir,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	code = osb(ts.URL, "PUT", "i1", "")
+	Assert(t, code == http.StatusCreated, "Error provisioning: %d", code)
+	sdb := srv.Instances["i1"].DB
+	db := &dbclient.DBConnection{URL: ts.URL + "/db/" + sdb.ID,
+		User: sdb.User, Password: sdb.Password}
+	Assert(t, db.Set("key1", "value1") == nil, "Error setting key1")
+	_, err = db.SAdd(context.Background(), "set", "a")
+	Assert(t, err == nil, "Error adding to set: %s", err)
+
+	info, err := dbclient.CreateBackup(ts.URL, "i1", "first", testUser,
+		testPassword)
+	Assert(t, err == nil, "Error creating backup: %s", err)
+	Assert(t, info.Name == "first" && info.InstanceID == "i1" &&
+		info.DBID == sdb.ID && info.Keys == 2 && info.Size > 0,
+		"Bad backup: %#v", info)
+	_, err = dbclient.CreateBackup(ts.URL, "i1", "first", testUser,
+		testPassword)
+	Assert(t, dbclient.StatusCode(err) == http.StatusConflict,
+		"Should have been a conflict: %s", err)
+	_, err = dbclient.CreateBackup(ts.URL, "i1", ".bad", testUser,
+		testPassword)
+	Assert(t, dbclient.StatusCode(err) == http.StatusBadRequest,
+		"Should have been a bad name: %s", err)
+	_, err = dbclient.CreateBackup(ts.URL, "missing", "", testUser,
+		testPassword)
+	Assert(t, dbclient.StatusCode(err) == http.StatusNotFound,
+		"Should have been missing: %s", err)
+
+	// Only one of the same name at the same time should win
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := srv.CreateBackup("i1", srv.Instances["i1"], "race")
+			results <- err
+		}()
+	}
+	created := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			created++
+		} else {
+			Assert(t, err == os.ErrExist, "Error creating backup: %s", err)
+		}
+	}
+	Assert(t, created == 1, "Created %d backups called race", created)
+	tmps, _ := filepath.Glob(filepath.Join(dir, "backups", "*.tmp"))
+	Assert(t, len(tmps) == 0, "Temp files left behind: %v", tmps)
+	Assert(t, srv.DeleteBackup("race") == nil, "Error deleting race")
+
+	Assert(t, db.Set("key1", "changed") == nil, "Error setting key1")
+	Assert(t, db.Set("key2", "value2") == nil, "Error setting key2")
+	info, err = dbclient.CreateBackup(ts.URL, "i1", "", testUser,
+		testPassword)
+	Assert(t, err == nil && strings.HasPrefix(info.Name, "i1-") &&
+		info.Keys == 3, "Bad backup: %#v %s", info, err)
+
+	infos, err := dbclient.GetBackups(ts.URL, "i1", testUser, testPassword)
+	Assert(t, err == nil && len(infos) == 2 && infos[0].Name == "first",
+		"Bad backups: %#v %s", infos, err)
+
+	// A new instance from a backup
+	code = osb(ts.URL, "PUT", "i2", `"restore_from":"missing"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+	Assert(t, srv.Instances["i2"] == nil, "Instance shouldn't exist")
+	code = osb(ts.URL, "PUT", "i2", `"restore_from":"first"`)
+	Assert(t, code == http.StatusCreated, "Error provisioning: %d", code)
+	sdb2 := srv.Instances["i2"].DB
+	db2 := &dbclient.DBConnection{URL: ts.URL + "/db/" + sdb2.ID,
+		User: sdb2.User, Password: sdb2.Password}
+	val, err := db2.Get("key1")
+	Assert(t, err == nil && val == "value1", "Bad value: %q %s", val, err)
+	ok, err := db2.SIsMember(context.Background(), "set", "a")
+	Assert(t, err == nil && ok, "Bad set: %v %s", ok, err)
+
+	// Updating an instance from a backup replaces what's there
+	code = osb(ts.URL, "PATCH", "i1", `"restore_from":"first"`)
+	Assert(t, code == http.StatusOK, "Error updating: %d", code)
+	keys, _ := db.Keys("")
+	Assert(t, len(keys) == 2, "Bad keys: %v", keys)
+	val, _ = db.Get("key1")
+	Assert(t, val == "value1", "Bad value: %q", val)
+	code = osb(ts.URL, "PATCH", "i1", `"restore_from":"missing"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+
+	// Repeating the same restore_from doesn't restore it again
+	Assert(t, db.Set("key2", "value2") == nil, "Error setting key2")
+	code = osb(ts.URL, "PATCH", "i1", `"restore_from":"first"`)
+	Assert(t, code == http.StatusOK, "Error updating: %d", code)
+	val, _ = db.Get("key2")
+	Assert(t, val == "value2", "Should not have restored: %q", val)
+
+	code = osb(ts.URL, "PATCH", "i1", `"restore_from":"../first"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+	code = osb(ts.URL, "PUT", "i3", `"restore_from":"../first"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+
+	// Instances that are being restored or cloned can't be changed yet
+	srv.instanceMutex.Lock()
+	srv.markBusy("i1")
+	srv.instanceMutex.Unlock()
+	code = osb(ts.URL, "PATCH", "i1", `"restore_from":"`+info.Name+`"`)
+	Assert(t, code == http.StatusUnprocessableEntity, "Not busy: %d", code)
+	code = osb(ts.URL, "DELETE", "i1?service_id=service-1-id&"+
+		"plan_id=plan-1-id", "")
+	Assert(t, code == http.StatusUnprocessableEntity, "Not busy: %d", code)
+	srv.unmarkBusy("i1")
+	Assert(t, len(srv.busy) == 0, "Still busy: %v", srv.busy)
+
+	// Backups outlive their instance
+	Assert(t, osb(ts.URL, "DELETE", "i1?service_id=service-1-id&"+
+		"plan_id=plan-1-id", "") == http.StatusOK, "Error deprovisioning")
+	infos, err = dbclient.GetBackups(ts.URL, "", testUser, testPassword)
+	Assert(t, err == nil && len(infos) == 2, "Bad backups: %#v %s",
+		infos, err)
+
+	err = dbclient.DeleteBackup(ts.URL, "first", testUser, testPassword)
+	Assert(t, err == nil, "Error deleting backup: %s", err)
+	err = dbclient.DeleteBackup(ts.URL, "first", testUser, testPassword)
+	Assert(t, dbclient.StatusCode(err) == http.StatusNotFound,
+		"Should have been missing: %s", err)
+	files, _ := filepath.Glob(dir + "/backups/*")
+	Assert(t, len(files) == 2, "Bad backup files: %v", files)
+}
+
+func TestClone(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "osbdb")
+	Assert(t, err == nil, "Can't create temp dir: %s", err)
+	defer os.RemoveAll(dir)
+
+	srv := mustServer(t, Config{
+		BrokerUser:     testUser,
+		BrokerPassword: testPassword,
+		DataDir:        dir,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	provision := func(iID, plan, org, params string) int {
+		req, _ := http.NewRequest("PUT", ts.URL+"/v2/service_instances/"+iID,
+			strings.NewReader(`{"service_id":"service-1-id",`+
+				`"plan_id":"`+plan+`","organization_guid":"`+org+`",`+
+				`"space_guid":"s1","parameters":{`+params+`}}`))
+		req.SetBasicAuth(testUser, testPassword)
+		req.Header.Set("X-Broker-API-Version", "2.14")
+		res, err := http.DefaultClient.Do(req)
+		Assert(t, err == nil, "Error provisioning: %s", err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	getDB := func(iID string) *dbclient.DBConnection {
+		sdb := srv.Instances[iID].DB
+		return &dbclient.DBConnection{URL: ts.URL + "/db/" + sdb.ID,
+			User: sdb.User, Password: sdb.Password}
+	}
+
+	code := provision("prod", "plan-1-id", "o1", "")
+	Assert(t, code == http.StatusCreated, "Error provisioning: %d", code)
+	prod := getDB("prod")
+	Assert(t, prod.Set("key1", "value1") == nil, "Error setting key1")
+	_, err = prod.RPush(ctx, "list", []byte("a"))
+	Assert(t, err == nil, "Error pushing: %s", err)
+
+	code = provision("bad", "plan-1-id", "o2", `"clone_from_instance":"prod"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+	code = provision("bad", "plan-1-id", "o1", `"clone_from_instance":"x"`)
+	Assert(t, code == http.StatusBadRequest, "Should have failed: %d", code)
+	Assert(t, srv.Instances["bad"] == nil, "Instance shouldn't exist")
+
+	// Changes to a clone, in memory or on disk, don't change the original
+	for _, plan := range []string{"plan-1-id", "plan-3-id"} {
+		code = provision(plan, plan, "o1", `"clone_from_instance":"prod"`)
+		Assert(t, code == http.StatusCreated, "Error cloning: %d", code)
+		clone := getDB(plan)
+
+		val, err := clone.Get("key1")
+		Assert(t, err == nil && val == "value1", "Bad value: %q %s", val, err)
+		Assert(t, clone.Set("key1", "staging") == nil, "Error setting key1")
+		_, err = clone.RPush(ctx, "list", []byte("b"))
+		Assert(t, err == nil, "Error pushing: %s", err)
+		Assert(t, clone.Set("key2", "value2") == nil, "Error setting key2")
+
+		val, _ = prod.Get("key1")
+		Assert(t, val == "value1", "Prod changed: %q", val)
+		n, _ := prod.LLen(ctx, "list")
+		Assert(t, n == 1, "Prod list changed: %d", n)
+		keys, _ := prod.Keys("")
+		Assert(t, len(keys) == 2, "Bad prod keys: %v", keys)
+
+		n, _ = clone.LLen(ctx, "list")
+		Assert(t, n == 2, "Bad clone list: %d", n)
+	}
+	Assert(t, srv.Instances["plan-3-id"].DB.Storage == StorageDisk,
+		"Clone should be on disk")
+
+	Assert(t, prod.Set("key1", "changed") == nil, "Error setting key1")
+	val, _ := getDB("plan-1-id").Get("key1")
+	Assert(t, val == "staging", "Clone changed: %q", val)
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	ReplHeartbeat, ReplRetryDelay = 100*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		ReplHeartbeat, ReplRetryDelay = 5*time.Second, time.Second
+	}()
+
+	config := Config{BrokerUser: testUser, BrokerPassword: testPassword}
+	srv := mustServer(t, config)
+	ts := httptest.NewServer(srv)
+	srv2 := mustServer(t, config)
+	ts2 := httptest.NewServer(srv2)
+	defer ts2.Close()
+
+	osb := func(url, method, path, body string) int {
+		req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+		req.SetBasicAuth(testUser, testPassword)
+		req.Header.Set("X-Broker-API-Version", "2.14")
+		res, err := http.DefaultClient.Do(req)
+		Assert(t, err == nil, "Error calling %s: %s", path, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	provision := func(url, iID string) int {
+		return osb(url, "PUT", "/v2/service_instances/"+iID,
+			`{"service_id":"service-1-id","plan_id":"plan-1-id",`+
+				`"organization_guid":"o1","space_guid":"s1"}`)
+	}
+	bind := func(url, iID, bID string) int {
+		return osb(url, "PUT", "/v2/service_instances/"+iID+
+			"/service_bindings/"+bID,
+			`{"service_id":"service-1-id","plan_id":"plan-1-id"}`)
+	}
+	// Wait for key to show up in db
+	waitFor := func(db *dbclient.DBConnection, key string) {
+		for i := 0; ; i++ {
+			if _, err := db.Get(key); err == nil {
+				return
+			}
+			Assert(t, i < 200, "Timed out waiting for %q", key)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Some state from before the follower shows up
+	Assert(t, provision(ts.URL, "i1") == http.StatusCreated, "Bad provision")
+	Assert(t, bind(ts.URL, "i1", "b1") == http.StatusCreated, "Bad bind")
+	sdb := srv.Instances["i1"].DB
+	db := &dbclient.DBConnection{URL: ts.URL + "/db/" + sdb.ID,
+		User: sdb.User, Password: sdb.Password}
+	Assert(t, db.Set("key1", "value1") == nil, "Error setting key1")
+	Assert(t, db.Set("key1", "value2") == nil, "Error setting key1")
+	_, err := db.RPush(ctx, "list", []byte("a"))
+	Assert(t, err == nil, "Error pushing: %s", err)
+
+	Assert(t, srv2.Follow(ts.URL) == nil, "Error following")
+	Assert(t, srv2.Follow(ts.URL) != nil, "Should already be following")
+	db2 := &dbclient.DBConnection{URL: ts2.URL + "/db/" + sdb.ID,
+		User: sdb.User, Password: sdb.Password}
+	waitFor(db2, "key1")
+
+	// Then changes as they happen
+	Assert(t, db.Set("key2", "value3") == nil, "Error setting key2")
+	Assert(t, db.DeleteKey("key1") == nil, "Error deleting key1")
+	_, err = db.RPush(ctx, "list", []byte("b"))
+	Assert(t, err == nil, "Error pushing: %s", err)
+	Assert(t, provision(ts.URL, "i2") == http.StatusCreated, "Bad provision")
+	Assert(t, db.Set("done", "1") == nil, "Error setting done")
+	waitFor(db2, "done")
+
+	_, err = db2.Get("key1")
+	Assert(t, errors.Is(err, dbclient.ErrNotFound), "key1 should be gone")
+	val, err := db2.Get("key2")
+	Assert(t, err == nil && val == "value3", "Bad key2: %q %s", val, err)
+	n, err := db2.LLen(ctx, "list")
+	Assert(t, err == nil && n == 2, "Bad list len: %d %s", n, err)
+	code := osb(ts2.URL, "GET", "/v2/service_instances/i2", "")
+	Assert(t, code == http.StatusOK, "Missing i2 on follower: %d", code)
+	code = osb(ts2.URL, "GET", "/v2/service_instances/i1/service_bindings/b1", "")
+	Assert(t, code == http.StatusOK, "Missing b1 on follower: %d", code)
+
+	status, err := dbclient.GetReplication(ts2.URL, testUser, testPassword)
+	Assert(t, err == nil, "Error getting status: %s", err)
+	Assert(t, status.Role == ReplRoleFollower && status.Leader == ts.URL &&
+		status.Connected && status.Synced, "Bad status: %#v", status)
+	status, err = dbclient.GetReplication(ts.URL, testUser, testPassword)
+	Assert(t, err == nil, "Error getting status: %s", err)
+	Assert(t, status.Role == ReplRoleLeader && status.Followers == 1,
+		"Bad status: %#v", status)
+
+	// Followers don't take writes
+	err = db2.Set("key3", "x")
+	Assert(t, errors.Is(err, dbclient.ErrReadOnly), "Should be read-only: %v",
+		err)
+	code = provision(ts2.URL, "i3")
+	Assert(t, code == http.StatusMisdirectedRequest, "Should fail: %d", code)
+
+	Assert(t, srv2.CheckReplication().Status == "ok", "Should be ready")
+
+	// Lose the leader, then promote the follower
+	srv.Shutdown(ctx)
+	ts.Close()
+	for i := 0; srv2.CheckReplication().Status == "ok"; i++ {
+		Assert(t, i < 200, "Follower should stop being ready")
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, err = dbclient.GetReplication(ts2.URL, testUser, testPassword)
+	Assert(t, err == nil, "Error getting status: %s", err)
+	Assert(t, !status.Connected && !status.Synced, "Bad status: %#v", status)
+	res, err := http.Get(ts2.URL + "/readyz")
+	Assert(t, err == nil, "Error getting readyz: %s", err)
+	res.Body.Close()
+	Assert(t, res.StatusCode == http.StatusServiceUnavailable,
+		"Should not be ready: %d", res.StatusCode)
+
+	status, err = dbclient.Promote(ts2.URL, testUser, testPassword)
+	Assert(t, err == nil, "Error promoting: %s", err)
+	Assert(t, status.Role == ReplRoleLeader, "Bad status: %#v", status)
+
+	Assert(t, db2.Set("key3", "value4") == nil, "Error setting key3")
+	val, _ = db2.Get("key2")
+	Assert(t, val == "value3", "Lost key2: %q", val)
+	Assert(t, bind(ts2.URL, "i2", "b2") == http.StatusCreated, "Bad bind")
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Set Stuff */
+/*************/
+
+// A set key holds a set of unique strings (members):
+//
+//	GET    /db/{dbID}/{key}/_set                    all members, sorted
+//	GET    /db/{dbID}/{key}/_set?op=union&with=k2   members of key or k2
+//	GET    /db/{dbID}/{key}/_set?op=inter&with=k2   members of key and k2
+//	GET    /db/{dbID}/{key}/_set/{member}           true or false
+//	PUT    /db/{dbID}/{key}/_set/{member}
+//	DELETE /db/{dbID}/{key}/_set/{member}
+//
+// "with" can be repeated. Empty sets are deleted.
+
+func (s *Server) DBSetMembersHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	query := r.URL.Query()
+	op := query.Get("op")
+	if op != "" && op != "union" && op != "inter" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown op %q\n", op)
+		return
+	}
+
+	keys := append([]string{key}, query["with"]...)
+	counts := map[string]int{}
+
+	db.mutex.Lock()
+	for _, k := range keys {
+		v := db.Data.Get(k)
+		if !CheckType(w, k, v, TypeSet) {
+			db.mutex.Unlock()
+			return
+		}
+		if v == nil {
+			continue
+		}
+		for m := range v.Set {
+			counts[m]++
+		}
+	}
+	db.mutex.Unlock()
+
+	members := []string{}
+	for m, c := range counts {
+		if op != "inter" || c == len(keys) {
+			members = append(members, m)
+		}
+	}
+	sort.Strings(members)
+	w.Header().Set(LengthHeader, strconv.Itoa(len(members)))
+	WriteJSON(w, members)
+}
+
+func (s *Server) DBSetIsMemberHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, member := vars["key"], vars["member"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeSet) {
+		db.mutex.Unlock()
+		return
+	}
+	isMember := v != nil && v.Set[member]
+	db.mutex.Unlock()
+
+	buf, _ := json.Marshal(isMember)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (s *Server) DBSetAddHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, member := vars["key"], vars["member"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeSet) {
+		db.mutex.Unlock()
+		return
+	}
+	need := db.addNeed(key, int64(24+len(member)))
+	if !s.MakeRoom(w, db, key, need) {
+		db.mutex.Unlock()
+		return
+	}
+	if v == nil {
+		v = db.NewTypedValue(key, TypeSet)
+	}
+	if !v.Set[member] {
+		v.Set[member] = true
+		v.Modified = time.Now().UTC()
+		db.Data.Put(key, v)
+		db.Notify(&WatchEvent{Op: "sadd", Key: key, Field: member})
+	}
+	length := len(v.Set)
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Added %q to %q\n", db.ID, member, key)
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+}
+
+func (s *Server) DBSetRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, member := vars["key"], vars["member"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeSet) {
+		db.mutex.Unlock()
+		return
+	}
+	if v == nil || !v.Set[member] {
+		db.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(v.Set, member)
+	v.Modified = time.Now().UTC()
+	length := len(v.Set)
+	db.Notify(&WatchEvent{Op: "srem", Key: key, Field: member})
+	if length == 0 {
+		db.Data.Delete(key)
+	} else {
+		db.Data.Put(key, v)
+	}
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Removed %q from %q\n", db.ID, member, key)
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+/* Snapshot Stuff */
+/******************/
+
+// SnapshotFile is the name of the file, within Config.DataDir, that holds
+// the state of all DBs and Instances between runs.
+const SnapshotFile = "snapshot.json"
+
+type Snapshot struct {
+	LastID    int                          `json:"lastID"`
+	DBs       []*DBSnapshot                `json:"dbs"`
+	Instances map[string]*InstanceSnapshot `json:"instances"`
+}
+
+type DBSnapshot struct {
+	ID       string                `json:"id"`
+	User     string                `json:"user"`
+	Password string                `json:"password"`
+	URL      string                `json:"url"`
+	Storage  string                `json:"storage,omitempty"` // Not memory
+	Data     map[string][]byte     `json:"data"`
+	Meta     map[string]*ValueMeta `json:"meta,omitempty"`
+	History  map[string][]*Value   `json:"history,omitempty"`
+	Typed    map[string]*Value     `json:"typed,omitempty"` // Not plain
+}
+
+type InstanceSnapshot struct {
+	DBID     string           `json:"dbID"`
+	Request  ProvisionRequest `json:"request"`
+	Bindings []string         `json:"bindings"`
+
+	// BindingID -> request, missing in older snapshots
+	BindRequests map[string]*BindRequest `json:"bindRequests,omitempty"`
+}
+
+// instance turns is back into an Instance, using db
+func (is *InstanceSnapshot) instance(db *DB) *Instance {
+	instance := &Instance{
+		DB:       db,
+		Request:  is.Request,
+		Bindings: map[string]interface{}{},
+	}
+	for _, bID := range is.Bindings {
+		bReq := is.BindRequests[bID]
+		if bReq == nil {
+			bReq = &BindRequest{}
+		}
+		instance.Bindings[bID] = bReq
+	}
+	return instance
+}
+
+// TakeSnapshot returns a copy of the state of all DBs and Instances
+func (s *Server) TakeSnapshot() *Snapshot {
+	snap := &Snapshot{
+		DBs:       []*DBSnapshot{},
+		Instances: map[string]*InstanceSnapshot{},
+	}
+
+	s.newDBIDMutex.Lock()
+	snap.LastID = s.lastID
+	s.newDBIDMutex.Unlock()
+
+	s.dbMapMutex.Lock()
+	for _, db := range s.DBs {
+		db.mutex.Lock()
+		ds := &DBSnapshot{
+			ID:       db.ID,
+			User:     db.User,
+			Password: db.Password,
+			URL:      db.URL,
+			Storage:  db.Storage,
+			Data:     map[string][]byte{},
+			Meta:     map[string]*ValueMeta{},
+		}
+		// Other stores save their own data
+		if db.Storage == StorageMemory {
+			db.Data.Range("", "", func(k string, v *Value) bool {
+				if v.Type != TypeString {
+					if ds.Typed == nil {
+						ds.Typed = map[string]*Value{}
+					}
+					ds.Typed[k] = v.Copy()
+					return true
+				}
+				vm := v.ValueMeta
+				ds.Data[k] = v.Data
+				ds.Meta[k] = &vm
+				return true
+			})
+		}
+		for k, h := range db.History {
+			if ds.History == nil {
+				ds.History = map[string][]*Value{}
+			}
+			ds.History[k] = append([]*Value{}, h...)
+		}
+		db.mutex.Unlock()
+
+		snap.DBs = append(snap.DBs, ds)
+	}
+	s.dbMapMutex.Unlock()
+	sort.Slice(snap.DBs, func(i, j int) bool {
+		return snap.DBs[i].ID < snap.DBs[j].ID
+	})
+
+	s.instanceMutex.Lock()
+	for id, instance := range s.Instances {
+		snap.Instances[id] = newInstanceSnapshot(instance)
+	}
+	s.instanceMutex.Unlock()
+
+	return snap
+}
+
+func newInstanceSnapshot(instance *Instance) *InstanceSnapshot {
+	is := &InstanceSnapshot{
+		DBID:     instance.DB.ID,
+		Request:  instance.Request,
+		Bindings: []string{},
+	}
+	for bID, binding := range instance.Bindings {
+		is.Bindings = append(is.Bindings, bID)
+		if bReq, ok := binding.(*BindRequest); ok {
+			if is.BindRequests == nil {
+				is.BindRequests = map[string]*BindRequest{}
+			}
+			is.BindRequests[bID] = bReq
+		}
+	}
+	sort.Strings(is.Bindings)
+	return is
+}
+
+// RestoreSnapshot replaces all DBs and Instances with the ones in snap
+func (s *Server) RestoreSnapshot(snap *Snapshot) error {
+	dbs := map[string]*DB{}
+	// On an error, don't leave the files of any on-disk stores open
+	closeDBs := func() {
+		for _, db := range dbs {
+			db.Data.Close()
+		}
+	}
+	for _, ds := range snap.DBs {
+		data, err := s.newStore(ds.ID, ds.Storage)
+		if err != nil {
+			closeDBs()
+			return fmt.Errorf("Can't load DB %s: %s", ds.ID, err)
+		}
+		for k, d := range ds.Data {
+			v := &Value{Data: d}
+			if vm := ds.Meta[k]; vm != nil {
+				v.ValueMeta = *vm
+			}
+			if v.Version == 0 {
+				v.Version = 1 // From before we had versions
+			}
+			data.Put(k, v)
+		}
+		for k, v := range ds.Typed {
+			data.Put(k, v)
+		}
+		dbs[ds.ID] = &DB{
+			ID:       ds.ID,
+			User:     ds.User,
+			Password: ds.Password,
+			URL:      ds.URL,
+			Storage:  ds.Storage,
+			Data:     data,
+			History:  ds.History,
+		}
+	}
+
+	instances := map[string]*Instance{}
+	for id, is := range snap.Instances {
+		db := dbs[is.DBID]
+		if db == nil {
+			closeDBs()
+			return fmt.Errorf("Instance %s refers to missing DB %s", id,
+				is.DBID)
+		}
+		instances[id] = is.instance(db)
+	}
+
+	s.newDBIDMutex.Lock()
+	s.lastID = snap.LastID
+	s.newDBIDMutex.Unlock()
+
+	s.dbMapMutex.Lock()
+	atomic.StoreInt64(&s.memUsed, 0)
+	for _, db := range dbs {
+		s.trackDB(db)
+	}
+	s.DBs = dbs
+	s.dbMapMutex.Unlock()
+
+	s.instanceMutex.Lock()
+	s.Instances = instances
+	s.instanceMutex.Unlock()
+	return nil
+}
+
+// stateChanged notes that DBs or Instances (or Bindings) were added or
+// removed, so a snapshot needs to be saved. See SaveChanges.
+func (s *Server) stateChanged() {
+	atomic.StoreInt32(&s.stateDirty, 1)
+}
+
+// SaveChanges saves a snapshot if DBs or Instances were added or removed
+// since the last one. Otherwise, after a crash, the data of on-disk DBs
+// would be left behind with nothing saying who it belongs to. Must not be
+// called with any of the server's locks held.
+func (s *Server) SaveChanges() error {
+	if s.config.DataDir == "" || atomic.LoadInt32(&s.stateDirty) == 0 {
+		return nil
+	}
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	// Someone else may have just saved it
+	if atomic.LoadInt32(&s.stateDirty) == 0 {
+		return nil
+	}
+	return s.saveSnapshot()
+}
+
+// saveChanges is SaveChanges for when there's no one to return an error to
+func (s *Server) saveChanges() {
+	if err := s.SaveChanges(); err != nil {
+		s.Debug(1, "%s\n", err)
+	}
+}
+
+// SaveSnapshot writes the state of the server to Config.DataDir. The
+// file is written to a temp file first so a crash won't leave a partial
+// snapshot behind.
+func (s *Server) SaveSnapshot() error {
+	if s.config.DataDir == "" {
+		return nil
+	}
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+	return s.saveSnapshot()
+}
+
+// saveSnapshot must be called with s.snapshotMutex held
+func (s *Server) saveSnapshot() error {
+	// Clear it first so changes made while saving aren't lost
+	atomic.StoreInt32(&s.stateDirty, 0)
+	err := s.writeSnapshot()
+	if err != nil {
+		s.stateChanged() // Try again next time
+	}
+	return err
+}
+
+func (s *Server) writeSnapshot() error {
+	buf, err := json.MarshalIndent(s.TakeSnapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Can't serialize snapshot: %s", err)
+	}
+
+	if err = os.MkdirAll(s.config.DataDir, 0700); err != nil {
+		return fmt.Errorf("Can't create data dir: %s", err)
+	}
+
+	file := filepath.Join(s.config.DataDir, SnapshotFile)
+	if err = ioutil.WriteFile(file+".tmp", buf, 0600); err != nil {
+		return fmt.Errorf("Can't write snapshot: %s", err)
+	}
+	if err = os.Rename(file+".tmp", file); err != nil {
+		return fmt.Errorf("Can't write snapshot: %s", err)
+	}
+
+	s.Debug(1, "Saved snapshot to %s\n", file)
+	return nil
+}
+
+// LoadSnapshot restores the state of the server from Config.DataDir, if
+// there's a snapshot there.
+func (s *Server) LoadSnapshot() error {
+	if s.config.DataDir == "" {
+		return nil
+	}
+
+	file := filepath.Join(s.config.DataDir, SnapshotFile)
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Can't read snapshot: %s", err)
+	}
+
+	snap := Snapshot{}
+	if err = json.Unmarshal(buf, &snap); err != nil {
+		return fmt.Errorf("Can't parse snapshot %q: %s", file, err)
+	}
+
+	if err = s.RestoreSnapshot(&snap); err != nil {
+		return err
+	}
+
+	s.Debug(1, "Loaded %d DBs and %d instances from %s\n", len(snap.DBs),
+		len(snap.Instances), file)
+	return nil
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"math/rand"
+)
+
+/* Store Stuff */
+/***************/
+
+// Store is where a DB keeps its keys, in key order. Implementations don't
+// need to be safe for concurrent use since they're only used with the
+// DB's mutex held.
+//
+// Lists, hashes and other typed values are changed in place, so a Store
+// may hand back a Value that's shared with its own copy, but callers must
+// still Put it back after changing it so stores that keep their own copy
+// (e.g. on disk) see the change.
+type Store interface {
+	Get(key string) *Value
+	Put(key string, v *Value)
+	Delete(key string) bool // false if it wasn't there
+	Len() int
+
+	// Range calls fn, in key order, for each key >= start and < end until
+	// fn returns false. An empty end means there's no upper bound.
+	Range(start, end string, fn func(key string, v *Value) bool)
+
+	// Snapshot returns a read-only copy of the Store, as of now, that
+	// won't see any later changes. The Values themselves may be shared.
+	Snapshot() Store
+
+	// Err returns the first error the Store ran into, e.g. a failed disk
+	// write, since none of the calls above return one
+	Err() error
+
+	// Close releases the Store's resources, and Drop also deletes anything
+	// it saved. Neither can be undone.
+	Close() error
+	Drop() error
+}
+
+// Kinds of storage a Plan can ask for
+const (
+	StorageMemory = "" // MemStore
+	StorageDisk   = "disk"
+)
+
+// PrefixEnd returns the first key after all of the ones that start with
+// prefix, for use as the end of a Range. "" means there isn't one.
+func PrefixEnd(prefix string) string {
+	buf := []byte(prefix)
+	for i := len(buf) - 1; i >= 0; i-- {
+		if buf[i] < 0xff {
+			buf[i]++
+			return string(buf[:i+1])
+		}
+	}
+	return ""
+}
+
+// MemStore is an in-memory Store
+type MemStore struct {
+	tree *treap
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{tree: newTreap()}
+}
+
+func (m *MemStore) Get(key string) *Value {
+	if v, ok := m.tree.get(key); ok {
+		return v.(*Value)
+	}
+	return nil
+}
+
+func (m *MemStore) Put(key string, v *Value) {
+	m.tree.put(key, v)
+}
+
+func (m *MemStore) Delete(key string) bool {
+	_, ok := m.tree.delete(key)
+	return ok
+}
+
+func (m *MemStore) Len() int {
+	return m.tree.size
+}
+
+func (m *MemStore) Range(start, end string, fn func(string, *Value) bool) {
+	m.tree.walk(start, end, func(key string, v interface{}) bool {
+		return fn(key, v.(*Value))
+	})
+}
+
+func (m *MemStore) Snapshot() Store {
+	return m.Clone()
+}
+
+// Clone returns a copy of m that, unlike a Snapshot, can be changed. Like
+// a Snapshot it's O(1), the two share what they haven't changed.
+func (m *MemStore) Clone() *MemStore {
+	return &MemStore{tree: m.tree.clone()}
+}
+
+func (m *MemStore) Err() error   { return nil }
+func (m *MemStore) Close() error { return nil }
+func (m *MemStore) Drop() error  { return nil }
+
+// treap is an ordered map of string to whatever. It's a binary tree that's
+// kept balanced by giving each node a random priority. Nodes are copied
+// on write once they're shared with a clone, so clone is O(1) and
+// everything else is O(log n).
+type treap struct {
+	root  *treapNode
+	size  int
+	owner *treapOwner
+}
+
+type treapNode struct {
+	key         string
+	value       interface{}
+	prio        uint32
+	left, right *treapNode
+	owner       *treapOwner // Only the tree with this owner can change it
+}
+
+// Not zero sized so that each one has its own address
+type treapOwner struct{ _ byte }
+
+func newTreap() *treap {
+	return &treap{owner: &treapOwner{}}
+}
+
+// mutable returns a copy of n that this tree is allowed to change
+func (t *treap) mutable(n *treapNode) *treapNode {
+	if n.owner == t.owner {
+		return n
+	}
+	tmp := *n
+	tmp.owner = t.owner
+	return &tmp
+}
+
+func (t *treap) get(key string) (interface{}, bool) {
+	for n := t.root; n != nil; {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n.value, true
+		}
+	}
+	return nil, false
+}
+
+// put returns the old value, if there was one
+func (t *treap) put(key string, v interface{}) (old interface{}) {
+	t.root = t.insert(t.root, key, v, &old)
+	return old
+}
+
+func (t *treap) insert(n *treapNode, key string, v interface{}, old *interface{}) *treapNode {
+	if n == nil {
+		t.size++
+		return &treapNode{key: key, value: v, prio: rand.Uint32(),
+			owner: t.owner}
+	}
+
+	n = t.mutable(n)
+	switch {
+	case key < n.key:
+		n.left = t.insert(n.left, key, v, old)
+		if n.left.prio > n.prio {
+			// Rotate right, n.left is already ours
+			l := n.left
+			n.left, l.right = l.right, n
+			return l
+		}
+	case key > n.key:
+		n.right = t.insert(n.right, key, v, old)
+		if n.right.prio > n.prio {
+			r := n.right
+			n.right, r.left = r.left, n
+			return r
+		}
+	default:
+		*old, n.value = n.value, v
+	}
+	return n
+}
+
+func (t *treap) delete(key string) (interface{}, bool) {
+	var old interface{}
+	root, ok := t.remove(t.root, key, &old)
+	if ok {
+		t.root = root
+		t.size--
+	}
+	return old, ok
+}
+
+// remove doesn't copy anything unless key is there
+func (t *treap) remove(n *treapNode, key string, old *interface{}) (*treapNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	switch {
+	case key < n.key:
+		l, ok := t.remove(n.left, key, old)
+		if !ok {
+			return n, false
+		}
+		n = t.mutable(n)
+		n.left = l
+	case key > n.key:
+		r, ok := t.remove(n.right, key, old)
+		if !ok {
+			return n, false
+		}
+		n = t.mutable(n)
+		n.right = r
+	default:
+		*old = n.value
+		return t.merge(n.left, n.right), true
+	}
+	return n, true
+}
+
+// merge joins two trees where all of a's keys are less than b's
+func (t *treap) merge(a, b *treapNode) *treapNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a = t.mutable(a)
+		a.right = t.merge(a.right, b)
+		return a
+	}
+	b = t.mutable(b)
+	b.left = t.merge(a, b.left)
+	return b
+}
+
+// walk calls fn, in order, for keys >= start and < end ("" means no end)
+// until fn returns false
+func (t *treap) walk(start, end string, fn func(string, interface{}) bool) {
+	walkNodes(t.root, start, end, fn)
+}
+
+// walkNodes returns false once fn does, so we can stop
+func walkNodes(n *treapNode, start, end string, fn func(string, interface{}) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.key >= start {
+		if !walkNodes(n.left, start, end, fn) {
+			return false
+		}
+		if end != "" && n.key >= end {
+			return false
+		}
+		if !fn(n.key, n.value) {
+			return false
+		}
+	}
+	return walkNodes(n.right, start, end, fn)
+}
+
+func (t *treap) clone() *treap {
+	// Neither tree owns the current nodes any more, so the next change to
+	// either one will copy what it touches
+	t.owner = &treapOwner{}
+	return &treap{root: t.root, size: t.size, owner: &treapOwner{}}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Watch/List Stuff */
+/********************/
+
+// WatchEvent is sent to watchers each time a key changes. Value is
+// base64 encoded in the JSON.
+type WatchEvent struct {
+	Op    string `json:"op"` // set or delete
+	Key   string `json:"key"`
+	Field string `json:"field,omitempty"` // Field/member of a typed value
+	Value []byte `json:"value,omitempty"`
+	Null  bool   `json:"null,omitempty"` // Value was set to nil (X-NULL)
+}
+
+// Max number of events we'll queue up for a watcher before giving up on it
+var WatchQueueSize = 100
+
+type Watcher struct {
+	Prefix string
+	Events chan *WatchEvent // Closed when the watch is over
+}
+
+// Watch registers interest in all keys starting with prefix. Caller must
+// call Unwatch when done.
+func (db *DB) Watch(prefix string) *Watcher {
+	w := &Watcher{
+		Prefix: prefix,
+		Events: make(chan *WatchEvent, WatchQueueSize),
+	}
+
+	db.mutex.Lock()
+	if db.watchers == nil {
+		db.watchers = map[*Watcher]bool{}
+	}
+	db.watchers[w] = true
+	db.mutex.Unlock()
+	return w
+}
+
+func (db *DB) Unwatch(w *Watcher) {
+	db.mutex.Lock()
+	if db.watchers[w] {
+		delete(db.watchers, w)
+		close(w.Events)
+	}
+	db.mutex.Unlock()
+}
+
+// Notify sends the event to all interested watchers. Must be called with
+// db.mutex held. Watchers that can't keep up are dropped.
+func (db *DB) Notify(ev *WatchEvent) {
+	for w := range db.watchers {
+		if !strings.HasPrefix(ev.Key, w.Prefix) {
+			continue
+		}
+		select {
+		case w.Events <- ev:
+		default:
+			delete(db.watchers, w)
+			close(w.Events)
+		}
+	}
+}
+
+// CloseWatchers ends all watches, e.g. when the DB is deleted
+func (db *DB) CloseWatchers() {
+	db.mutex.Lock()
+	for w := range db.watchers {
+		delete(db.watchers, w)
+		close(w.Events)
+	}
+	db.mutex.Unlock()
+}
+
+// Keys returns the sorted list of keys that start with prefix
+func (db *DB) Keys(prefix string) []string {
+	keys, _ := db.KeyRange(prefix, PrefixEnd(prefix), 0)
+	return keys
+}
+
+// KeyRange returns, in order, up to limit (0 means no limit) keys that are
+// >= start and < end ("" means no end). If there are more, next is the
+// key to use as the start of the next call.
+func (db *DB) KeyRange(start, end string, limit int) (keys []string, next string) {
+	keys = []string{}
+	db.mutex.Lock()
+	db.Data.Range(start, end, func(k string, v *Value) bool {
+		if limit > 0 && len(keys) == limit {
+			next = k
+			return false
+		}
+		keys = append(keys, k)
+		return true
+	})
+	db.mutex.Unlock()
+	return keys, next
+}
+
+// NextKeyHeader holds the start of the next page of a _keys call that hit
+// its limit
+const NextKeyHeader = "X-Next-Key"
+
+// DBKeysHandler returns the sorted list of keys as a JSON array:
+//
+//	GET /db/{dbID}/_keys?prefix=abc
+//	GET /db/{dbID}/_keys?start=a&end=b&limit=100
+//
+// start is inclusive, end isn't, and they can be used along with prefix.
+// If limit cut the list short, the X-Next-Key header has the start of
+// the next page.
+func (s *Server) DBKeysHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := intParam(r, "limit", 0)
+	if err != nil || limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid 'limit' query parameter\n")
+		return
+	}
+	prefix := query.Get("prefix")
+	start, end := prefix, PrefixEnd(prefix)
+	if str := query.Get("start"); str > start {
+		start = str
+	}
+	if str := query.Get("end"); str != "" && (end == "" || str < end) {
+		end = str
+	}
+
+	keys, next := db.KeyRange(start, end, limit)
+	if next != "" {
+		w.Header().Set(NextKeyHeader, next)
+	}
+	WriteJSON(w, keys)
+}
+
+// DBWatchHandler streams a WatchEvent, as one line of JSON, for each
+// change to the keys that start with the "prefix" query parameter. The
+// stream ends when the client goes away, the DB is deleted, or the
+// server is shutting down.
+func (s *Server) DBWatchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.VerifyBasicAuth(w, r, db.User, db.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Streams can last a lot longer than the server's WriteTimeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	watcher := db.Watch(r.URL.Query().Get("prefix"))
+	defer db.Unwatch(watcher)
+	s.Debug(3, "DB %s: Watch started on %q\n", db.ID, watcher.Prefix)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if enc.Encode(ev) != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.Done():
+			return
+		}
+	}
+}
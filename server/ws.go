@@ -0,0 +1,341 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+/* WebSocket Stuff */
+/*******************/
+
+// The _ws endpoint lets a client, like a browser, do DB operations over
+// one connection. Each text message from the client is a WSRequest, and
+// each one gets a WSResponse back with the same ID:
+//
+//	{"id":1,"op":"set","key":"abc","value":"aGk="}
+//	{"id":2,"op":"get","key":"abc"}
+//	{"id":3,"op":"delete","key":"abc"}
+//	{"id":4,"op":"list","prefix":"a"}
+//	{"id":5,"op":"watch","prefix":"a"}
+//	{"id":6,"op":"unwatch","watch":5}
+//
+// Values are base64 encoded. Status is the HTTP status code the same
+// operation would get from the REST API. Events for a watch are sent as
+// WSResponses with the ID of the watch request and the WatchEvent in
+// "event".
+//
+// Browsers can't add an Authorization header to a WebSocket, and may send
+// one they've cached, so the header is only used for same-origin (or
+// non-browser) clients. Everyone else has to send
+// {"op":"auth","user":"...","password":"..."} first.
+
+type WSRequest struct {
+	ID       int64  `json:"id,omitempty"`
+	Op       string `json:"op"` // auth, get, set, delete, list, watch, unwatch
+	Key      string `json:"key,omitempty"`
+	Value    []byte `json:"value,omitempty"`
+	Null     bool   `json:"null,omitempty"` // For set, like X-NULL
+	Prefix   string `json:"prefix,omitempty"`
+	Watch    int64  `json:"watch,omitempty"` // ID of the watch to unwatch
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type WSResponse struct {
+	ID      int64       `json:"id,omitempty"`
+	Status  int         `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Value   []byte      `json:"value,omitempty"`
+	Null    bool        `json:"null,omitempty"`
+	Version int         `json:"version,omitempty"`
+	Keys    []string    `json:"keys,omitempty"`
+	Event   *WatchEvent `json:"event,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// Auth is checked per connection (see above), so any origin is ok
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// sameOrigin is true if the request didn't come from a page on some other
+// site
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsConn is one _ws connection. gorilla's Conn allows only one writer at
+// a time so all writes go through send.
+type wsConn struct {
+	s        *Server
+	db       *DB
+	conn     *websocket.Conn
+	authed   bool
+	writeMu  sync.Mutex
+	watchers map[int64]*Watcher
+	wg       sync.WaitGroup
+}
+
+// wsWriteTimeout is how long we'll wait on a client that isn't reading
+var wsWriteTimeout = 10 * time.Second
+
+func (c *wsConn) send(res *WSResponse) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(res)
+}
+
+func (c *wsConn) ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteControl(websocket.PingMessage, nil,
+		time.Now().Add(wsWriteTimeout))
+}
+
+func (s *Server) DBWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	db := s.getDB(vars["dbID"])
+	if db == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// A bad Authorization header fails right away, a missing one means
+	// we'll wait for an "auth" message
+	_, _, hasAuth := r.BasicAuth()
+	authed := s.VerifyBasicAuth(w, r, db.User, db.Password)
+	if hasAuth && !authed {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if hasAuth && !sameOrigin(r) {
+		authed = s.config.DisableAuth || db.User == ""
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already sent back an error
+		s.Debug(3, "DB %s: WebSocket upgrade failed: %s\n", db.ID, err)
+		return
+	}
+	defer conn.Close()
+	// Values are base64 encoded so leave room for that
+	conn.SetReadLimit(s.config.MaxValueSize/3*4 + 64*1024)
+
+	c := &wsConn{
+		s:        s,
+		db:       db,
+		conn:     conn,
+		authed:   authed,
+		watchers: map[int64]*Watcher{},
+	}
+	s.Debug(3, "DB %s: WebSocket connected\n", db.ID)
+
+	// Reads happen in their own goroutine so we notice shutdowns
+	reqs := make(chan *WSRequest)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			req := &WSRequest{}
+			if err := conn.ReadJSON(req); err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(SubPingInterval)
+	defer ticker.Stop()
+	defer func() {
+		for id, watcher := range c.watchers {
+			db.Unwatch(watcher)
+			delete(c.watchers, id)
+		}
+		c.wg.Wait()
+	}()
+
+	for {
+		select {
+		case req := <-reqs:
+			if !c.handle(req) {
+				return
+			}
+		case err := <-readErr:
+			if _, ok := err.(*websocket.CloseError); !ok {
+				s.Debug(3, "DB %s: WebSocket error: %s\n", db.ID, err)
+			}
+			return
+		case <-ticker.C:
+			if c.ping() != nil {
+				return
+			}
+		case <-s.Done():
+			c.writeMu.Lock()
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway,
+					"Server is shutting down"),
+				time.Now().Add(time.Second))
+			c.writeMu.Unlock()
+			return
+		}
+	}
+}
+
+// handle does one request. Returns false if the connection should be
+// closed.
+func (c *wsConn) handle(req *WSRequest) bool {
+	s, db := c.s, c.db
+	res := &WSResponse{ID: req.ID, Status: http.StatusOK}
+
+	if !c.authed && req.Op != "auth" {
+		res.Status = http.StatusUnauthorized
+		res.Error = "Must send an 'auth' request first"
+		c.send(res)
+		return false
+	}
+
+	if (req.Op == "set" || req.Op == "delete") && s.ReadOnly() {
+		res.Status = http.StatusMisdirectedRequest
+		res.Error = "This server is a read-only follower of " +
+			s.ReplicationStatus().Leader
+		return c.send(res) == nil
+	}
+
+	switch req.Op {
+	case "auth":
+		c.authed = s.config.DisableAuth || db.User == "" ||
+			(req.User == db.User && req.Password == db.Password)
+		if !c.authed {
+			res.Status = http.StatusUnauthorized
+			res.Error = "Invalid user or password"
+			c.send(res)
+			return false
+		}
+
+	case "get":
+		if req.Key == "" {
+			res.Status, res.Error = http.StatusBadRequest, "Missing 'key'"
+			break
+		}
+		db.mutex.Lock()
+		v := db.Data.Get(req.Key)
+		db.mutex.Unlock()
+		switch {
+		case v == nil:
+			res.Status = http.StatusNotFound
+		case v.Type != TypeString:
+			res.Status = http.StatusConflict
+			res.Error = fmt.Sprintf("Key %q is a %s", req.Key,
+				typeName(v.Type))
+		default:
+			res.Value, res.Version = v.Data, v.Version
+			if v.Data == nil {
+				res.Status, res.Null = http.StatusNoContent, true
+			}
+		}
+
+	case "set":
+		if req.Key == "" {
+			res.Status, res.Error = http.StatusBadRequest, "Missing 'key'"
+			break
+		}
+		data := req.Value
+		if req.Null {
+			data = nil
+		} else if data == nil {
+			data = []byte{}
+		}
+		if int64(len(data)) > s.config.MaxValueSize {
+			res.Status = http.StatusRequestEntityTooLarge
+			res.Error = fmt.Sprintf("Value is larger than %d bytes",
+				s.config.MaxValueSize)
+			break
+		}
+		v := &Value{Data: data, ValueMeta: ValueMeta{
+			Modified: time.Now().UTC(),
+		}}
+		db.mutex.Lock()
+		need := db.setNeed(req.Key, v, s.config.MaxVersions)
+		if !s.makeRoom(db, req.Key, need) {
+			db.mutex.Unlock()
+			res.Status = http.StatusInsufficientStorage
+			res.Error = fmt.Sprintf("Out of memory, can't add to DB %s",
+				db.ID)
+			break
+		}
+		db.SetValue(req.Key, v, s.config.MaxVersions)
+		db.mutex.Unlock()
+		res.Version = v.Version
+		s.Debug(3, "DB %s: Set %q via WebSocket (version %d)\n", db.ID,
+			req.Key, v.Version)
+
+	case "delete":
+		db.mutex.Lock()
+		ok := req.Key != "" && db.RemoveValue(req.Key, s.config.MaxVersions)
+		db.mutex.Unlock()
+		if !ok {
+			res.Status = http.StatusNotFound
+		}
+
+	case "list":
+		res.Keys = db.Keys(req.Prefix)
+
+	case "watch":
+		if req.ID == 0 || c.watchers[req.ID] != nil {
+			res.Status = http.StatusBadRequest
+			res.Error = "A watch needs a unique 'id'"
+			break
+		}
+		watcher := db.Watch(req.Prefix)
+		c.watchers[req.ID] = watcher
+		// Send the ok before any events
+		if c.send(res) != nil {
+			return false
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for ev := range watcher.Events {
+				if c.send(&WSResponse{ID: req.ID, Status: http.StatusOK,
+					Event: ev}) != nil {
+					return
+				}
+			}
+		}()
+		return true
+
+	case "unwatch":
+		watcher := c.watchers[req.Watch]
+		if watcher == nil {
+			res.Status = http.StatusNotFound
+			break
+		}
+		delete(c.watchers, req.Watch)
+		db.Unwatch(watcher)
+
+	default:
+		res.Status = http.StatusBadRequest
+		res.Error = fmt.Sprintf("Unknown op %q", req.Op)
+	}
+
+	return c.send(res) == nil
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Sorted Set Stuff */
+/********************/
+
+// ZItem is one member of a sorted set
+type ZItem struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func (a ZItem) less(b ZItem) bool {
+	return a.Score < b.Score || (a.Score == b.Score && a.Member < b.Member)
+}
+
+// SortedSet keeps its members ordered by score (then by member), so rank
+// and score range lookups are binary searches. Adds and removes have to
+// shift the slice, which is fine for the sizes a demo DB will see.
+type SortedSet struct {
+	scores map[string]float64
+	items  []ZItem
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{scores: map[string]float64{}, items: []ZItem{}}
+}
+
+func (z *SortedSet) Len() int {
+	return len(z.items)
+}
+
+// index returns where item is, or would be, in z.items
+func (z *SortedSet) index(item ZItem) int {
+	return sort.Search(len(z.items), func(i int) bool {
+		return !z.items[i].less(item)
+	})
+}
+
+// Add sets the score of member, adding it if needed. Returns true if it's
+// a new member.
+func (z *SortedSet) Add(member string, score float64) bool {
+	isNew := !z.Remove(member)
+	item := ZItem{Member: member, Score: score}
+	i := z.index(item)
+	z.items = append(z.items, ZItem{})
+	copy(z.items[i+1:], z.items[i:])
+	z.items[i] = item
+	z.scores[member] = score
+	return isNew
+}
+
+// Remove returns false if member wasn't there
+func (z *SortedSet) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	i := z.index(ZItem{Member: member, Score: score})
+	z.items = append(z.items[:i], z.items[i+1:]...)
+	delete(z.scores, member)
+	return true
+}
+
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Rank returns the 0-based position of member, lowest score first, or
+// highest first if rev is true
+func (z *SortedSet) Rank(member string, rev bool) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.index(ZItem{Member: member, Score: score})
+	if rev {
+		rank = len(z.items) - 1 - rank
+	}
+	return rank, true
+}
+
+// RangeByRank returns the members from rank start to stop, inclusive.
+// Negative ranks count from the end.
+func (z *SortedSet) RangeByRank(start, stop int, rev bool) []ZItem {
+	from, to := listRange(len(z.items), start, stop)
+	items := make([]ZItem, 0, to-from)
+	for i := from; i < to; i++ {
+		if rev {
+			items = append(items, z.items[len(z.items)-1-i])
+		} else {
+			items = append(items, z.items[i])
+		}
+	}
+	return items
+}
+
+// RangeByScore returns the members with min <= score <= max, up to limit
+// of them (0 means no limit)
+func (z *SortedSet) RangeByScore(min, max float64, rev bool, limit int) []ZItem {
+	lo := sort.Search(len(z.items), func(i int) bool {
+		return z.items[i].Score >= min
+	})
+	hi := sort.Search(len(z.items), func(i int) bool {
+		return z.items[i].Score > max
+	})
+	items := []ZItem{}
+	for i := lo; i < hi; i++ {
+		if limit > 0 && len(items) == limit {
+			break
+		}
+		if rev {
+			items = append(items, z.items[hi-1-(i-lo)])
+		} else {
+			items = append(items, z.items[i])
+		}
+	}
+	return items
+}
+
+func (z *SortedSet) Copy() *SortedSet {
+	tmp := NewSortedSet()
+	tmp.items = append(tmp.items, z.items...)
+	for k, v := range z.scores {
+		tmp.scores[k] = v
+	}
+	return tmp
+}
+
+// Sorted sets are saved as a list of ZItems, lowest score first
+func (z *SortedSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(z.items)
+}
+
+func (z *SortedSet) UnmarshalJSON(buf []byte) error {
+	items := []ZItem{}
+	if err := json.Unmarshal(buf, &items); err != nil {
+		return err
+	}
+	*z = *NewSortedSet()
+	for _, item := range items {
+		z.Add(item.Member, item.Score)
+	}
+	return nil
+}
+
+// A sorted set key holds unique members, each with a score:
+//
+//	GET    /db/{dbID}/{key}/_zset?start=0&stop=-1     range by rank
+//	GET    /db/{dbID}/{key}/_zset?min=1&max=10&limit=5 range by score
+//	GET    /db/{dbID}/{key}/_zset/{member}            score and rank
+//	PUT    /db/{dbID}/{key}/_zset/{member}?score=N
+//	POST   /db/{dbID}/{key}/_zset/{member}?op=incr&by=N
+//	DELETE /db/{dbID}/{key}/_zset/{member}
+//
+// Add "rev=true" to a GET for highest scores first. min and max can be
+// "-inf" and "+inf". Empty sorted sets are deleted.
+
+func parseScore(r *http.Request, name string, def float64) (float64, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		if math.IsNaN(def) {
+			return 0, fmt.Errorf("Missing %q query parameter", name)
+		}
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("Invalid %q query parameter: %q", name, str)
+	}
+	return f, nil
+}
+
+func (s *Server) DBZSetRangeHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	rev := query.Get("rev") == "true"
+	byScore := query.Get("min") != "" || query.Get("max") != ""
+
+	var err error
+	var start, stop, limit int
+	var min, max float64
+	if byScore {
+		if min, err = parseScore(r, "min", math.Inf(-1)); err == nil {
+			max, err = parseScore(r, "max", math.Inf(1))
+		}
+		if err == nil {
+			limit, err = intParam(r, "limit", 0)
+		}
+	} else {
+		if start, err = intParam(r, "start", 0); err == nil {
+			stop, err = intParam(r, "stop", -1)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeZSet) {
+		db.mutex.Unlock()
+		return
+	}
+	items := []ZItem{}
+	length := 0
+	if v != nil {
+		length = v.ZSet.Len()
+		if byScore {
+			items = v.ZSet.RangeByScore(min, max, rev, limit)
+		} else {
+			items = v.ZSet.RangeByRank(start, stop, rev)
+		}
+	}
+	db.mutex.Unlock()
+
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+	WriteJSON(w, items)
+}
+
+// ZRankInfo is returned when asking about one member
+type ZRankInfo struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	Rank   int     `json:"rank"`
+}
+
+func (s *Server) DBZSetGetHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, member := vars["key"], vars["member"]
+	rev := r.URL.Query().Get("rev") == "true"
+
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeZSet) {
+		db.mutex.Unlock()
+		return
+	}
+	var info *ZRankInfo
+	if v != nil {
+		if rank, ok := v.ZSet.Rank(member, rev); ok {
+			score, _ := v.ZSet.Score(member)
+			info = &ZRankInfo{Member: member, Score: score, Rank: rank}
+		}
+	}
+	db.mutex.Unlock()
+
+	if info == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, info)
+}
+
+// DBZSetAddHandler handles both setting (PUT) and incrementing (POST) the
+// score of a member. The new score is returned.
+func (s *Server) DBZSetAddHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	incr := r.Method == "POST"
+	var n float64
+	var err error
+	if incr {
+		if op := r.URL.Query().Get("op"); op != "incr" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unknown op %q\n", op)
+			return
+		}
+		n, err = parseScore(r, "by", 1)
+	} else {
+		n, err = parseScore(r, "score", math.NaN())
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, member := vars["key"], vars["member"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeZSet) {
+		db.mutex.Unlock()
+		return
+	}
+	need := db.addNeed(key, int64(72+2*len(member)))
+	if !s.MakeRoom(w, db, key, need) {
+		db.mutex.Unlock()
+		return
+	}
+	if v == nil {
+		v = db.NewTypedValue(key, TypeZSet)
+	}
+	score := n
+	if incr {
+		old, _ := v.ZSet.Score(member)
+		score = old + n
+	}
+	if math.IsNaN(score) || math.IsInf(score, 0) {
+		db.mutex.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Score must be a finite number\n")
+		return
+	}
+	v.ZSet.Add(member, score)
+	v.Modified = time.Now().UTC()
+	db.Data.Put(key, v)
+	length := v.ZSet.Len()
+	scoreStr := strconv.FormatFloat(score, 'g', -1, 64)
+	db.Notify(&WatchEvent{Op: "zadd", Key: key, Field: member,
+		Value: []byte(scoreStr)})
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Set score of %q in %q to %s\n", db.ID, member, key,
+		scoreStr)
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s", scoreStr)
+}
+
+func (s *Server) DBZSetRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	db := s.typedDB(w, r)
+	if db == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, member := vars["key"], vars["member"]
+	db.mutex.Lock()
+	v := db.Data.Get(key)
+	if !CheckType(w, key, v, TypeZSet) {
+		db.mutex.Unlock()
+		return
+	}
+	if v == nil || !v.ZSet.Remove(member) {
+		db.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	v.Modified = time.Now().UTC()
+	length := v.ZSet.Len()
+	db.Notify(&WatchEvent{Op: "zrem", Key: key, Field: member})
+	if length == 0 {
+		db.Data.Delete(key)
+	} else {
+		db.Data.Put(key, v)
+	}
+	db.mutex.Unlock()
+
+	s.Debug(3, "DB %s: Removed %q from %q\n", db.ID, member, key)
+	w.Header().Set(LengthHeader, strconv.Itoa(length))
+}